@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+/*
+ * Admission control for new processes, based on the backlog of the job queue.
+ *
+ * When the fetch workers can't keep up, the job queue grows and every new
+ * process waits longer for its tasks to be picked up. Rather than handing out
+ * promises that take minutes to keep (and surface as timeouts in the client),
+ * queries are rejected with a BUSY error when the queue the process would go
+ * on is over the limits. The client can back off and retry, and the overload
+ * is visible immediately.
+ *
+ * The wait is estimated by how long the oldest task in the queue has waited.
+ * The queue of every priority class is checked on its own, so that a deep
+ * batch queue does not turn away interactive queries.
+ */
+type admission struct {
+	jobs     queue.Jobs
+	/*
+	 * Max tasks in the queue, including the tasks of the new process. Zero
+	 * (or less) is unlimited.
+	 */
+	maxdepth int
+	/*
+	 * Max estimated wait. Zero (or less) is unlimited.
+	 */
+	maxwait  time.Duration
+}
+
+/*
+ * The retry-after hint when the queue is too deep, but the wait is unknown
+ * or short.
+ */
+const busyRetryAfter = 5 * time.Second
+
+func (a *admission) enabled() bool {
+	return a != nil && (a.maxdepth > 0 || a.maxwait > 0)
+}
+
+/*
+ * Check that a process of ntasks can be admitted to the queue of the
+ * priority class. Errors reading the backlog do not reject the process - if
+ * the queue is unavailable, scheduling will fail anyway.
+ */
+func (a *admission) admit(
+	ctx      context.Context,
+	pid      string,
+	priority queue.Priority,
+	ntasks   int,
+) error {
+	if !a.enabled() {
+		return nil
+	}
+	backlog, err := a.jobs.Backlog(ctx, priority)
+	if err != nil {
+		zap.L().Warn(
+			"unable to read job queue backlog",
+			logging.Pid(pid),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	wait := backlog.Wait()
+	retryAfter := wait
+	if retryAfter < busyRetryAfter {
+		retryAfter = busyRetryAfter
+	}
+	if a.maxwait > 0 && wait > a.maxwait {
+		admissionRejections.WithLabelValues(priority.String(), "wait").Inc()
+		msg := "Busy: the %s queue has an estimated wait of %s"
+		return internal.Busy(
+			fmt.Sprintf(msg, priority, wait.Round(time.Second)),
+			retryAfter,
+		)
+	}
+	if a.maxdepth > 0 && backlog.Tasks + ntasks > a.maxdepth {
+		admissionRejections.WithLabelValues(priority.String(), "depth").Inc()
+		msg := "Busy: the %s queue has %d tasks waiting"
+		return internal.Busy(
+			fmt.Sprintf(msg, priority, backlog.Tasks),
+			retryAfter,
+		)
+	}
+	return nil
+}
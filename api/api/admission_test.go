@@ -0,0 +1,51 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal"
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+func TestAdmissionDisabledAdmitsAll(t *testing.T) {
+	var a *admission
+	err := a.admit(context.Background(), "pid", queue.Interactive, 1000)
+	assert.NoError(t, err)
+}
+
+func TestAdmissionRejectsDeepQueue(t *testing.T) {
+	ctx  := context.Background()
+	jobs := queue.NewMemoryJobs()
+	jobs.Enqueue(ctx, make([]queue.Task, 8)...)
+	a := &admission { jobs: jobs, maxdepth: 10 }
+
+	assert.NoError(t, a.admit(ctx, "pid", queue.Interactive, 2))
+	err := a.admit(ctx, "pid", queue.Interactive, 3)
+	busy, ok := err.(*internal.BusyE)
+	if !assert.True(t, ok, "want BusyE; was %T", err) {
+		return
+	}
+	assert.Equal(t, "BUSY", busy.Extensions()["code"])
+	assert.Equal(t, 5, busy.Extensions()["retryAfter"])
+
+	/*
+	 * The batch queue is empty, and is checked on its own
+	 */
+	assert.NoError(t, a.admit(ctx, "pid", queue.Batch, 3))
+}
+
+func TestAdmissionRejectsLongWait(t *testing.T) {
+	ctx  := context.Background()
+	jobs := queue.NewMemoryJobs()
+	a    := &admission { jobs: jobs, maxwait: 10 * time.Millisecond }
+	jobs.Enqueue(ctx, queue.Task { Pid: "pid" })
+	assert.NoError(t, a.admit(ctx, "pid", queue.Interactive, 1))
+
+	time.Sleep(20 * time.Millisecond)
+	err := a.admit(ctx, "pid", queue.Interactive, 1)
+	assert.IsType(t, &internal.BusyE{}, err)
+}
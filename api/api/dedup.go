@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/dedup"
+	"github.com/equinor/oneseismic/api/internal/logging"
+)
+
+/*
+ * The identity of a query, i.e. what makes two queries identical. Two
+ * queries are identical if they ask the same function with the same
+ * arguments and options, of the same version (ETag) of the same cube.
+ *
+ * The priority and retention are not part of the identity (nor the json of
+ * the opts), since they do not change the result.
+ */
+func queryIdentity(
+	endpoint string,
+	guid     string,
+	etag     string,
+	function string,
+	args     interface{},
+	opts     interface{},
+) (string, error) {
+	identity, err := json.Marshal(struct {
+		Endpoint string      `json:"endpoint"`
+		Guid     string      `json:"guid"`
+		ETag     string      `json:"etag"`
+		Function string      `json:"function"`
+		Args     interface{} `json:"args"`
+		Opts     interface{} `json:"opts"`
+	} {
+		Endpoint: endpoint,
+		Guid:     guid,
+		ETag:     etag,
+		Function: function,
+		Args:     args,
+		Opts:     opts,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(identity)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/*
+ * Get a promise for the process of an identical query, if there is one, or
+ * nil. The token is valid for the retention the caller asked for, or for as
+ * long as the result is kept, whichever is shorter.
+ *
+ * The caller must be allowed to read the cube, which Cube() checks when it
+ * fetches the manifest with the caller's credentials.
+ *
+ * Deduplication is best-effort; should the store fail, the query is planned
+ * and scheduled as usual.
+ */
+func reuse(
+	ctx       context.Context,
+	qctx      *queryContext,
+	key       string,
+	retention time.Duration,
+) *promise {
+	pid, left, err := qctx.dedup.Get(ctx, key)
+	if err == dedup.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		zap.L().Warn(
+			"unable to look up identical query",
+			logging.Pid(qctx.pid),
+			zap.Error(err),
+		)
+		return nil
+	}
+	if left < retention {
+		retention = left
+	}
+
+	token, err := qctx.keyring.SignOnBehalfOf(
+		pid,
+		qctx.user.Oid,
+		qctx.user.Upn,
+		retention,
+	)
+	if err != nil {
+		zap.L().Error("signing failed", logging.Pid(pid), zap.Error(err))
+		return nil
+	}
+	dedupHits.Inc()
+	zap.L().Info(
+		"reusing process of identical query",
+		logging.Pid(qctx.pid),
+		zap.String("reused", pid),
+	)
+	return &promise {
+		Url: fmt.Sprintf("result/%s", pid),
+		Key: token,
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/dedup"
+)
+
+func TestQueryIdentityIgnoresPriorityAndRetention(t *testing.T) {
+	args := sliceargs { Kind: "index", Dim: 0, Val: 10 }
+	batch     := "batch"
+	retention := int32(60)
+	plain, err := queryIdentity("ep", "guid", "etag", "slice", args, &opts {})
+	assert.NoError(t, err)
+	scheduled, err := queryIdentity(
+		"ep",
+		"guid",
+		"etag",
+		"slice",
+		args,
+		&opts { Priority: &batch, Retention: &retention },
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, scheduled)
+}
+
+func TestQueryIdentityDependsOnVersionAndArgs(t *testing.T) {
+	args := sliceargs { Kind: "index", Dim: 0, Val: 10 }
+	key, err := queryIdentity("ep", "guid", "etag-0", "slice", args, nil)
+	assert.NoError(t, err)
+
+	newversion, err := queryIdentity("ep", "guid", "etag-1", "slice", args, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, newversion)
+
+	args.Val = 11
+	otherline, err := queryIdentity("ep", "guid", "etag-0", "slice", args, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, otherline)
+
+	attrs := []string{ "cdp" }
+	withattrs, err := queryIdentity(
+		"ep",
+		"guid",
+		"etag-0",
+		"slice",
+		sliceargs { Kind: "index", Dim: 0, Val: 10 },
+		&opts { Attributes: &attrs },
+	)
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, withattrs)
+}
+
+func TestReuseGivesPromiseForRecordedProcess(t *testing.T) {
+	ctx     := context.Background()
+	keyring := auth.MakeKeyring([]byte("key"))
+	store   := dedup.NewMemoryStore()
+	qctx    := &queryContext {
+		pid:     "pid-1",
+		keyring: &keyring,
+		dedup:   store,
+	}
+
+	assert.Nil(t, reuse(ctx, qctx, "key", time.Minute))
+
+	assert.NoError(t, store.Put(ctx, "key", "pid-0", 30 * time.Second))
+	p := reuse(ctx, qctx, "key", time.Minute)
+	if p == nil {
+		t.Fatalf("expected a promise for the recorded process")
+	}
+	assert.Equal(t, "result/pid-0", p.Url)
+	assert.NoError(t, keyring.Validate(p.Key, "pid-0"))
+
+	/*
+	 * The token must not outlive the result of the reused process
+	 */
+	claims := jwt.MapClaims {}
+	_, _, err := new(jwt.Parser).ParseUnverified(p.Key, claims)
+	assert.NoError(t, err)
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	assert.True(
+		t,
+		!exp.After(time.Now().Add(30 * time.Second)),
+		"token expires at %s", exp,
+	)
+}
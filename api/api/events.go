@@ -0,0 +1,241 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/archive"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+/*
+ * The progress of a process, as pushed to clients that follow the process
+ * rather than poll /status. The fields are those of the /status response.
+ *
+ *     {"status": "pending"}, until the process is scheduled
+ *     {"status": "working", "progress": "3/10"}, as parts land
+ *     {"status": "finished", "progress": "10/10", "location": "result/<pid>"}
+ *     {"status": "failed", "reason": "..."}
+ *
+ * finished and failed are final.
+ */
+type processStatus struct {
+	Status   string `json:"status"`
+	Progress string `json:"progress,omitempty"`
+	Location string `json:"location,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func (s processStatus) final() bool {
+	return s.Status == "finished" || s.Status == "failed"
+}
+
+/*
+ * The default timeout for following a process, i.e. the keep-alive interval
+ * and how long to wait for a process to be scheduled.
+ */
+const defaultWatchTimeout = 15 * time.Second
+
+/*
+ * How often to check if the process is scheduled, while it is pending
+ */
+const pendingInterval = 250 * time.Millisecond
+
+/*
+ * Follow the progress of a process, by reading its stream of parts, and send
+ * the status every time parts land. The last status sent is final, unless the
+ * context is cancelled first.
+ *
+ * Should no part land for the timeout, keepalive is called, and the process is
+ * checked for expiry, which fails it - a process that expires before it
+ * completes will never complete.
+ */
+type processWatch struct {
+	storage queue.Results
+	/*
+	 * The archive of finished results, or nil
+	 */
+	archive archive.Archive
+	timeout time.Duration
+}
+
+func (w *processWatch) run(
+	ctx       context.Context,
+	pid       string,
+	send      func(processStatus),
+	keepalive func(),
+) {
+	failed := func(reason string) {
+		send(processStatus { Status: "failed", Reason: reason })
+	}
+
+	head, err := w.awaitHeader(ctx, pid, send)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == queue.ErrNotFound && w.archived(ctx, pid) {
+		send(finished(pid, 0))
+		return
+	}
+	if err == queue.ErrNotFound {
+		failed("process not found, or expired")
+		return
+	}
+	if err != nil {
+		zap.L().Error("watch failed", logging.Pid(pid), zap.Error(err))
+		failed("unable to get process")
+		return
+	}
+
+	total  := head.Ntasks
+	count  := 0
+	cursor := ""
+	for count < total {
+		rctx, cancel := context.WithTimeout(ctx, w.timeout)
+		parts, next, err := w.storage.Read(rctx, pid, cursor)
+		timedout := rctx.Err() == context.DeadlineExceeded
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil && timedout {
+			_, err := w.storage.Header(ctx, pid)
+			if err == queue.ErrNotFound {
+				failed("process expired before it completed")
+				return
+			}
+			keepalive()
+			continue
+		}
+		if err != nil {
+			zap.L().Error("watch failed", logging.Pid(pid), zap.Error(err))
+			failed("unable to read progress")
+			return
+		}
+
+		count += len(parts)
+		cursor = next
+		if count < total {
+			send(processStatus {
+				Status:   "working",
+				Progress: fmt.Sprintf("%d/%d", count, total),
+			})
+		}
+	}
+	send(finished(pid, total))
+}
+
+func finished(pid string, ntasks int) processStatus {
+	status := processStatus {
+		Status:   "finished",
+		Location: fmt.Sprintf("result/%s", pid),
+	}
+	if ntasks > 0 {
+		status.Progress = fmt.Sprintf("%d/%d", ntasks, ntasks)
+	}
+	return status
+}
+
+/*
+ * Get the process header, waiting for up to the timeout for the process to be
+ * scheduled. The pending status is sent if the process is not scheduled yet.
+ */
+func (w *processWatch) awaitHeader(
+	ctx  context.Context,
+	pid  string,
+	send func(processStatus),
+) (*message.ProcessHeader, error) {
+	deadline := time.Now().Add(w.timeout)
+	pending  := false
+	for {
+		body, err := w.storage.Header(ctx, pid)
+		if err == nil {
+			return parseProcessHeader(body)
+		}
+		if err != queue.ErrNotFound || time.Now().After(deadline) {
+			return nil, err
+		}
+		/*
+		 * An archived result will not be scheduled again
+		 */
+		if w.archived(ctx, pid) {
+			return nil, err
+		}
+		if !pending {
+			pending = true
+			send(processStatus { Status: "pending" })
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pendingInterval):
+		}
+	}
+}
+
+func (w *processWatch) archived(ctx context.Context, pid string) bool {
+	if w.archive == nil {
+		return false
+	}
+	_, err := w.archive.Stat(ctx, pid)
+	return err == nil
+}
+
+/*
+ * The progress of a process as server-sent events, so that clients can follow
+ * the process without polling /status. Browsers' EventSource can't set the
+ * Authorization header, so the token is usually passed as ?key=.
+ *
+ * The events are progress (pending and working), finished and failed, with the
+ * process status as data, and the stream ends after finished or failed. A
+ * comment is sent to keep the connection open when there is no progress for
+ * the timeout.
+ */
+func (r *Result) Events(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	header := ctx.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	/*
+	 * Tell nginx (see docker-compose-nginx.conf) not to buffer the events
+	 */
+	header.Set("X-Accel-Buffering", "no")
+	ctx.Writer.WriteHeader(http.StatusOK)
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultWatchTimeout
+	}
+	watch := processWatch {
+		storage: r.Storage,
+		archive: r.Archive,
+		timeout: timeout,
+	}
+	send := func(status processStatus) {
+		event := status.Status
+		if !status.final() {
+			event = "progress"
+		}
+		ctx.SSEvent(event, status)
+		ctx.Writer.Flush()
+	}
+	keepalive := func() {
+		io.WriteString(ctx.Writer, ": keep-alive\n\n")
+		ctx.Writer.Flush()
+	}
+	/*
+	 * The gin context is never cancelled, but the request context is when
+	 * the client goes away
+	 */
+	watch.run(ctx.Request.Context(), pid, send, keepalive)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+/*
+ * The names of the events in the body of an event stream, in order
+ */
+func eventNames(body string) []string {
+	names := []string{}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "event:") {
+			names = append(names, strings.TrimPrefix(line, "event:"))
+		}
+	}
+	return names
+}
+
+func TestEventsPushProgressUntilFinished(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	r.Archive = nil
+	r.Storage.SetHeader(ctx, "pid", processHeader(t, 3), 0)
+	r.Storage.Append(ctx, "pid", queue.Part { Name: "0/3", Body: []byte("a") })
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Storage.Append(ctx, "pid", queue.Part { Name: "1/3", Body: []byte("b") })
+		time.Sleep(10 * time.Millisecond)
+		r.Storage.Append(ctx, "pid", queue.Part { Name: "2/3", Body: []byte("c") })
+	}()
+
+	w := serveResult(r, "/result/pid/events")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	/*
+	 * The parts that land while an event is sent are reported together, so
+	 * there are one or two progress events
+	 */
+	body  := w.Body.String()
+	names := eventNames(body)
+	assert.Equal(t, "progress", names[0])
+	assert.Equal(t, "finished", names[len(names) - 1])
+	assert.Contains(t, body, `"progress":"1/3"`)
+	assert.Contains(t, body, `"progress":"3/3"`)
+	assert.Contains(t, body, `"location":"result/pid"`)
+}
+
+func TestEventsPendingUntilScheduled(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	r.Archive = nil
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Storage.SetHeader(ctx, "pid", processHeader(t, 1), 0)
+		r.Storage.Append(ctx, "pid", queue.Part { Name: "0/1", Body: []byte("a") })
+	}()
+
+	w := serveResult(r, "/result/pid/events")
+	assert.Equal(t, []string { "progress", "finished" }, eventNames(w.Body.String()))
+	assert.Contains(t, w.Body.String(), `"status":"pending"`)
+}
+
+func TestEventsFailWhenProcessNotFound(t *testing.T) {
+	r := archivingResult()
+	r.Archive = nil
+	r.Timeout = 10 * time.Millisecond
+	w := serveResult(r, "/result/pid/events")
+	assert.Equal(t, []string { "progress", "failed" }, eventNames(w.Body.String()))
+}
+
+func TestEventsFailWhenProcessExpires(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	r.Archive = nil
+	r.Timeout = 20 * time.Millisecond
+	retention := 10 * time.Millisecond
+	r.Storage.SetHeader(ctx, "pid", processHeader(t, 2), retention)
+	r.Storage.Append(ctx, "pid", queue.Part {
+		Name:      "0/2",
+		Body:      []byte("a"),
+		Retention: retention,
+	})
+
+	w := serveResult(r, "/result/pid/events")
+	body := w.Body.String()
+	assert.Equal(t, []string { "progress", "failed" }, eventNames(body))
+	assert.Contains(t, body, "expired")
+}
+
+func TestEventsFinishedWhenArchived(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	expires := time.Now().Add(time.Hour)
+	err := r.Archive.Put(ctx, "pid", strings.NewReader("result"), expires)
+	assert.NoError(t, err)
+	w := serveResult(r, "/result/pid/events")
+	assert.Equal(t, []string { "finished" }, eventNames(w.Body.String()))
+}
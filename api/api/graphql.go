@@ -5,16 +5,29 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 
+	"github.com/equinor/oneseismic/api/internal/audit"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/callback"
+	"github.com/equinor/oneseismic/api/internal/dedup"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/quota"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/equinor/oneseismic/api/internal/util"
 	"github.com/equinor/oneseismic/api/internal"
 )
@@ -35,6 +48,40 @@ type queryContext struct {
 	endpoint      string
 	keyring       *auth.Keyring
 	scheduler     scheduler
+	pending       *sync.WaitGroup
+	/*
+	 * Queries with more tasks than this are scheduled as batch, unless the
+	 * caller asks for a priority.
+	 */
+	batchThreshold int
+	/*
+	 * How long results are kept, unless the caller asks for less
+	 */
+	retention      time.Duration
+	/*
+	 * Per-user quotas, or nil if disabled
+	 */
+	quotas         quota.Store
+	admission      *admission
+	/*
+	 * The processes of earlier queries, to reuse for identical queries, or
+	 * nil if disabled
+	 */
+	dedup          dedup.Store
+	/*
+	 * Follows processes for subscriptions, or nil if disabled
+	 */
+	watch          *processWatch
+	/*
+	 * The hosts callbacks can be sent to, or nil if disabled
+	 */
+	callbacks      callback.Hosts
+	/*
+	 * The user, from a verified token, or empty if the request has none (see
+	 * auth.VerifyUser). Quotas are keyed on this user, and never on the
+	 * subject of the audit log, which is only what the caller claimed.
+	 */
+	user           auth.User
 }
 
 /*
@@ -59,6 +106,19 @@ type gql struct {
 	endpoint  string // e.g. https://oneseismic-storage.blob.windows.net
 	keyring   *auth.Keyring
 	scheduler scheduler
+	batchThreshold int
+	retention time.Duration
+	quotas    quota.Store
+	admission *admission
+	dedup     dedup.Store
+	watch     *processWatch
+	callbacks callback.Hosts
+	/*
+	 * Scheduling is done in the background, after the promise is returned to
+	 * the caller. The pending group tracks the scheduling in progress, so
+	 * that the promises can be kept on shutdown.
+	 */
+	pending   sync.WaitGroup
 }
 
 type resolver struct {
@@ -67,6 +127,10 @@ type resolver struct {
 type cube struct {
 	id       graphql.ID
 	manifest json.RawMessage
+	/*
+	 * The ETag of the manifest, or empty if unknown
+	 */
+	etag     string
 }
 
 type promise struct {
@@ -90,6 +154,83 @@ func (p *promise) UnmarshalGraphQL(input interface{}) error {
 
 type opts struct {
 	Attributes *[]string `json:"attributes"`
+	/*
+	 * The priority and retention (in seconds) are for the scheduler, and not
+	 * passed on to the planner.
+	 */
+	Priority   *string   `json:"-"`
+	Retention  *int32    `json:"-"`
+	/*
+	 * The URL to notify when the process is done, which is for the fetch
+	 * workers only.
+	 */
+	Callback   *string   `json:"-"`
+}
+
+/*
+ * The priority class of a query. The caller can ask for one explicitly (in
+ * the opts), otherwise it is inferred from the cost - queries with more tasks
+ * than the threshold are batch, so that exports of large curtains do not
+ * starve the interactive queries.
+ */
+func queryPriority(
+	options   interface{},
+	ntasks    int,
+	threshold int,
+) (queue.Priority, error) {
+	if o, ok := options.(*opts); ok && o != nil && o.Priority != nil {
+		return queue.ParsePriority(*o.Priority)
+	}
+	if threshold > 0 && ntasks > threshold {
+		return queue.Batch, nil
+	}
+	return queue.Interactive, nil
+}
+
+/*
+ * How long the result of a query is kept. The caller can ask for a shorter
+ * retention than that of the deployment (in the opts), but not a longer one,
+ * since the result store may not keep results any longer.
+ */
+func queryRetention(
+	options   interface{},
+	retention time.Duration,
+) (time.Duration, error) {
+	o, ok := options.(*opts)
+	if !ok || o == nil || o.Retention == nil {
+		return retention, nil
+	}
+	requested := time.Duration(*o.Retention) * time.Second
+	if requested <= 0 {
+		return 0, fmt.Errorf("retention must be positive; was %d", *o.Retention)
+	}
+	if requested > retention {
+		msg := "retention (%s) is longer than the max retention (%s)"
+		return 0, fmt.Errorf(msg, requested, retention)
+	}
+	return requested, nil
+}
+
+/*
+ * The callback of a query, or empty if the caller did not ask for one. The
+ * callback must be to one of the hosts, and callbacks are disabled (nil
+ * hosts) unless configured.
+ */
+func queryCallback(
+	options interface{},
+	hosts   callback.Hosts,
+) (string, error) {
+	o, ok := options.(*opts)
+	if !ok || o == nil || o.Callback == nil {
+		return "", nil
+	}
+	if hosts == nil {
+		return "", errors.New("callbacks are not enabled")
+	}
+	if err := hosts.Check(*o.Callback); err != nil {
+		return "", err
+	}
+	return *o.Callback, nil
 }
 
 func (r *resolver) Cube(
@@ -98,21 +239,22 @@ func (r *resolver) Cube(
 ) (*cube, error) {
 	qctx := getQueryContext(ctx)
 	pid  := qctx.pid
+	audit.FromContext(ctx).AddCube(string(args.Id))
 	urls := fmt.Sprintf("%s/%s", qctx.endpoint, args.Id)
-	log.Printf("Getting URL %s", urls)
+	zap.L().Debug("getting manifest", logging.Pid(pid), zap.String("url", urls))
 	url, err := url.Parse(urls)
 	if err != nil {
-		log.Printf(
-			"pid=%s, failed to parse URL; endpoint=%s, id=%s, error=%v",
-			pid,
-			qctx.endpoint,
-			args.Id,
-			err,
+		zap.L().Error(
+			"failed to parse URL",
+			logging.Pid(pid),
+			logging.Guid(string(args.Id)),
+			zap.String("endpoint", qctx.endpoint),
+			zap.Error(err),
 		)
 		return nil, internal.NewInternalError()
 	}
 
-	doc, err := getManifest(ctx, qctx, url)
+	doc, etag, err := getManifest(ctx, qctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -122,11 +264,12 @@ func (r *resolver) Cube(
 		// errors here probably mean the document itself is broken
 		// the URL gets recorded, but maybe the content (or digested content
 		// e.g. hash) should be recorded as well)
-		log.Printf(
-			"pid=%s, init query engine session from %v failed: %v",
-			pid,
-			url,
-			err,
+		zap.L().Error(
+			"init query engine session failed",
+			logging.Pid(pid),
+			logging.Guid(string(args.Id)),
+			zap.Stringer("url", url),
+			zap.Error(err),
 		)
 		return nil, internal.NewInternalError()
 	}
@@ -134,6 +277,7 @@ func (r *resolver) Cube(
 	return &cube {
 		id:       args.Id,
 		manifest: doc,
+		etag:     etag,
 	}, nil
 }
 
@@ -149,7 +293,12 @@ func (c *cube) basicManifestQuery(
 	qctx := getQueryContext(ctx)
 	d, err := qctx.session.QueryManifest(path)
 	if err != nil {
-		log.Printf("pid=%s, %s failed: %v", qctx.pid, path, err)
+		zap.L().Error(
+			"manifest query failed",
+			logging.Pid(qctx.pid),
+			zap.String("path", path),
+			zap.Error(err),
+		)
 		return internal.NewInternalError()
 	}
 
@@ -170,8 +319,13 @@ func (c *cube) basicManifestQuery(
 		 * between the manifest content => C++ parse-and-lookup => output. This
 		 * should be investigated immediately.
 		 */
-		msg := "pid=%s, %s failed: unable to unmarshal %s to %T"
-		log.Printf(msg, qctx.pid, path, string(d), out)
+		zap.L().Error(
+			"manifest query failed: unable to unmarshal",
+			logging.Pid(qctx.pid),
+			zap.String("path", path),
+			zap.ByteString("doc", d),
+			zap.String("type", fmt.Sprintf("%T", out)),
+		)
 		return internal.NewInternalError()
 	}
 	return nil
@@ -189,8 +343,11 @@ func (c *cube) Linenumbers(ctx context.Context) ([][]int32, error) {
 			// missing, which means this resolver is not constructible. This
 			// should be debugged immediately.
 			pid := getQueryContext(ctx).pid
-			msg := "pid=%s, /line-numbers not found in %s manifest"
-			log.Printf(msg, pid, c.id)
+			zap.L().Error(
+				"/line-numbers not found in manifest",
+				logging.Pid(pid),
+				logging.Guid(string(c.id)),
+			)
 		}
 	}
 	return out, err
@@ -239,36 +396,43 @@ func getManifest(
 	ctx      context.Context,
 	qctx     *queryContext,
 	url      *url.URL,
-) ([]byte, error) {
+) ([]byte, string, error) {
 	// This is arguably bad; the passed url gets modified in-place. It's
 	// probably ok since this is a helper function to pull the azure handling
 	// stuff out of the caller body, and it is called once, but it should be
 	// considered if this function should restore the rawQuery.
 	url.RawQuery = qctx.urlQuery
-	manifest, err := util.FetchManifest(ctx, url)
+	manifest, etag, err := util.FetchManifest(ctx, url)
 	if err == nil {
-		return manifest, nil
+		return manifest, etag, nil
 	}
 
-	log.Printf("pid=%s, %v", qctx.pid, err)
+	zap.L().Warn(
+		"unable to fetch manifest",
+		logging.Pid(qctx.pid),
+		zap.Error(err),
+	)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", internal.QueryError("Not found")
+	}
 	switch e := err.(type) {
 	case azblob.StorageError:
 		status := e.Response().StatusCode
 		switch status {
 		case http.StatusNotFound:
 			// TODO: add guid as a part of the error message?
-			return nil, internal.QueryError("Not found")
+			return nil, "", internal.QueryError("Not found")
 
 		case http.StatusForbidden:
-			return nil, internal.PermissionDeniedFromStatus(status)
+			return nil, "", internal.PermissionDeniedFromStatus(status)
 		case http.StatusUnauthorized:
-			return nil, internal.PermissionDeniedFromStatus(status)
+			return nil, "", internal.PermissionDeniedFromStatus(status)
 
 		default:
-			return nil, internal.NewInternalError()
+			return nil, "", internal.NewInternalError()
 		}
 	}
-	return nil, err
+	return nil, "", err
 }
 
 func (c *cube) basicQuery(
@@ -279,6 +443,47 @@ func (c *cube) basicQuery(
 ) (*promise, error) {
 	qctx := getQueryContext(ctx)
 	pid  := qctx.pid
+	record := audit.FromContext(ctx)
+	record.AddQuery(string(c.id), fun, args)
+
+	retention, err := queryRetention(opts, qctx.retention)
+	if err != nil {
+		return nil, internal.QueryError(err.Error())
+	}
+	cb, err := queryCallback(opts, qctx.callbacks)
+	if err != nil {
+		return nil, internal.QueryError(err.Error())
+	}
+
+	/*
+	 * Identical queries of the same version of the cube get the same
+	 * process. Without an ETag the version is unknown, and the query is never
+	 * deduplicated. Neither are queries with a callback, since a reused
+	 * process may already be done, and would never call back.
+	 */
+	dedupkey := ""
+	if qctx.dedup != nil && c.etag != "" && cb == "" {
+		dedupkey, err = queryIdentity(
+			qctx.endpoint,
+			string(c.id),
+			c.etag,
+			fun,
+			args,
+			opts,
+		)
+		if err != nil {
+			zap.L().Error(
+				"unable to make query identity",
+				logging.Pid(pid),
+				zap.Error(err),
+			)
+			return nil, internal.NewInternalError()
+		}
+		if p := reuse(ctx, qctx, dedupkey, retention); p != nil {
+			return p, nil
+		}
+	}
+
 	msg  := message.Query {
 		Pid:             pid,
 		UrlQuery:        qctx.urlQuery,
@@ -288,28 +493,86 @@ func (c *cube) basicQuery(
 		Function:        fun,
 		Args:            args,
 		Opts:            opts,
+		TraceContext:    tracing.Inject(ctx),
 	}
+	start := time.Now()
+	_, span := tracing.Tracer().Start(ctx, "plan")
 	query, err := qctx.session.PlanQuery(&msg)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "planning failed")
+		span.End()
+		zap.L().Error("planning failed", logging.Pid(pid), zap.Error(err))
 		return nil, nil
 	}
+	span.End()
+	planDuration.WithLabelValues(fun).Observe(time.Since(start).Seconds())
+	tasksPerQuery.WithLabelValues(fun).Observe(float64(len(query.plan)))
+
+	query.priority, err = queryPriority(opts, len(query.plan), qctx.batchThreshold)
+	if err != nil {
+		return nil, internal.QueryError(err.Error())
+	}
+	query.retention = retention
+	query.callback  = cb
 
-	key, err := qctx.keyring.Sign(pid)
+	err = qctx.admission.admit(ctx, pid, query.priority, len(query.plan))
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		zap.L().Info("process not admitted", logging.Pid(pid), zap.Error(err))
+		return nil, err
+	}
+
+	/*
+	 * Sign before admitting the process, which consumes the user's quota
+	 * until the process is done
+	 */
+	key, err := qctx.keyring.SignOnBehalfOf(
+		pid,
+		qctx.user.Oid,
+		qctx.user.Upn,
+		query.retention,
+	)
+	if err != nil {
+		zap.L().Error("signing failed", logging.Pid(pid), zap.Error(err))
 		return nil, internal.NewInternalError()
 	}
 
+	query.user = qctx.user.Oid
+	err = admit(ctx, qctx.quotas, query.user, pid, len(query.plan))
+	if err != nil {
+		return nil, err
+	}
+
+	if dedupkey != "" {
+		err = qctx.dedup.Put(ctx, dedupkey, pid, query.retention)
+		if err != nil {
+			zap.L().Warn(
+				"unable to record process for identical queries",
+				logging.Pid(pid),
+				zap.Error(err),
+			)
+		}
+	}
+
+	qctx.pending.Add(1)
 	go func (s scheduler) {
-		err := s.Schedule(context.Background(), pid, query)
+		defer qctx.pending.Done()
+		ctx, span := tracing.Tracer().Start(tracing.Detach(ctx), "schedule")
+		defer span.End()
+		err := s.Schedule(ctx, pid, query)
 		if err != nil {
+			span.RecordError(err)
+			scheduleErrors.Inc()
 			/*
 			 * Make scheduling errors fatal to detect them for debugging.
 			 * Eventually this should log, maybe cancel the process, and
 			 * continue.
 			 */
-			log.Fatalf("pid=%s, %v", pid, err)
+			zap.L().Fatal(
+				"scheduling failed",
+				logging.Pid(pid),
+				zap.Error(err),
+			)
 		}
 	}(qctx.scheduler)
 
@@ -319,6 +582,43 @@ func (c *cube) basicQuery(
 	}, nil
 }
 
+/*
+ * Admit the process against the user's quotas. Queries from unknown users,
+ * and all queries when quotas are disabled, are always admitted.
+ */
+func admit(
+	ctx    context.Context,
+	quotas quota.Store,
+	user   string,
+	pid    string,
+	ntasks int,
+) error {
+	if quotas == nil || user == "" {
+		return nil
+	}
+	err := quotas.Admit(ctx, user, pid, ntasks)
+	if err == nil {
+		return nil
+	}
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		quotaRejections.WithLabelValues(exceeded.Limit).Inc()
+		zap.L().Info(
+			"quota exceeded",
+			logging.Pid(pid),
+			zap.String("oid", user),
+			zap.String("limit", exceeded.Limit),
+		)
+		return internal.QuotaExceeded(
+			exceeded.Error(),
+			exceeded.Limit,
+			exceeded.RetryAfter,
+		)
+	}
+	zap.L().Error("unable to check quota", logging.Pid(pid), zap.Error(err))
+	return internal.NewInternalError()
+}
+
 type sliceargs struct {
 	Kind string `json:"kind"`
 	Dim  int32  `json:"dim"`
@@ -441,14 +741,34 @@ type Query {
     cube(id: ID!): Cube!
 }
 
+type Subscription {
+    process(pid: ID!, key: String!): Process!
+}
+
+type Process {
+    pid: ID!
+    status: String!
+    progress: String
+    location: String
+    reason: String
+}
+
 enum Attribute {
     cdp
     cdpx
     cdpy
 }
 
+enum Priority {
+    interactive
+    batch
+}
+
 input Opts {
     attributes: [Attribute!]
+    priority: Priority
+    retention: Int
+    callback: String
 }
 
 type Cube {
@@ -471,16 +791,115 @@ type Cube {
 	return &gql {
 		schema: s,
 		queryEngine: QueryEngine {
-			tasksize: 10,
-			pool: DefaultQueryEnginePool(),
+			sizer: DefaultTaskSizer(),
+			pool:  DefaultQueryEnginePool(),
 		},
 		endpoint:  endpoint,
 		keyring:   keyring,
 		scheduler: scheduler,
+		batchThreshold: DefaultBatchThreshold,
+		retention: queue.DefaultTTL,
 	}
 }
 
+/*
+ * The default number of tasks above which queries are scheduled as batch. With
+ * the default task sizing this is queries of more than 2500 fragments.
+ */
+const DefaultBatchThreshold = 25
+
+/*
+ * Set the number of tasks above which queries without an explicit priority
+ * are scheduled as batch. Zero or less schedules all such queries as
+ * interactive.
+ */
+func (g *gql) SetBatchThreshold(ntasks int) {
+	g.batchThreshold = ntasks
+}
+
+/*
+ * Set how the task size is chosen for queries. See TaskSizer.
+ */
+func (g *gql) SetTaskSizer(sizer TaskSizer) {
+	g.queryEngine.sizer = sizer
+}
+
+/*
+ * Set how long results are kept, which is also how long the tokens for the
+ * results are valid. Queries can ask for a shorter retention. Defaults to
+ * queue.DefaultTTL.
+ */
+func (g *gql) SetRetention(retention time.Duration) {
+	g.retention = retention
+}
+
+/*
+ * Admit new processes against the per-user quotas in the store. Quotas are
+ * disabled by default.
+ */
+func (g *gql) SetQuotas(quotas quota.Store) {
+	g.quotas = quotas
+}
+
+/*
+ * Reject new processes with a BUSY error when the job queue has more than
+ * maxdepth tasks, or the oldest task has waited longer than maxwait. Zero
+ * disables the limit, and both are disabled by default.
+ */
+func (g *gql) SetAdmission(
+	jobs     queue.Jobs,
+	maxdepth int,
+	maxwait  time.Duration,
+) {
+	g.admission = &admission {
+		jobs:     jobs,
+		maxdepth: maxdepth,
+		maxwait:  maxwait,
+	}
+}
+
+/*
+ * Give identical queries the process of the first, rather than planning and
+ * scheduling them again. Disabled (nil) by default.
+ */
+func (g *gql) SetDedup(store dedup.Store) {
+	g.dedup = store
+}
+
+/*
+ * Enable subscriptions to the progress of processes, which is read from the
+ * result store. Disabled (nil) by default.
+ */
+func (g *gql) SetResults(results queue.Results) {
+	g.watch = &processWatch {
+		storage: results,
+		timeout: defaultWatchTimeout,
+	}
+}
+
+/*
+ * Allow queries to ask for a callback when the process is done, to one of the
+ * hosts. Disabled (nil) by default. The fetch workers must be configured to
+ * send the callbacks.
+ */
+func (g *gql) SetCallbacks(hosts callback.Hosts) {
+	g.callbacks = hosts
+}
+
+/*
+ * Wait for all scheduling started by queries to complete. This should be
+ * called on shutdown, after the server has stopped accepting new requests.
+ */
+func (g *gql) Wait() {
+	g.pending.Wait()
+}
+
 func (g *gql) Get(ctx *gin.Context) {
+	if websocket.IsWebSocketUpgrade(ctx.Request) {
+		g.serveWebSocket(ctx)
+		return
+	}
+
 	query := ctx.Request.URL.Query()
 	q, err := util.GraphQLQueryFromGet(query)
 	if err != nil {
@@ -500,7 +919,11 @@ func (g *gql) Post(ctx *gin.Context) {
 	body := util.GraphQLQuery {}
 	err := ctx.BindJSON(&body)
 	if err != nil {
-		log.Printf("pid=%s %v", ctx.GetString("pid"), err)
+		zap.L().Warn(
+			"bad request body",
+			logging.Pid(ctx.GetString("pid")),
+			zap.Error(err),
+		)
 		return
 	}
 
@@ -523,7 +946,36 @@ func (g *gql) execQuery(
 		endpoint:  g.endpoint,
 		keyring:   g.keyring,
 		scheduler: g.scheduler,
+		pending:   &g.pending,
+		batchThreshold: g.batchThreshold,
+		retention: g.retention,
+		quotas:    g.quotas,
+		admission: g.admission,
+		dedup:     g.dedup,
+		callbacks: g.callbacks,
+		user:      auth.VerifiedUser(ctx),
+	}
+
+	/*
+	 * The query span is the root of the process trace, unless the client
+	 * started the trace (and sent a traceparent header). Since processes are
+	 * scheduled asynchronously, this span is usually ended long before the
+	 * process completes.
+	 */
+	parent := tracing.ExtractHTTP(ctx.Request.Context(), ctx.Request.Header)
+	spanctx, span := tracing.Tracer().Start(
+		parent,
+		"query",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.Pid(qctx.pid)),
+	)
+	defer span.End()
+
+	c := setQueryContext(spanctx, &qctx)
+	response := g.schema.Exec(c, query.Query, query.OperationName, query.Variables)
+	record := audit.FromContext(c)
+	for _, err := range response.Errors {
+		record.AddError(err)
 	}
-	c := setQueryContext(ctx, &qctx)
-	return g.schema.Exec(c, query.Query, query.OperationName, query.Variables)
+	return response
 }
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/equinor/oneseismic/api/internal/metrics"
+)
+
+/*
+ * Metrics recorded by the query (planning and scheduling) and the result
+ * services. Labels are kept to a minimum, and never include pids or guids, as
+ * every label value makes a new time series.
+ */
+var (
+	planDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "query",
+			Name:      "plan_duration_seconds",
+			Help:      "Time spent planning queries",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		},
+		[]string{ "function" },
+	)
+
+	tasksPerQuery = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "query",
+			Name:      "tasks",
+			Help:      "Number of tasks per planned query",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		},
+		[]string{ "function" },
+	)
+
+	scheduleErrors = promauto.NewCounter(
+		prometheus.CounterOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "query",
+			Name:      "schedule_errors_total",
+			Help:      "Number of processes that could not be scheduled",
+		},
+	)
+
+	quotaRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "query",
+			Name:      "quota_rejections_total",
+			Help:      "Number of queries rejected because the user is over quota",
+		},
+		[]string{ "limit" },
+	)
+
+	admissionRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "query",
+			Name:      "admission_rejections_total",
+			Help:      "Number of queries rejected because the job queue is busy",
+		},
+		[]string{ "priority", "reason" },
+	)
+
+	dedupHits = promauto.NewCounter(
+		prometheus.CounterOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "query",
+			Name:      "dedup_hits_total",
+			Help:      "Number of queries given the process of an identical query",
+		},
+	)
+
+	resultTimeToFirstByte = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "result",
+			Name:      "time_to_first_byte_seconds",
+			Help:      "Time from request until the first byte is written",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		},
+		[]string{ "endpoint" },
+	)
+
+	resultDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "result",
+			Name:      "duration_seconds",
+			Help:      "Time from request until the response is completed",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 18),
+		},
+		[]string{ "endpoint" },
+	)
+)
@@ -46,13 +46,26 @@ const char* session_init(session* self, const char* doc, int len) {
     }
 }
 
-plan session_plan_query(
+const char* session_prepare_query(
     session* self,
     const char* doc,
     int len,
-    int task_size)
+    int* nfragments)
+{
+    try {
+        *nfragments = self->prepare_query(doc, len);
+        return nullptr;
+    } catch (std::exception& e) {
+        // using malloc is important; the str will be free'd by go
+        char* msg = (char*)std::malloc(std::strlen(e.what()) + 1);
+        std::strcpy(msg, e.what());
+        return msg;
+    }
+}
+
+plan session_plan_query(session* self, int task_size)
 try {
-    const auto taskset = self->plan_query(doc, len, task_size);
+    const auto taskset = self->plan_query(task_size);
     if (taskset.empty()) {
         throw one::bad_message("task-set should not be empty");
     }
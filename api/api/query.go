@@ -10,14 +10,53 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/equinor/oneseismic/api/internal"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/queue"
 )
 
 type QueryPlan struct {
-	header []byte
-	plan   [][]byte
+	header    []byte
+	plan      [][]byte
+	/*
+	 * The priority class of the tasks, which is not decided by the planner
+	 * but by the caller or the cost of the query.
+	 */
+	priority  queue.Priority
+	/*
+	 * How long the result is kept. Zero for the result store's time-to-live.
+	 */
+	retention time.Duration
+	/*
+	 * The user (oid) that made the query, if known.
+	 */
+	user      string
+	/*
+	 * The URL to notify when the process is done, or empty for none.
+	 */
+	callback  string
+}
+
+/*
+ * The tasks of the plan, as put on the job queue.
+ */
+func (p *QueryPlan) tasks(pid string, retention time.Duration) []queue.Task {
+	ntasks := len(p.plan)
+	tasks  := make([]queue.Task, ntasks)
+	for i, task := range p.plan {
+		tasks[i] = queue.Task {
+			Pid:       pid,
+			Part:      fmt.Sprintf("%d/%d", i, ntasks),
+			Body:      task,
+			User:      p.user,
+			Priority:  p.priority,
+			Retention: retention,
+			Callback:  p.callback,
+		}
+	}
+	return tasks
 }
 
 /*
@@ -25,8 +64,8 @@ type QueryPlan struct {
  * that wrap C++ functionality and gives it a go interface.
  */
 type QueryEngine struct {
-	tasksize int
-	pool     sync.Pool
+	sizer TaskSizer
+	pool  sync.Pool
 }
 
 /*
@@ -35,7 +74,7 @@ type QueryEngine struct {
  */
 type QuerySession struct {
 	csession *C.struct_session
-	tasksize int
+	sizer    TaskSizer
 }
 
 func NewQuerySession() *QuerySession {
@@ -54,7 +93,7 @@ func DefaultQueryEnginePool() sync.Pool {
 
 func (qe *QueryEngine) Get() *QuerySession {
 	q := qe.pool.Get().(*QuerySession)
-	q.tasksize = qe.tasksize
+	q.sizer = qe.sizer
 	return q
 }
 
@@ -79,19 +118,44 @@ func (q *QuerySession) InitWithManifest(doc []byte) error {
 	return nil
 }
 
+/*
+ * Plan the query, with the task size chosen by the session's TaskSizer.
+ *
+ * The size depends on the number of fragments, which is not known until the
+ * query is prepared, so the query is prepared first, and then planned with
+ * the size chosen from its number of fragments.
+ */
 func (q *QuerySession) PlanQuery(query *message.Query) (*QueryPlan, error) {
 	msg, err := query.Pack()
 	if err != nil {
 		return nil, fmt.Errorf("pack error: %w", err)
 	}
 
-	// TODO: exhaustive error check including those from C++ exceptions
-	csched := C.session_plan_query(
+	nfragments, err := q.prepare(msg)
+	if err != nil {
+		return nil, err
+	}
+	return q.plan(q.sizer.size(nfragments))
+}
+
+func (q *QuerySession) prepare(msg []byte) (int, error) {
+	var nfragments C.int
+	err := C.session_prepare_query(
 		q.csession,
 		(*C.char)(unsafe.Pointer(&msg[0])),
 		C.int(len(msg)),
-		C.int(q.tasksize),
+		&nfragments,
 	)
+	if err != nil {
+		defer C.free(unsafe.Pointer(err))
+		return 0, internal.QueryError(C.GoString(err))
+	}
+	return int(nfragments), nil
+}
+
+func (q *QuerySession) plan(tasksize int) (*QueryPlan, error) {
+	// TODO: exhaustive error check including those from C++ exceptions
+	csched := C.session_plan_query(q.csession, C.int(tasksize))
 	defer C.plan_delete(&csched)
 	if csched.err != nil {
 		return nil, internal.QueryError(C.GoString(csched.err))
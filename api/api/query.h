@@ -51,11 +51,17 @@ void query_result_delete(struct query_result*);
 struct session;
 struct session* session_new();
 const char* session_init(struct session*, const char* doc, int len);
-struct plan session_plan_query(
+/*
+ * Prepare the query for planning, and write the number of fragments in it to
+ * nfragments. Returns nullptr on success, and a malloc'd error message
+ * otherwise. The prepared query is planned with session_plan_query, once.
+ */
+const char* session_prepare_query(
     struct session*,
     const char* doc,
     int len,
-    int task_size);
+    int* nfragments);
+struct plan session_plan_query(struct session*, int task_size);
 
 struct query_result session_query_manifest(
     struct session*,
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Range requests (RFC 7233) for /result, so that clients can resume large
+ * downloads that fail half-way.
+ *
+ * Results never change once the process is complete, so the ETag is made from
+ * the pid and the size of the result. The ETag is the same whether the result
+ * is served from the result store or from the archive, so a download started
+ * before the result is archived can be resumed after.
+ *
+ * Only a single range is supported. Requests for multiple ranges get the whole
+ * result, which the RFC allows.
+ */
+
+/*
+ * The byte range [start, end) of a result
+ */
+type byteRange struct {
+	start int
+	end   int
+}
+
+func (r byteRange) length() int {
+	return r.end - r.start
+}
+
+/*
+ * The Content-Range of the range, for a result of size bytes
+ */
+func (r byteRange) contentRange(size int) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end - 1, size)
+}
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+func resultETag(pid string, size int) string {
+	return fmt.Sprintf(`"%s-%d"`, pid, size)
+}
+
+/*
+ * Parse the Range header for a result of size bytes. Returns nil if the whole
+ * result should be served, i.e. there is no range, the range is not
+ * understood, or the If-Range precondition does not hold (the result has
+ * changed since the client started). Returns errUnsatisfiable if the range
+ * starts after the end of the result.
+ */
+func parseRange(
+	header  string,
+	ifrange string,
+	etag    string,
+	size    int,
+) (*byteRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+	/*
+	 * If-Range can also be a date, but the result has no Last-Modified for
+	 * it to match, so only the (strong) ETag is ever a match
+	 */
+	if ifrange != "" && ifrange != etag {
+		return nil, nil
+	}
+
+	const unit = "bytes="
+	if !strings.HasPrefix(header, unit) {
+		return nil, nil
+	}
+	spec := strings.TrimSpace(header[len(unit):])
+	if strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return nil, nil
+	}
+	first := strings.TrimSpace(spec[:dash])
+	last  := strings.TrimSpace(spec[dash + 1:])
+
+	if first == "" {
+		/*
+		 * The suffix range, i.e. the last n bytes
+		 */
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 {
+			return nil, errUnsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return &byteRange { start: size - n, end: size }, nil
+	}
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size
+	if last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < start {
+			return nil, nil
+		}
+		if n + 1 < end {
+			end = n + 1
+		}
+	}
+	if start >= size {
+		return nil, errUnsatisfiable
+	}
+	return &byteRange { start: start, end: end }, nil
+}
+
+/*
+ * A writer that only passes on the bytes in the range, of everything written
+ * to it.
+ */
+type rangeWriter struct {
+	w      io.Writer
+	offset int
+	rng    byteRange
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	n     := len(p)
+	start := rw.offset
+	end   := rw.offset + n
+	rw.offset = end
+
+	if end <= rw.rng.start || start >= rw.rng.end {
+		return n, nil
+	}
+	lo := 0
+	if start < rw.rng.start {
+		lo = rw.rng.start - start
+	}
+	hi := n
+	if end > rw.rng.end {
+		hi = rw.rng.end - start
+	}
+	_, err := rw.w.Write(p[lo:hi])
+	return n, err
+}
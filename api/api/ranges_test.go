@@ -0,0 +1,63 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	etag := resultETag("pid", 100)
+	cases := []struct {
+		header string
+		want   *byteRange
+	} {
+		{ "",               nil },
+		{ "bytes=0-9",      &byteRange { start: 0,  end: 10  } },
+		{ "bytes=90-",      &byteRange { start: 90, end: 100 } },
+		{ "bytes=90-200",   &byteRange { start: 90, end: 100 } },
+		{ "bytes=-10",      &byteRange { start: 90, end: 100 } },
+		{ "bytes=-200",     &byteRange { start: 0,  end: 100 } },
+		{ "bytes=0-1,5-6",  nil },
+		{ "bytes=9-0",      nil },
+		{ "items=0-9",      nil },
+		{ "bytes=a-b",      nil },
+	}
+	for _, c := range cases {
+		got, err := parseRange(c.header, "", etag, 100)
+		assert.NoError(t, err, c.header)
+		assert.Equal(t, c.want, got, c.header)
+	}
+
+	_, err := parseRange("bytes=100-", "", etag, 100)
+	assert.Equal(t, errUnsatisfiable, err)
+	_, err = parseRange("bytes=-0", "", etag, 100)
+	assert.Equal(t, errUnsatisfiable, err)
+}
+
+func TestParseRangeIfRange(t *testing.T) {
+	etag := resultETag("pid", 100)
+	got, err := parseRange("bytes=10-", etag, etag, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, &byteRange { start: 10, end: 100 }, got)
+
+	got, err = parseRange("bytes=10-", resultETag("pid", 99), etag, 100)
+	assert.NoError(t, err)
+	assert.Nil(t, got, "want the whole result when If-Range does not match")
+
+	got, err = parseRange("bytes=10-", "Wed, 21 Oct 2015 07:28:00 GMT", etag, 100)
+	assert.NoError(t, err)
+	assert.Nil(t, got, "want the whole result for If-Range dates")
+}
+
+func TestRangeWriterCutsRangeAcrossWrites(t *testing.T) {
+	var out bytes.Buffer
+	w := &rangeWriter { w: &out, rng: byteRange { start: 2, end: 7 } }
+	for _, p := range []string { "ab", "cd", "efgh", "ij" } {
+		n, err := w.Write([]byte(p))
+		assert.NoError(t, err)
+		assert.Equal(t, len(p), n)
+	}
+	assert.Equal(t, "cdefg", out.String())
+}
@@ -4,53 +4,230 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/equinor/oneseismic/api/internal/archive"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
-	"github.com/go-redis/redis/v8"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 type Result struct {
 	Timeout    time.Duration
 	StorageURL string
-	Storage    redis.Cmdable
+	Storage    queue.Results
 	Keyring    *auth.Keyring
+	/*
+	 * The archive of finished results, or nil if archiving is disabled, and
+	 * how long results are kept there.
+	 */
+	Archive          archive.Archive
+	ArchiveRetention time.Duration
 }
 
 /*
- * Silly helper to centralise the name/key of the header object. It's not
- * likely to change too much, but it beats hardcoding the key with formatting
- * all over the place.
+ * The time allowed for writing a result to the archive
+ */
+const archiveTimeout = 1 * time.Minute
+
+/*
+ * Serve the result from the archive, if archiving is enabled and the result is
+ * archived. Returns false if the result was not served, i.e. the caller
+ * should respond.
+ *
+ * The result is streamed from the archive, and only the requested range is
+ * read from it. The size (and so the ETag and the ranges) is known from the
+ * archive before the result is read.
  */
-func headerkey(pid string) string {
-	return fmt.Sprintf("%s/header.json", pid)
+func (r *Result) serveArchived(ctx *gin.Context, pid string) bool {
+	if r.Archive == nil {
+		return false
+	}
+	logerr := func(err error) {
+		if err != archive.ErrNotFound {
+			zap.L().Error(
+				"unable to get archived result",
+				logging.Pid(pid),
+				zap.Error(err),
+			)
+		}
+	}
+	info, err := r.Archive.Stat(ctx, pid)
+	if err != nil {
+		logerr(err)
+		return false
+	}
+
+	total  := int(info.Size)
+	status := http.StatusOK
+	header := ctx.Writer.Header()
+	var rng *byteRange
+	if !encoded(header) {
+		etag := resultETag(pid, total)
+		rng, err = parseRange(
+			ctx.GetHeader("Range"),
+			ctx.GetHeader("If-Range"),
+			etag,
+			total,
+		)
+		header.Set("Accept-Ranges", "bytes")
+		header.Set("ETag", etag)
+		if err == errUnsatisfiable {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+			ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+			return true
+		}
+	}
+
+	offset := 0
+	length := total
+	if rng != nil {
+		offset = rng.start
+		length = rng.length()
+	}
+	body, err := r.Archive.Get(ctx, pid, int64(offset), int64(length))
+	if err != nil {
+		logerr(err)
+		header.Del("Accept-Ranges")
+		header.Del("ETag")
+		return false
+	}
+	defer body.Close()
+
+	header.Set("Content-Type", "application/octet-stream")
+	if !encoded(header) {
+		if rng != nil {
+			status = http.StatusPartialContent
+			header.Set("Content-Range", rng.contentRange(total))
+		}
+		header.Set("Content-Length", strconv.Itoa(length))
+	}
+	ctx.Writer.WriteHeader(status)
+	_, err = io.Copy(ctx.Writer, body)
+	if err != nil {
+		zap.L().Error(
+			"unable to serve archived result",
+			logging.Pid(pid),
+			zap.Error(err),
+		)
+	}
+	return true
+}
+
+/*
+ * Archive the (complete) result, unless it is already archived. This is done
+ * in the background, so that the response is not held up by object storage.
+ * The result is read again from the result store, rather than kept from the
+ * response, so that serving a result does not hold it in memory. This is
+ * done once per result, not once per request.
+ */
+func (r *Result) archive(pid string) {
+	if r.Archive == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), archiveTimeout)
+		defer cancel()
+		_, err := r.Archive.Stat(ctx, pid)
+		if err == nil {
+			return
+		}
+		_, err = r.archiveNow(ctx, pid)
+		if err != nil {
+			zap.L().Error(
+				"unable to archive result",
+				logging.Pid(pid),
+				zap.Error(err),
+			)
+		}
+	}()
 }
 
 func parseProcessHeader(doc []byte) (*message.ProcessHeader, error) {
 	ph, err := (&message.ProcessHeader{}).Unpack(doc)
 	if err != nil {
-		log.Printf("bad process header: %s", string(doc))
+		zap.L().Error("bad process header", zap.ByteString("header", doc))
 		return ph, fmt.Errorf("unable to parse process header: %w", err)
 	}
 
 	if ph.Ntasks <= 0 {
-		log.Printf("bad process header: %s", string(doc))
+		zap.L().Error("bad process header", zap.ByteString("header", doc))
 		return ph, fmt.Errorf("processheader.parts = %d; want >= 1", ph.Ntasks)
 	}
 	return ph, nil
 }
 
+/*
+ * The span of a result request (the stream-out). The trace context of the
+ * process is only known once the first part is read from the result stream,
+ * so the span is started (back-dated to when the request started) on the
+ * first observed trace context. If no part carries a trace context, e.g. when
+ * tracing is disabled, no span is recorded.
+ */
+type resultTrace struct {
+	sync.Mutex
+	name  string
+	pid   string
+	start time.Time
+	span  trace.Span
+}
+
+func newResultTrace(name, pid string) *resultTrace {
+	return &resultTrace {
+		name:  name,
+		pid:   pid,
+		start: time.Now(),
+	}
+}
+
+func (t *resultTrace) observe(tracecontext map[string]string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.span != nil || len(tracecontext) == 0 {
+		return
+	}
+	parent := tracing.Extract(context.Background(), tracecontext)
+	_, t.span = tracing.Tracer().Start(
+		parent,
+		t.name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(t.start),
+		trace.WithAttributes(tracing.Pid(t.pid)),
+	)
+}
+
+func (t *resultTrace) end(err error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.span == nil {
+		return
+	}
+	if err != nil {
+		t.span.RecordError(err)
+		t.span.SetStatus(codes.Error, "result failed")
+	}
+	t.span.End()
+}
+
 func collectResult(
 	ctx context.Context,
-	storage redis.Cmdable,
+	storage queue.Results,
 	pid string,
 	head *message.ProcessHeader,
 	tiles chan []byte,
 	failure chan error,
+	rt *resultTrace,
 ) {
 	// This close is quite important - when the tiles channel is closed, it is
 	// a signal to the caller that all partial results are in and processed,
@@ -59,120 +236,258 @@ func collectResult(
 
 	tiles <- head.RawHeader
 
-	streamCursor := "0"
+	cursor := ""
 	count := 0
 	for count < head.Ntasks {
-		xreadArgs := redis.XReadArgs{
-			Streams: []string{pid, streamCursor},
-			Block:   0,
-		}
-		reply, err := storage.XRead(ctx, &xreadArgs).Result()
-
+		parts, next, err := storage.Read(ctx, pid, cursor)
 		if err != nil {
 			failure <- err
 			return
 		}
 
-		for _, message := range reply[0].Messages {
-			for _, tile := range message.Values {
-				chunk, ok := tile.(string)
-				if !ok {
-					msg := fmt.Sprintf("tile.type = %T; expected []byte]", tile)
-					failure <- errors.New(msg)
-					return
-				}
-
-				tiles <- []byte(chunk)
-				count++
-			}
-			streamCursor = message.ID
+		for _, part := range parts {
+			rt.observe(part.TraceContext)
+			tiles <- part.Body
+			count++
 		}
+		cursor = next
 	}
 }
 
 func (r *Result) Stream(ctx *gin.Context) {
+	start := time.Now()
+	defer func() {
+		resultDuration.WithLabelValues("stream").Observe(
+			time.Since(start).Seconds(),
+		)
+	}()
+
 	pid := ctx.Param("pid")
-	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	body, err := r.Storage.Header(ctx, pid)
 	if err != nil {
-		log.Printf("Unable to get process header: %v", err)
+		if r.serveArchived(ctx, pid) {
+			return
+		}
+		zap.L().Info(
+			"unable to get process header",
+			logging.Pid(pid),
+			zap.Error(err),
+		)
 		ctx.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
 	head, err := parseProcessHeader(body)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		zap.L().Error("stream failed", logging.Pid(pid), zap.Error(err))
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	tiles := make(chan []byte)
-	failure := make(chan error)
-	go collectResult(ctx, r.Storage, pid, head, tiles, failure)
-
-	w := ctx.Writer
-	header := w.Header()
+	header := ctx.Writer.Header()
 	header.Set("Transfer-Encoding", "chunked")
 	header.Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(http.StatusOK)
+	ctx.Writer.WriteHeader(http.StatusOK)
 
+	err = r.writeResult(ctx, ctx.Writer, pid, head, "stream", start)
+	if err != nil {
+		zap.L().Error("stream failed", logging.Pid(pid), zap.Error(err))
+		return
+	}
+	r.archive(pid)
+}
+
+/*
+ * Write the result to w as the parts are read from the result store, without
+ * holding on to them. The response header must be written already, so should
+ * reading the parts fail the response is cut short, which the client sees as
+ * a short (or unterminated chunked) body.
+ */
+func (r *Result) writeResult(
+	ctx   *gin.Context,
+	w     io.Writer,
+	pid   string,
+	head  *message.ProcessHeader,
+	label string,
+	start time.Time,
+) error {
+	rt := newResultTrace("stream-out", pid)
+	tiles := make(chan []byte)
+	failure := make(chan error)
+	go collectResult(ctx, r.Storage, pid, head, tiles, failure, rt)
+
+	first := true
 	for {
 		select {
 		case output, ok := <-tiles:
 			if !ok {
-				w.(http.Flusher).Flush()
-				return
+				ctx.Writer.Flush()
+				rt.end(nil)
+				return nil
 			}
 			w.Write(output)
+			if first {
+				first = false
+				resultTimeToFirstByte.WithLabelValues(label).Observe(
+					time.Since(start).Seconds(),
+				)
+			}
 
 		case err := <-failure:
-			log.Printf("pid=%s, %s", pid, err)
-			return
+			rt.end(err)
+			return err
 		}
 	}
 }
 
+/*
+ * A reader of the complete result, i.e. the header followed by the parts, as
+ * they are read from the result store. Reading fails if reading the parts
+ * fails. The reader must be closed, which stops reading the parts.
+ */
+func (r *Result) reader(
+	ctx  context.Context,
+	pid  string,
+	head *message.ProcessHeader,
+	rt   *resultTrace,
+) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		tiles := make(chan []byte)
+		/*
+		 * The failure is only read once all the tiles are, so it must be
+		 * buffered, or collectResult would block on it before closing tiles.
+		 */
+		failure := make(chan error, 1)
+		go collectResult(ctx, r.Storage, pid, head, tiles, failure, rt)
+
+		/*
+		 * Keep draining the tiles when the reader is closed, so that
+		 * collectResult is not left blocked on them. Cancelling the context
+		 * stops it reading more parts.
+		 */
+		var err error
+		for tile := range tiles {
+			if err != nil {
+				continue
+			}
+			_, err = pw.Write(tile)
+			if err != nil {
+				cancel()
+			}
+		}
+		select {
+		case err = <-failure:
+		default:
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+/*
+ * True if the response is encoded (compressed) on the way out, see
+ * util.Compression. The size, ranges and ETag are all of the result itself,
+ * so they do not apply to an encoded response.
+ */
+func encoded(header http.Header) bool {
+	return header.Get("Content-Encoding") != ""
+}
+
 func (r *Result) Get(ctx *gin.Context) {
+	start := time.Now()
 	pid := ctx.Param("pid")
-	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	body, err := r.Storage.Header(ctx, pid)
 	if err != nil {
-		log.Printf("Unable to get process header: %v", err)
+		if r.serveArchived(ctx, pid) {
+			return
+		}
+		zap.L().Info(
+			"unable to get process header",
+			logging.Pid(pid),
+			zap.Error(err),
+		)
 		ctx.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
 	head, err := parseProcessHeader(body)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		zap.L().Error("get failed", logging.Pid(pid), zap.Error(err))
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	count, err := r.Storage.XLen(ctx, pid).Result()
-
-	if count < int64(head.Ntasks) {
+	count, err := r.Storage.Count(ctx, pid)
+	if err != nil {
+		zap.L().Error("get failed", logging.Pid(pid), zap.Error(err))
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if count < head.Ntasks {
 		ctx.AbortWithStatus(http.StatusAccepted)
 		return
 	}
 
-	tiles := make(chan []byte, 1000)
-	failure := make(chan error)
-	go collectResult(ctx, r.Storage, pid, head, tiles, failure)
+	/*
+	 * The process is complete, so the size of the result is known up front
+	 * and the parts can be streamed as a plain, sized body.
+	 */
+	size, err := r.Storage.Size(ctx, pid)
+	if err != nil {
+		zap.L().Error("get failed", logging.Pid(pid), zap.Error(err))
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	total := len(head.RawHeader) + size
 
-	result := make([]byte, 0)
+	var w io.Writer = ctx.Writer
+	status := http.StatusOK
+	header := ctx.Writer.Header()
+	header.Set("Content-Type", "application/octet-stream")
+	if !encoded(header) {
+		etag := resultETag(pid, total)
+		header.Set("Accept-Ranges", "bytes")
+		header.Set("ETag", etag)
+
+		rng, err := parseRange(
+			ctx.GetHeader("Range"),
+			ctx.GetHeader("If-Range"),
+			etag,
+			total,
+		)
+		if err == errUnsatisfiable {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+			ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
 
-	for tile := range tiles {
-		result = append(result, tile...)
+		/*
+		 * A range is cut out of the parts as they are written. The stream
+		 * is still read from the start, since the size of the individual
+		 * parts is not known until they are read.
+		 */
+		length := total
+		if rng != nil {
+			w = &rangeWriter { w: ctx.Writer, rng: *rng }
+			status = http.StatusPartialContent
+			length = rng.length()
+			header.Set("Content-Range", rng.contentRange(total))
+		}
+		header.Set("Content-Length", strconv.Itoa(length))
 	}
+	ctx.Writer.WriteHeader(status)
 
-	select {
-	case err = <-failure:
-		ctx.AbortWithStatus(http.StatusInternalServerError)
+	err = r.writeResult(ctx, w, pid, head, "get", start)
+	if err != nil {
+		zap.L().Error("get failed", logging.Pid(pid), zap.Error(err))
 		return
-	default:
 	}
-
-	ctx.Data(http.StatusOK, "application/octet-stream", result)
+	resultDuration.WithLabelValues("get").Observe(time.Since(start).Seconds())
+	r.archive(pid)
 }
 
 func (r *Result) Status(ctx *gin.Context) {
@@ -192,8 +507,22 @@ func (r *Result) Status(ctx *gin.Context) {
 	 *
 	 * [1] the header-write step not completed, to be precise
 	 */
-	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
-	if err == redis.Nil {
+	body, err := r.Storage.Header(ctx, pid)
+	if err == queue.ErrNotFound && r.Archive != nil {
+		/*
+		 * The result may have expired from the result store, but still be
+		 * archived
+		 */
+		_, aerr := r.Archive.Stat(ctx, pid)
+		if aerr == nil {
+			ctx.JSON(http.StatusOK, gin.H {
+				"location": fmt.Sprintf("result/%s", pid),
+				"status": "finished",
+			})
+			return
+		}
+	}
+	if err == queue.ErrNotFound {
 		/* request sucessful, but key does not exist */
 		ctx.JSON(http.StatusAccepted, gin.H {
 			"location": fmt.Sprintf("result/%s/status", pid),
@@ -202,26 +531,26 @@ func (r *Result) Status(ctx *gin.Context) {
 		return
 	}
 	if err != nil {
-		log.Printf("%s %v", pid, err)
+		zap.L().Error("status failed", logging.Pid(pid), zap.Error(err))
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	proc, err := parseProcessHeader(body)
 	if err != nil {
-		log.Printf("%s %v", pid, err)
+		zap.L().Error("status failed", logging.Pid(pid), zap.Error(err))
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	count, err := r.Storage.XLen(ctx, pid).Result()
+	count, err := r.Storage.Count(ctx, pid)
 	if err != nil {
-		log.Printf("%s %v", pid, err)
+		zap.L().Error("status failed", logging.Pid(pid), zap.Error(err))
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	done := count == int64(proc.Ntasks)
+	done := count == proc.Ntasks
 	completed := fmt.Sprintf("%d/%d", count, proc.Ntasks)
 
 	// TODO: add (and detect) failed status
@@ -239,3 +568,94 @@ func (r *Result) Status(ctx *gin.Context) {
 		})
 	}
 }
+
+/*
+ * Make a link to the result that can be shared, i.e. a URL with a token that
+ * is valid for as long as the result is archived, signed on behalf of the
+ * user of the request. The result is archived first, if it is not already, so
+ * the process must be finished.
+ *
+ * The link is valid until the archived result expires, which is
+ * ArchiveRetention after it was archived, and not after the link was made.
+ */
+func (r *Result) Link(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	if r.Archive == nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	info, err := r.Archive.Stat(ctx, pid)
+	expires := info.Expires
+	if err == archive.ErrNotFound {
+		expires, err = r.archiveNow(ctx, pid)
+	}
+	if err == queue.ErrNotFound {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err == errNotFinished {
+		ctx.JSON(http.StatusAccepted, gin.H {
+			"location": fmt.Sprintf("result/%s/status", pid),
+			"status": "working",
+		})
+		return
+	}
+	if err != nil {
+		zap.L().Error("link failed", logging.Pid(pid), zap.Error(err))
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	key, err := r.Keyring.SignLink(pid, auth.VerifiedUser(ctx), expires)
+	if err != nil {
+		zap.L().Error("signing failed", logging.Pid(pid), zap.Error(err))
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H {
+		"url":     fmt.Sprintf("result/%s?key=%s", pid, url.QueryEscape(key)),
+		"key":     key,
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+}
+
+var errNotFinished = errors.New("process not finished")
+
+/*
+ * Archive the result from the result store, and return when it expires.
+ * Returns queue.ErrNotFound if the process does not exist (or has expired),
+ * and errNotFinished if not all parts are written yet.
+ */
+func (r *Result) archiveNow(
+	ctx context.Context,
+	pid string,
+) (time.Time, error) {
+	body, err := r.Storage.Header(ctx, pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	count, err := r.Storage.Count(ctx, pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if count < head.Ntasks {
+		return time.Time{}, errNotFinished
+	}
+
+	rt := newResultTrace("archive", pid)
+	result := r.reader(ctx, pid, head, rt)
+	defer result.Close()
+	expires := time.Now().Add(r.ArchiveRetention)
+	err = r.Archive.Put(ctx, pid, result, expires)
+	rt.end(err)
+	if err != nil {
+		return time.Time{}, err
+	}
+	zap.L().Info("result archived", logging.Pid(pid))
+	return expires, nil
+}
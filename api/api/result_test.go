@@ -0,0 +1,278 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/equinor/oneseismic/api/internal/archive"
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+/*
+ * A process header for a process of ntasks tasks, with the envelope that the
+ * planner writes in front of it.
+ */
+func processHeader(t *testing.T, ntasks int) []byte {
+	body, err := msgpack.Marshal(map[string]int { "nbundles": ntasks })
+	assert.NoError(t, err)
+	return append([]byte { 0x92 }, body...)
+}
+
+func archivingResult() *Result {
+	keyring := auth.MakeKeyring([]byte("psk"))
+	return &Result {
+		Storage:          queue.NewMemoryResults(queue.DefaultTTL),
+		Keyring:          &keyring,
+		Archive:          archive.NewMemoryArchive(),
+		ArchiveRetention: time.Hour,
+	}
+}
+
+func serveResult(r *Result, target string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	return serveRequest(r, req)
+}
+
+func serveRequest(r *Result, req *http.Request) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.GET("/result/:pid", r.Get)
+	app.GET("/result/:pid/link", r.Link)
+	app.GET("/result/:pid/status", r.Status)
+	app.GET("/result/:pid/events", r.Events)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func rangeRequest(target, rng, ifrange string) *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Range", rng)
+	if ifrange != "" {
+		req.Header.Set("If-Range", ifrange)
+	}
+	return req
+}
+
+func TestResultServedFromArchiveAfterExpiry(t *testing.T) {
+	r := archivingResult()
+	expires := time.Now().Add(time.Hour)
+	err := r.Archive.Put(
+		context.Background(),
+		"pid",
+		strings.NewReader("result"),
+		expires,
+	)
+	assert.NoError(t, err)
+
+	w := serveResult(r, "/result/pid")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "result", w.Body.String())
+
+	w = serveResult(r, "/result/pid/status")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serveResult(r, "/result/other")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestLinkArchivesFinishedResult(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	header := processHeader(t, 2)
+	r.Storage.SetHeader(ctx, "pid", header, 0)
+	r.Storage.Append(ctx, "pid", queue.Part { Name: "0/2", Body: []byte("a") })
+
+	w := serveResult(r, "/result/pid/link")
+	assert.Equal(t, http.StatusAccepted, w.Code, "want 202 when not finished")
+
+	r.Storage.Append(ctx, "pid", queue.Part { Name: "1/2", Body: []byte("b") })
+	w = serveResult(r, "/result/pid/link")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var link struct {
+		Url     string `json:"url"`
+		Key     string `json:"key"`
+		Expires string `json:"expires"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &link))
+	assert.Equal(t, fmt.Sprintf("result/pid?key=%s", link.Key), link.Url)
+	assert.NoError(t, r.Keyring.Validate(link.Key, "pid"))
+
+	info, err := r.Archive.Stat(ctx, "pid")
+	assert.NoError(t, err)
+	assert.Equal(t, info.Expires.UTC().Format(time.RFC3339), link.Expires)
+
+	body, err := r.Archive.Get(ctx, "pid", 0, info.Size)
+	assert.NoError(t, err)
+	archived, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, append(header, []byte("ab")...), archived)
+}
+
+func TestLinkWithoutArchiveIsNotFound(t *testing.T) {
+	r := archivingResult()
+	r.Archive = nil
+	w := serveResult(r, "/result/pid/link")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetStreamsSizedResult(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	r.Archive = nil
+	header := processHeader(t, 2)
+	r.Storage.SetHeader(ctx, "pid", header, 0)
+	r.Storage.Append(ctx, "pid", queue.Part { Name: "0/2", Body: []byte("ab") })
+
+	w := serveResult(r, "/result/pid")
+	assert.Equal(t, http.StatusAccepted, w.Code, "want 202 when not finished")
+
+	r.Storage.Append(ctx, "pid", queue.Part { Name: "1/2", Body: []byte("cde") })
+	w = serveResult(r, "/result/pid")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, append(header, []byte("abcde")...), w.Body.Bytes())
+	assert.Equal(
+		t,
+		fmt.Sprintf("%d", len(header) + 5),
+		w.Header().Get("Content-Length"),
+	)
+}
+
+func TestGetServesRange(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	r.Archive = nil
+	header := processHeader(t, 2)
+	r.Storage.SetHeader(ctx, "pid", header, 0)
+	r.Storage.Append(ctx, "pid", queue.Part { Name: "0/2", Body: []byte("ab") })
+	r.Storage.Append(ctx, "pid", queue.Part { Name: "1/2", Body: []byte("cde") })
+	result := append(header, []byte("abcde")...)
+	total  := len(result)
+
+	w := serveResult(r, "/result/pid")
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+
+	rng := fmt.Sprintf("bytes=%d-", total - 4)
+	w = serveRequest(r, rangeRequest("/result/pid", rng, etag))
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, result[total - 4:], w.Body.Bytes())
+	assert.Equal(t, "4", w.Header().Get("Content-Length"))
+	assert.Equal(
+		t,
+		fmt.Sprintf("bytes %d-%d/%d", total - 4, total - 1, total),
+		w.Header().Get("Content-Range"),
+	)
+
+	w = serveRequest(r, rangeRequest("/result/pid", rng, `"stale"`))
+	assert.Equal(t, http.StatusOK, w.Code, "want 200 on If-Range mismatch")
+	assert.Equal(t, result, w.Body.Bytes())
+
+	rng = fmt.Sprintf("bytes=%d-", total)
+	w = serveRequest(r, rangeRequest("/result/pid", rng, ""))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(
+		t,
+		fmt.Sprintf("bytes */%d", total),
+		w.Header().Get("Content-Range"),
+	)
+}
+
+func TestArchivedResultServesRangeWithSameETag(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	expires := time.Now().Add(time.Hour)
+	err := r.Archive.Put(ctx, "pid", strings.NewReader("result"), expires)
+	assert.NoError(t, err)
+
+	etag := resultETag("pid", len("result"))
+	w := serveRequest(r, rangeRequest("/result/pid", "bytes=2-", etag))
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "sult", w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, "bytes 2-5/6", w.Header().Get("Content-Range"))
+	assert.Equal(t, "4", w.Header().Get("Content-Length"))
+
+	w = serveRequest(r, rangeRequest("/result/pid", "bytes=6-", ""))
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(t, "bytes */6", w.Header().Get("Content-Range"))
+}
+
+func TestCompressedGetIsNotSized(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	r.Archive = nil
+	r.Storage.SetHeader(ctx, "pid", processHeader(t, 1), 0)
+	r.Storage.Append(ctx, "pid", queue.Part { Name: "0/1", Body: []byte("ab") })
+
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(util.Compression(config.DefaultCompression()))
+	app.GET("/result/:pid", r.Get)
+	w := httptest.NewRecorder()
+	req := rangeRequest("/result/pid?compression=gz", "bytes=1-", "")
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "want the whole result")
+	/*
+	 * The headers as sent, as the middleware touches the header map after
+	 * the response is written
+	 */
+	header := w.Result().Header
+	assert.Equal(t, "gzip", header.Get("Content-Encoding"))
+	assert.Empty(t, header.Get("Content-Length"))
+	assert.Empty(t, header.Get("ETag"))
+}
+
+/*
+ * A result store where reading the parts fails
+ */
+type unreadableResults struct {
+	*queue.MemoryResults
+}
+
+func (unreadableResults) Read(
+	ctx    context.Context,
+	pid    string,
+	cursor string,
+) ([]queue.Part, string, error) {
+	return nil, cursor, fmt.Errorf("read failed")
+}
+
+func TestArchiveFailsWhenResultIsUnreadable(t *testing.T) {
+	ctx := context.Background()
+	r   := archivingResult()
+	storage := unreadableResults { queue.NewMemoryResults(queue.DefaultTTL) }
+	storage.SetHeader(ctx, "pid", processHeader(t, 1), 0)
+	storage.Append(ctx, "pid", queue.Part { Name: "0/1", Body: []byte("a") })
+	r.Storage = storage
+
+	done := make(chan error)
+	go func() {
+		_, err := r.archiveNow(ctx, "pid")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("archiving an unreadable result did not return")
+	}
+	_, err := r.Archive.Stat(ctx, "pid")
+	assert.Equal(t, archive.ErrNotFound, err)
+}
@@ -12,10 +12,14 @@ package api
 
 import(
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/quota"
 )
 
 type redisScheduler struct {
@@ -40,40 +44,159 @@ type scheduler interface {
 func NewScheduler(storage redis.Cmdable) scheduler {
 	return &redisScheduler {
 		queue: storage,
-		ttl:   10 * time.Minute,
+		ttl:   queue.DefaultTTL,
 	}
 }
 
+/*
+ * Check that the redis scheduler can schedule on the client. With redis
+ * cluster the header and the job stream hash to different slots, and the
+ * go-redis cluster client splits the transaction into one per node. A process
+ * could then be partially scheduled, i.e. its header could promise tasks that
+ * are never enqueued, and so the scheduler refuses cluster mode.
+ *
+ * The header key is made from the pid alone, and the job streams are shared
+ * by all processes, so there is no hash tag that would put them in the same
+ * slot.
+ */
+func CheckScheduler(client redis.UniversalClient) error {
+	if _, cluster := client.(*redis.ClusterClient); cluster {
+		return errors.New(
+			"redis cluster is not supported by the scheduler; " +
+			"the header and tasks of a process cannot be written atomically",
+		)
+	}
+	return nil
+}
+
+/*
+ * Write the header and all the tasks in a single MULTI/EXEC, so that a
+ * process is either fully scheduled or not at all. Should the transaction
+ * fail, nothing is enqueued and no header claims tasks that will never be
+ * processed, which would make /result wait forever.
+ *
+ * This is also a single round trip, regardless of the number of tasks.
+ *
+ * Redis does not roll back a transaction when a command fails inside EXEC,
+ * but the commands here only fail like that on a wrongly-typed key, which
+ * would be a bug or misconfiguration. The transaction is only atomic with a
+ * single redis (standalone or sentinel), see CheckScheduler.
+ */
 func (rs *redisScheduler) Schedule(
 	ctx  context.Context,
 	pid  string,
 	plan *QueryPlan,
 ) error {
-	err := rs.queue.Set(
-		ctx,
-		fmt.Sprintf("%s/header.json", pid),
-		plan.header,
-		rs.ttl,
-	).Err()
+	ttl := plan.retention
+	if ttl <= 0 {
+		ttl = rs.ttl
+	}
+	_, err := rs.queue.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, fmt.Sprintf("%s/header.json", pid), plan.header, ttl)
+		for _, task := range plan.tasks(pid, ttl) {
+			pipe.XAdd(ctx, &redis.XAddArgs {
+				Stream: queue.PriorityStream("jobs", task.Priority),
+				Values: queue.RedisValues(task),
+			})
+		}
+		return nil
+	})
+	return err
+}
+
+/*
+ * A scheduler on top of the queue interfaces, for queues other than redis,
+ * e.g. the in-memory queues used in single-binary mode (oneseismic-server).
+ */
+type queueScheduler struct {
+	jobs    queue.Jobs
+	results queue.Results
+}
+
+func NewQueueScheduler(jobs queue.Jobs, results queue.Results) scheduler {
+	return &queueScheduler {
+		jobs:    jobs,
+		results: results,
+	}
+}
+
+func (qs *queueScheduler) Schedule(
+	ctx  context.Context,
+	pid  string,
+	plan *QueryPlan,
+) error {
+	err := qs.results.SetHeader(ctx, pid, plan.header, plan.retention)
 	if err != nil {
 		return err
 	}
-	values := []interface{} {
-		"pid",  pid,
-		"part", nil,
-		"task", nil,
-	}
-	args := &redis.XAddArgs{Stream: "jobs", Values: values}
-	ntasks := len(plan.plan)
-	for i, task := range plan.plan {
-		part := fmt.Sprintf("%d/%d", i, ntasks)
-		values[3] = part
-		values[5] = task
-		err := rs.queue.XAdd(ctx, args).Err()
-		if err != nil {
-			msg := "pid=%s, part=%v, unable to schedule: %w"
-			return fmt.Errorf(msg, pid, part, err)
+	err = qs.jobs.Enqueue(ctx, plan.tasks(pid, plan.retention)...)
+	if err != nil {
+		/*
+		 * Some of the tasks may be queued, but not all, so the process will
+		 * never complete. Remove the header, which promises all the parts,
+		 * so that the result is not waited for. Should that fail too, the
+		 * header expires with the retention.
+		 */
+		if delerr := qs.results.DeleteHeader(ctx, pid); delerr != nil {
+			return fmt.Errorf(
+				"%w; and unable to remove the header: %v",
+				err,
+				delerr,
+			)
 		}
+		return err
 	}
 	return nil
 }
+
+/*
+ * A scheduler that interleaves the tasks of different users, so that a single
+ * user with large queries cannot monopolise the fetch workers.
+ *
+ * A user only gets share tasks on the job queue at once. The tasks of a
+ * process are put on the user's queue of held-back tasks in redis, in the
+ * same transaction as the header, and as many as the user has share for are
+ * moved on to the job queue right away. The fetch workers release the rest as
+ * the user's tasks are done (see quota.Hold), which puts them behind the
+ * tasks other users queued in the meantime.
+ *
+ * Since the held-back tasks are in redis from the start, a process is never
+ * partially scheduled, and nothing is lost should the query service stop.
+ *
+ * The queries of unknown users are scheduled directly.
+ */
+type fairScheduler struct {
+	redisScheduler
+	share int
+}
+
+func NewFairScheduler(storage redis.Cmdable, share int) scheduler {
+	return &fairScheduler {
+		redisScheduler: redisScheduler {
+			queue: storage,
+			ttl:   queue.DefaultTTL,
+		},
+		share: share,
+	}
+}
+
+func (fs *fairScheduler) Schedule(
+	ctx  context.Context,
+	pid  string,
+	plan *QueryPlan,
+) error {
+	if plan.user == "" || fs.share <= 0 {
+		return fs.redisScheduler.Schedule(ctx, pid, plan)
+	}
+
+	ttl := plan.retention
+	if ttl <= 0 {
+		ttl = fs.ttl
+	}
+	tasks := plan.tasks(pid, ttl)
+	_, err := fs.queue.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, fmt.Sprintf("%s/header.json", pid), plan.header, ttl)
+		return quota.Hold(ctx, pipe, "jobs", fs.share, ttl, tasks)
+	})
+	return err
+}
@@ -8,79 +8,197 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal"
+	"github.com/equinor/oneseismic/api/internal/callback"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/quota"
 )
 
-type redisNoSET struct {
-	redis.Cmdable
+/*
+ * A pipeline that records the queued commands rather than sending them. The
+ * commands fail with setErr and xaddErr, as if they failed in EXEC.
+ */
+type fakePipe struct {
+	redis.Pipeliner
+	setErr  error
+	xaddErr error
+	cmds    []redis.Cmder
+	streams []string
+	held    []interface{}
+	scripts int
 }
 
-func (r *redisNoSET) Set(
+func (p *fakePipe) Set(
 	ctx context.Context,
 	key string,
 	val interface{},
 	ttl time.Duration,
 ) *redis.StatusCmd {
-	return redis.NewStatusResult("set-fails", fmt.Errorf("SET failure"))
+	cmd := redis.NewStatusResult("OK", p.setErr)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
 }
 
-func TestScheduleFailsOnSETError(t *testing.T) {
-	s   := NewScheduler(&redisNoSET{})
-	err := s.Schedule(context.Background(), "<pid>", &QueryPlan{})
-	msg := "SET failure"
-	assert.EqualErrorf(t, err, msg, "want err = %v; was %v", msg, err)
+func (p *fakePipe) XAdd(
+	ctx  context.Context,
+	args *redis.XAddArgs,
+) *redis.StringCmd {
+	cmd := redis.NewStringResult("0-1", p.xaddErr)
+	p.cmds = append(p.cmds, cmd)
+	p.streams = append(p.streams, args.Stream)
+	return cmd
 }
 
-type redisContextAware struct {
-	redis.Cmdable
+func (p *fakePipe) RPush(
+	ctx    context.Context,
+	key    string,
+	values ...interface{},
+) *redis.IntCmd {
+	cmd := redis.NewIntResult(int64(len(values)), nil)
+	p.cmds = append(p.cmds, cmd)
+	p.held = append(p.held, values...)
+	return cmd
 }
 
-func (r *redisContextAware) Set(
+func (p *fakePipe) IncrBy(
+	ctx   context.Context,
+	key   string,
+	value int64,
+) *redis.IntCmd {
+	cmd := redis.NewIntResult(value, nil)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
+}
+
+func (p *fakePipe) PExpire(
 	ctx context.Context,
 	key string,
-	val interface{},
 	ttl time.Duration,
-) *redis.StatusCmd {
-	return redis.NewStatusResult("-", ctx.Err())
+) *redis.BoolCmd {
+	cmd := redis.NewBoolResult(true, nil)
+	p.cmds = append(p.cmds, cmd)
+	return cmd
 }
 
-func TestSetCompletedCalledIfContextCancelled(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
-	ctxaware    := &redisContextAware{}
-	cancel()
-	s   := NewScheduler(ctxaware)
-	err := s.Schedule(ctx, "<pid>", &QueryPlan{})
-	msg := "context canceled"
-	assert.EqualErrorf(t, err, msg, "want err = %v; was %v", msg, err)
+func (p *fakePipe) Eval(
+	ctx    context.Context,
+	script string,
+	keys   []string,
+	args   ...interface{},
+) *redis.Cmd {
+	cmd := redis.NewCmdResult(int64(0), nil)
+	p.cmds = append(p.cmds, cmd)
+	p.scripts++
+	return cmd
 }
 
-type redisNoXADD struct {
+/*
+ * Only TxPipelined is implemented, so any command sent outside of the
+ * transaction panics on the nil Cmdable.
+ */
+type redisTx struct {
 	redis.Cmdable
+	pipe  fakePipe
+	calls int
 }
 
-func (r *redisNoXADD) Set(
+func (r *redisTx) TxPipelined(
 	ctx context.Context,
-	key string,
-	val interface{},
-	ttl time.Duration,
-) *redis.StatusCmd {
-	return redis.NewStatusResult("OK", nil)
+	fn  func(redis.Pipeliner) error,
+) ([]redis.Cmder, error) {
+	r.calls++
+	if err := fn(&r.pipe); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, cmd := range r.pipe.cmds {
+		if err := cmd.Err(); err != nil {
+			return r.pipe.cmds, err
+		}
+	}
+	return r.pipe.cmds, nil
 }
 
-func (r *redisNoXADD) XAdd(
-	ctx  context.Context,
-	args *redis.XAddArgs,
-) *redis.StringCmd {
-	return redis.NewStringResult("xadd-fails", fmt.Errorf("XADD failure"))
+func TestScheduleFailsOnSETError(t *testing.T) {
+	s   := NewScheduler(&redisTx{ pipe: fakePipe{ setErr: fmt.Errorf("SET failure") } })
+	err := s.Schedule(context.Background(), "<pid>", &QueryPlan{})
+	msg := "SET failure"
+	assert.EqualErrorf(t, err, msg, "want err = %v; was %v", msg, err)
+}
+
+func TestSetCompletedCalledIfContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s   := NewScheduler(&redisTx{})
+	err := s.Schedule(ctx, "<pid>", &QueryPlan{})
+	msg := "context canceled"
+	assert.EqualErrorf(t, err, msg, "want err = %v; was %v", msg, err)
 }
 
 func TestScheduleFailsOnXADDError(t *testing.T) {
-	s   := NewScheduler(&redisNoXADD{})
+	s   := NewScheduler(&redisTx{ pipe: fakePipe{ xaddErr: fmt.Errorf("XADD failure") } })
 	qp  := &QueryPlan{plan: make([][]byte, 2)}
 	err := s.Schedule(context.Background(), "<pid>", qp)
 	msg := "XADD failure"
 	assert.Containsf(t, err.Error(), msg, "want err = %v; was %v", msg, err)
 }
 
+func TestScheduleIsSingleTransaction(t *testing.T) {
+	tx  := &redisTx{}
+	s   := NewScheduler(tx)
+	qp  := &QueryPlan{plan: make([][]byte, 100)}
+	err := s.Schedule(context.Background(), "<pid>", qp)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tx.calls)
+	/* the header and one XADD per task */
+	assert.Len(t, tx.pipe.cmds, 101)
+}
+
+func TestSchedulerRefusesRedisCluster(t *testing.T) {
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{})
+	defer cluster.Close()
+	assert.Error(t, CheckScheduler(cluster))
+
+	client := redis.NewClient(&redis.Options{})
+	defer client.Close()
+	assert.NoError(t, CheckScheduler(client))
+}
+
+func TestScheduleBatchOnBatchStream(t *testing.T) {
+	tx  := &redisTx{}
+	s   := NewScheduler(tx)
+	qp  := &QueryPlan{plan: make([][]byte, 2), priority: queue.Batch}
+	err := s.Schedule(context.Background(), "<pid>", qp)
+	assert.NoError(t, err)
+	assert.Equal(t, []string { "jobs-batch", "jobs-batch" }, tx.pipe.streams)
+}
+
+func TestQueryPriorityFromOptsOrCost(t *testing.T) {
+	batch := "batch"
+	interactive := "interactive"
+	cases := []struct {
+		opts     interface{}
+		ntasks   int
+		expected queue.Priority
+	}{
+		{ nil,                                  10,  queue.Interactive },
+		{ &opts{},                              500, queue.Batch       },
+		{ &opts{ Priority: &batch },            10,  queue.Batch       },
+		{ &opts{ Priority: &interactive },      500, queue.Interactive },
+	}
+	for _, c := range cases {
+		p, err := queryPriority(c.opts, c.ntasks, 250)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, p)
+	}
+
+	p, err := queryPriority(nil, 500, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, queue.Interactive, p, "threshold 0 should disable")
+}
 
 func TestErrorOnDisconnectedClient(t *testing.T) {
 	dcd := redis.NewClient(&redis.Options{})
@@ -89,3 +207,140 @@ func TestErrorOnDisconnectedClient(t *testing.T) {
 	err := s.Schedule(context.Background(), "<pid>", qp)
 	assert.Error(t, err, "Scheduling on disconnected redis did not fail")
 }
+
+func TestQueueSchedulerEnqueuesAllTasks(t *testing.T) {
+	ctx     := context.Background()
+	jobs    := queue.NewMemoryJobs()
+	results := queue.NewMemoryResults(queue.DefaultTTL)
+	s  := NewQueueScheduler(jobs, results)
+	qp := &QueryPlan{
+		header: []byte("header"),
+		plan:   [][]byte{ []byte("task-0"), []byte("task-1") },
+	}
+	err := s.Schedule(ctx, "<pid>", qp)
+	assert.NoError(t, err)
+
+	header, err := results.Header(ctx, "<pid>")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("header"), header)
+
+	for i := 0; i < 2; i++ {
+		tasks, err := jobs.Read(ctx, "consumer", time.Second)
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+		assert.Equal(t, fmt.Sprintf("%d/2", i), tasks[0].Part)
+		assert.Equal(t, fmt.Sprintf("task-%d", i), string(tasks[0].Body))
+	}
+}
+
+/*
+ * A job queue that only takes the first of the tasks it is given, and fails.
+ */
+type partialJobs struct {
+	*queue.MemoryJobs
+}
+
+func (j partialJobs) Enqueue(ctx context.Context, tasks ...queue.Task) error {
+	j.MemoryJobs.Enqueue(ctx, tasks[0])
+	return fmt.Errorf("enqueue failed")
+}
+
+func TestQueueSchedulerRemovesHeaderOnEnqueueFailure(t *testing.T) {
+	ctx     := context.Background()
+	jobs    := partialJobs { queue.NewMemoryJobs() }
+	results := queue.NewMemoryResults(queue.DefaultTTL)
+	s  := NewQueueScheduler(jobs, results)
+	qp := &QueryPlan{
+		header: []byte("header"),
+		plan:   [][]byte{ []byte("task-0"), []byte("task-1") },
+	}
+	err := s.Schedule(ctx, "<pid>", qp)
+	assert.Error(t, err)
+
+	_, err = results.Header(ctx, "<pid>")
+	assert.Equal(t, queue.ErrNotFound, err)
+}
+
+func TestFairSchedulerHoldsTasksInSingleTransaction(t *testing.T) {
+	tx  := &redisTx{}
+	s   := NewFairScheduler(tx, 2)
+	qp  := &QueryPlan{plan: make([][]byte, 5), user: "user"}
+	err := s.Schedule(context.Background(), "<pid>", qp)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tx.calls)
+	/*
+	 * All tasks are held, and released to the job queue by the script in
+	 * the same transaction as the header
+	 */
+	assert.Empty(t, tx.pipe.streams)
+	assert.Len(t, tx.pipe.held, 5)
+	assert.Equal(t, 1, tx.pipe.scripts)
+}
+
+func TestFairSchedulerSchedulesUnknownUserDirectly(t *testing.T) {
+	tx  := &redisTx{}
+	s   := NewFairScheduler(tx, 2)
+	qp  := &QueryPlan{plan: make([][]byte, 5)}
+	err := s.Schedule(context.Background(), "<pid>", qp)
+	assert.NoError(t, err)
+	assert.Len(t, tx.pipe.streams, 5)
+	assert.Empty(t, tx.pipe.held)
+}
+
+func TestAdmitReturnsStructuredQuotaError(t *testing.T) {
+	ctx    := context.Background()
+	quotas := quota.NewMemoryStore(quota.Limits { Processes: 1 })
+	assert.NoError(t, admit(ctx, quotas, "user", "pid-0", 1))
+	assert.NoError(t, admit(ctx, quotas, "",     "pid-1", 1))
+	assert.NoError(t, admit(ctx, nil,    "user", "pid-1", 1))
+
+	err := admit(ctx, quotas, "user", "pid-1", 1)
+	qe, ok := err.(*internal.QuotaExceededE)
+	if !assert.True(t, ok, "want QuotaExceededE; was %T", err) {
+		return
+	}
+	extensions := qe.Extensions()
+	assert.Equal(t, "QUOTA_EXCEEDED", extensions["code"])
+	assert.Equal(t, "processes", extensions["limit"])
+	assert.Equal(t, 10, extensions["retryAfter"])
+}
+
+func TestQueryRetentionFromOpts(t *testing.T) {
+	hour   := int32(3600)
+	day    := int32(86400)
+	zero   := int32(0)
+	retention := 4 * time.Hour
+
+	r, err := queryRetention(nil, retention)
+	assert.NoError(t, err)
+	assert.Equal(t, retention, r)
+
+	r, err = queryRetention(&opts{ Retention: &hour }, retention)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, r)
+
+	for _, seconds := range []*int32 { &day, &zero } {
+		_, err = queryRetention(&opts{ Retention: seconds }, retention)
+		assert.Error(t, err, "want error for retention = %d", *seconds)
+	}
+}
+
+func TestQueryCallbackFromOpts(t *testing.T) {
+	allowed := "https://hooks.example.com/done"
+	other   := "https://other.example.com/done"
+	hosts   := callback.Hosts { "hooks.example.com" }
+
+	cb, err := queryCallback(nil, hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, "", cb)
+
+	cb, err = queryCallback(&opts{ Callback: &allowed }, hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, allowed, cb)
+
+	_, err = queryCallback(&opts{ Callback: &other }, hosts)
+	assert.Error(t, err, "want error for host not allowed")
+
+	_, err = queryCallback(&opts{ Callback: &allowed }, nil)
+	assert.Error(t, err, "want error when callbacks are disabled")
+}
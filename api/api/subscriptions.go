@@ -0,0 +1,490 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+/*
+ * GraphQL subscriptions over WebSocket, so that a client can follow the
+ * progress of its processes on the same connection as it makes the queries:
+ *
+ *     subscription {
+ *         process(pid: "<pid>", key: "<key>") { status progress }
+ *     }
+ *
+ * The key is the key of the promise, which authorizes the process like it does
+ * for /result. The progress is read from the result store, like the events
+ * of /result/<pid>/events, and the subscription completes when the process is
+ * finished or failed.
+ *
+ * Both the WebSocket sub-protocols in use are supported, graphql-transport-ws
+ * (the graphql-ws library) and the older graphql-ws (subscriptions-transport-ws
+ * and Apollo). They are the same protocol with different message names.
+ */
+type wsProtocol struct {
+	subscribe string
+	stop      string
+	data      string
+	/*
+	 * The server's keep-alive message, or empty if the client pings
+	 */
+	keepalive string
+}
+
+var wsProtocols = map[string]wsProtocol {
+	"graphql-transport-ws": {
+		subscribe: "subscribe",
+		stop:      "complete",
+		data:      "next",
+	},
+	"graphql-ws": {
+		subscribe: "start",
+		stop:      "stop",
+		data:      "data",
+		keepalive: "ka",
+	},
+}
+
+/*
+ * The keep-alive interval of the older graphql-ws protocol
+ */
+const wsKeepAlive = 15 * time.Second
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+var upgrader = websocket.Upgrader {
+	Subprotocols: []string { "graphql-transport-ws", "graphql-ws" },
+	/*
+	 * The subscriptions are authorized by the key in the query, not by
+	 * cookies or other ambient credentials, so any origin is fine
+	 */
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+type process struct {
+	pid    graphql.ID
+	status processStatus
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (p *process) Pid() graphql.ID {
+	return p.pid
+}
+
+func (p *process) Status() string {
+	return p.status.Status
+}
+
+func (p *process) Progress() *string {
+	return optional(p.status.Progress)
+}
+
+func (p *process) Location() *string {
+	return optional(p.status.Location)
+}
+
+func (p *process) Reason() *string {
+	return optional(p.status.Reason)
+}
+
+func (r *resolver) Process(
+	ctx  context.Context,
+	args struct {
+		Pid graphql.ID
+		Key string
+	},
+) (<-chan *process, error) {
+	qctx := getQueryContext(ctx)
+	if qctx.watch == nil {
+		return nil, internal.QueryError("subscriptions are not enabled")
+	}
+	pid := string(args.Pid)
+	err := qctx.keyring.Validate(args.Key, pid)
+	if err != nil {
+		zap.L().Info(
+			"subscription not authorized",
+			logging.Pid(pid),
+			zap.Error(err),
+		)
+		return nil, internal.PermissionDenied("invalid key for process")
+	}
+
+	c := make(chan *process)
+	go func() {
+		defer close(c)
+		send := func(status processStatus) {
+			select {
+			case c <- &process { pid: args.Pid, status: status }:
+			case <-ctx.Done():
+			}
+		}
+		qctx.watch.run(ctx, pid, send, func() {})
+	}()
+	return c, nil
+}
+
+/*
+ * Serve subscriptions on the WebSocket connection, until the client closes it.
+ */
+func (g *gql) serveWebSocket(ctx *gin.Context) {
+	pid := ctx.GetString("pid")
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// The upgrader has already responded with an error
+		zap.L().Info("websocket upgrade failed", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	protocol, ok := wsProtocols[conn.Subprotocol()]
+	if !ok {
+		protocol = wsProtocols["graphql-ws"]
+	}
+
+	/*
+	 * The connection is hijacked, so the request context is not cancelled
+	 * when the client goes away. The connection context is cancelled when
+	 * reading from the connection fails instead.
+	 */
+	wsctx, cancel := context.WithCancel(context.Background())
+	var pending sync.WaitGroup
+	defer pending.Wait()
+	defer cancel()
+
+	var lock sync.Mutex
+	write := func(msg wsMessage) {
+		lock.Lock()
+		defer lock.Unlock()
+		err := conn.WriteJSON(msg)
+		if err != nil {
+			zap.L().Info("websocket write failed", zap.Error(err))
+		}
+	}
+
+	/*
+	 * The running subscriptions by id. A subscription removes itself when it
+	 * completes, unless it has been replaced by a new one with the same id.
+	 */
+	type subscription struct {
+		stop context.CancelFunc
+	}
+	var sublock sync.Mutex
+	subscriptions := make(map[string]*subscription)
+	for {
+		var msg wsMessage
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case "connection_init":
+			write(wsMessage { Type: "connection_ack" })
+			if protocol.keepalive != "" {
+				pending.Add(1)
+				go func() {
+					defer pending.Done()
+					keepalive(wsctx, protocol.keepalive, write)
+				}()
+			}
+
+		case "ping":
+			write(wsMessage { Type: "pong" })
+
+		case protocol.subscribe:
+			subctx, stop := context.WithCancel(wsctx)
+			sub := &subscription { stop: stop }
+			sublock.Lock()
+			if prev, ok := subscriptions[msg.ID]; ok {
+				prev.stop()
+			}
+			subscriptions[msg.ID] = sub
+			sublock.Unlock()
+			pending.Add(1)
+			go func(msg wsMessage) {
+				defer pending.Done()
+				defer func() {
+					sublock.Lock()
+					defer sublock.Unlock()
+					if subscriptions[msg.ID] == sub {
+						delete(subscriptions, msg.ID)
+					}
+					sub.stop()
+				}()
+				g.subscribe(subctx, pid, protocol, msg, write)
+			}(msg)
+
+		case protocol.stop:
+			sublock.Lock()
+			if sub, ok := subscriptions[msg.ID]; ok {
+				sub.stop()
+				delete(subscriptions, msg.ID)
+			}
+			sublock.Unlock()
+
+		case "connection_terminate":
+			return
+		}
+	}
+}
+
+func keepalive(ctx context.Context, msgtype string, write func(wsMessage)) {
+	ticker := time.NewTicker(wsKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			write(wsMessage { Type: msgtype })
+		}
+	}
+}
+
+/*
+ * Run the subscription in the message, and send its responses until it
+ * completes or is stopped.
+ */
+func (g *gql) subscribe(
+	ctx      context.Context,
+	pid      string,
+	protocol wsProtocol,
+	msg      wsMessage,
+	write    func(wsMessage),
+) {
+	send := func(response *graphql.Response) {
+		payload, err := json.Marshal(response)
+		if err != nil {
+			zap.L().Error(
+				"unable to marshal response",
+				logging.Pid(pid),
+				zap.Error(err),
+			)
+			return
+		}
+		write(wsMessage { ID: msg.ID, Type: protocol.data, Payload: payload })
+	}
+
+	fail := func(err *gqlerrors.QueryError) {
+		send(&graphql.Response { Errors: []*gqlerrors.QueryError { err } })
+		write(wsMessage { ID: msg.ID, Type: "complete" })
+	}
+
+	query := util.GraphQLQuery {}
+	err := json.Unmarshal(msg.Payload, &query)
+	if err != nil {
+		fail(gqlerrors.Errorf("bad subscription payload: %v", err))
+		return
+	}
+
+	/*
+	 * graphql-go's Subscribe executes queries and mutations too, but the
+	 * WebSocket does not set up a session, scheduler or user for them, nor
+	 * audit or admit them. Queries must go through /graphql.
+	 */
+	optype, err := operationType(query.Query, query.OperationName)
+	if err != nil {
+		fail(gqlerrors.Errorf("%v", err))
+		return
+	}
+	if optype != "subscription" {
+		fail(gqlerrors.Errorf(
+			"only subscriptions are served over WebSocket; was %s",
+			optype,
+		))
+		return
+	}
+
+	qctx := queryContext {
+		pid:     pid,
+		keyring: g.keyring,
+		watch:   g.watch,
+	}
+	c := setQueryContext(ctx, &qctx)
+	responses, err := g.schema.Subscribe(
+		c,
+		query.Query,
+		query.OperationName,
+		query.Variables,
+	)
+	if err != nil {
+		zap.L().Error("subscribe failed", logging.Pid(pid), zap.Error(err))
+		return
+	}
+	for response := range responses {
+		send(response.(*graphql.Response))
+	}
+	if ctx.Err() == nil {
+		write(wsMessage { ID: msg.ID, Type: "complete" })
+	}
+}
+
+/*
+ * The type (query, mutation or subscription) of the operation in the graphql
+ * document that would be executed, i.e. the one named by operationName, or
+ * the only operation in the document if operationName is empty.
+ *
+ * This only scans the document for the top-level definitions, and does not
+ * validate it. That is left to the schema.
+ */
+func operationType(document, operationName string) (string, error) {
+	type operation struct {
+		optype string
+		name   string
+	}
+	operations := []operation {}
+	isop := func(keyword string) bool {
+		return keyword == "query" ||
+		       keyword == "mutation" ||
+		       keyword == "subscription"
+	}
+
+	depth := 0
+	doc   := document
+	/*
+	 * The keyword of the top-level definition whose header is being read, and
+	 * whether its name has been read. The header ends with the selection set.
+	 */
+	keyword := ""
+	named   := false
+	for len(doc) > 0 {
+		c := doc[0]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			doc = doc[1:]
+
+		case c == '#':
+			end := strings.IndexAny(doc, "\r\n")
+			if end == -1 {
+				end = len(doc)
+			}
+			doc = doc[end:]
+
+		case strings.HasPrefix(doc, `"""`):
+			doc = doc[3:]
+			for {
+				end := strings.Index(doc, `"""`)
+				if end == -1 {
+					return "", fmt.Errorf("unterminated block string")
+				}
+				escaped := end > 0 && doc[end - 1] == '\\'
+				doc = doc[end + 3:]
+				if !escaped {
+					break
+				}
+			}
+
+		case c == '"':
+			doc = doc[1:]
+			for {
+				end := strings.IndexAny(doc, `"\`)
+				if end == -1 {
+					return "", fmt.Errorf("unterminated string")
+				}
+				if doc[end] == '"' {
+					doc = doc[end + 1:]
+					break
+				}
+				if end + 2 > len(doc) {
+					return "", fmt.Errorf("unterminated string")
+				}
+				doc = doc[end + 2:]
+			}
+
+		case c == '{' || c == '(' || c == '[':
+			if depth == 0 && c == '{' {
+				if keyword == "" {
+					// The query shorthand, { ... }
+					operations = append(operations, operation { optype: "query" })
+				}
+				keyword = ""
+			}
+			depth++
+			doc = doc[1:]
+
+		case c == '}' || c == ')' || c == ']':
+			depth--
+			if depth < 0 {
+				return "", fmt.Errorf("unbalanced %c", c)
+			}
+			doc = doc[1:]
+
+		case c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z'):
+			end := 1
+			for end < len(doc) {
+				c := doc[end]
+				if c != '_' &&
+				   !('a' <= c && c <= 'z') &&
+				   !('A' <= c && c <= 'Z') &&
+				   !('0' <= c && c <= '9') {
+					break
+				}
+				end++
+			}
+			name := doc[:end]
+			doc   = doc[end:]
+			if depth > 0 {
+				continue
+			}
+
+			switch {
+			case keyword == "":
+				keyword = name
+				named   = false
+				if isop(name) {
+					operations = append(operations, operation { optype: name })
+				}
+			case !named:
+				named = true
+				if isop(keyword) {
+					operations[len(operations) - 1].name = name
+				}
+			}
+
+		default:
+			doc = doc[1:]
+		}
+	}
+
+	if operationName == "" {
+		if len(operations) != 1 {
+			return "", fmt.Errorf(
+				"operationName is required with %d operations",
+				len(operations),
+			)
+		}
+		return operations[0].optype, nil
+	}
+	for _, op := range operations {
+		if op.name == operationName {
+			return op.optype, nil
+		}
+	}
+	return "", fmt.Errorf("no operation named %s", operationName)
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+const processSubscription = `
+subscription($pid: ID!, $key: String!) {
+    process(pid: $pid, key: $key) { status progress }
+}`
+
+/*
+ * Start a query service with subscriptions, and connect to it with the
+ * WebSocket sub-protocol
+ */
+func subscriptionConn(
+	t        *testing.T,
+	protocol string,
+) (*websocket.Conn, queue.Results, *auth.Keyring) {
+	keyring := auth.MakeKeyring([]byte("psk"))
+	results := queue.NewMemoryResults(queue.DefaultTTL)
+	g := MakeGraphQL(&keyring, "", nil)
+	g.SetResults(results)
+
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.GET("/graphql", g.Get)
+	srv := httptest.NewServer(app)
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer { Subprotocols: []string { protocol } }
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/graphql"
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	assert.Equal(t, protocol, conn.Subprotocol())
+	return conn, results, &keyring
+}
+
+func subscribeProcess(t *testing.T, conn *websocket.Conn, start, pid, key string) {
+	payload, err := json.Marshal(map[string]interface{} {
+		"query": processSubscription,
+		"variables": map[string]string { "pid": pid, "key": key },
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.WriteJSON(wsMessage { Type: "connection_init" }))
+	assert.NoError(t, conn.WriteJSON(wsMessage {
+		ID:      "1",
+		Type:    start,
+		Payload: payload,
+	}))
+}
+
+/*
+ * Read the messages of the subscription until it completes
+ */
+func readSubscription(t *testing.T, conn *websocket.Conn) []wsMessage {
+	messages := []wsMessage{}
+	for {
+		var msg wsMessage
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if msg.Type == "connection_ack" || msg.Type == "ka" {
+			continue
+		}
+		messages = append(messages, msg)
+		if msg.Type == "complete" {
+			return messages
+		}
+	}
+}
+
+func TestSubscriptionFollowsProcess(t *testing.T) {
+	ctx := context.Background()
+	conn, results, keyring := subscriptionConn(t, "graphql-transport-ws")
+	results.SetHeader(ctx, "pid", processHeader(t, 2), 0)
+	results.Append(ctx, "pid", queue.Part { Name: "0/2", Body: []byte("a") })
+	go func() {
+		results.Append(ctx, "pid", queue.Part { Name: "1/2", Body: []byte("b") })
+	}()
+
+	key, err := keyring.Sign("pid", queue.DefaultTTL)
+	assert.NoError(t, err)
+	subscribeProcess(t, conn, "subscribe", "pid", key)
+	messages := readSubscription(t, conn)
+
+	last := messages[len(messages) - 2]
+	assert.Equal(t, "next", last.Type)
+	assert.JSONEq(
+		t,
+		`{"data":{"process":{"status":"finished","progress":"2/2"}}}`,
+		string(last.Payload),
+	)
+}
+
+func TestSubscriptionWithLegacyProtocol(t *testing.T) {
+	ctx := context.Background()
+	conn, results, keyring := subscriptionConn(t, "graphql-ws")
+	results.SetHeader(ctx, "pid", processHeader(t, 1), 0)
+	results.Append(ctx, "pid", queue.Part { Name: "0/1", Body: []byte("a") })
+
+	key, err := keyring.Sign("pid", queue.DefaultTTL)
+	assert.NoError(t, err)
+	subscribeProcess(t, conn, "start", "pid", key)
+	messages := readSubscription(t, conn)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "data", messages[0].Type)
+	assert.Contains(t, string(messages[0].Payload), `"finished"`)
+}
+
+func TestSubscriptionRequiresKeyOfProcess(t *testing.T) {
+	conn, _, keyring := subscriptionConn(t, "graphql-transport-ws")
+	key, err := keyring.Sign("other", queue.DefaultTTL)
+	assert.NoError(t, err)
+	subscribeProcess(t, conn, "subscribe", "pid", key)
+	messages := readSubscription(t, conn)
+	assert.Len(t, messages, 2)
+	assert.Contains(t, string(messages[0].Payload), `"errors"`)
+	assert.NotContains(t, string(messages[0].Payload), `"status"`)
+}
+
+func TestSubscriptionRejectsQuery(t *testing.T) {
+	conn, _, _ := subscriptionConn(t, "graphql-transport-ws")
+	payload, err := json.Marshal(map[string]interface{} {
+		"query": `{ cube(id: "guid") { linenumbers } }`,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.WriteJSON(wsMessage { Type: "connection_init" }))
+	assert.NoError(t, conn.WriteJSON(wsMessage {
+		ID:      "1",
+		Type:    "subscribe",
+		Payload: payload,
+	}))
+	messages := readSubscription(t, conn)
+	assert.Len(t, messages, 2)
+	assert.Contains(t, string(messages[0].Payload), "only subscriptions")
+	assert.NotContains(t, string(messages[0].Payload), `"data"`)
+}
+
+func TestOperationType(t *testing.T) {
+	cases := []struct {
+		document string
+		opname   string
+		optype   string
+	}{
+		{ `{ cube(id: "x") { linenumbers } }`,            "",  "query"        },
+		{ `query { cube(id: "{") { linenumbers } }`,      "",  "query"        },
+		{ `mutation M { x }`,                             "",  "mutation"     },
+		{ processSubscription,                            "",  "subscription" },
+		{ `# subscription
+		   query Q($s: String = "subscription") { x }`,   "",  "query"        },
+		{ `fragment F on Cube { x }
+		   subscription S { process { status } }`,        "",  "subscription" },
+		{ `query Q { x } subscription S { x }`,           "Q", "query"        },
+		{ `query Q { x } subscription S { x }`,           "S", "subscription" },
+		{ `""" description { """ subscription { x }`,     "",  "subscription" },
+	}
+	for _, c := range cases {
+		optype, err := operationType(c.document, c.opname)
+		assert.NoError(t, err, c.document)
+		assert.Equal(t, c.optype, optype, c.document)
+	}
+
+	_, err := operationType(`query Q { x } subscription S { x }`, "")
+	assert.Error(t, err)
+	_, err = operationType(`query Q { x }`, "S")
+	assert.Error(t, err)
+	_, err = operationType(`query Q { x } }`, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"time"
+)
+
+/*
+ * Task sizing, i.e. how many fragments go into a single task.
+ *
+ * Small tasks spread a query over more fetch workers, which lowers the latency
+ * of small queries. The cost is overhead per task, on the queue and in the
+ * workers, which adds up for large queries. The task size is therefore chosen
+ * per query:
+ *
+ * - the fragments are spread evenly over all the fetch workers, so that even
+ *   small queries use all of them
+ * - a task should take no longer than the target latency, which caps the task
+ *   size at TargetLatency / FragmentLatency fragments. Queries that hit the cap
+ *   have more tasks than workers, and bigger tasks would not make them faster
+ *
+ * A query of 20 fragments with 16 workers gets tasks of 2 fragments, whereas a
+ * query of 20000 fragments gets tasks of (by default) 100 fragments.
+ */
+type TaskSizer struct {
+	/*
+	 * Use this task size for all queries. Zero or less chooses the size per
+	 * query.
+	 */
+	Fixed           int
+	/*
+	 * The number of tasks the fetch workers process concurrently, i.e.
+	 * workers * jobs per worker.
+	 */
+	Workers         int
+	/*
+	 * The target latency of a single task
+	 */
+	TargetLatency   time.Duration
+	/*
+	 * The (estimated) time a worker spends per fragment in a task
+	 */
+	FragmentLatency time.Duration
+}
+
+func DefaultTaskSizer() TaskSizer {
+	return TaskSizer {
+		Workers:         16,
+		TargetLatency:   1 * time.Second,
+		FragmentLatency: 10 * time.Millisecond,
+	}
+}
+
+/*
+ * The largest task size that meets the target latency, and at least 1.
+ */
+func (s TaskSizer) max() int {
+	if s.FragmentLatency <= 0 {
+		return 1
+	}
+	max := int(s.TargetLatency / s.FragmentLatency)
+	if max < 1 {
+		return 1
+	}
+	return max
+}
+
+/*
+ * The task size for a query of nfragments fragments.
+ */
+func (s TaskSizer) size(nfragments int) int {
+	if s.Fixed > 0 {
+		return s.Fixed
+	}
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	size := (nfragments + workers - 1) / workers
+	if max := s.max(); size > max {
+		size = max
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTaskSizeSpreadsSmallQueriesOverWorkers(t *testing.T) {
+	sizer := TaskSizer {
+		Workers:         16,
+		TargetLatency:   1 * time.Second,
+		FragmentLatency: 10 * time.Millisecond,
+	}
+	cases := []struct {
+		nfragments int
+		size       int
+	} {
+		{     1,   1 },
+		{    16,   1 },
+		{    20,   2 },
+		{   160,  10 },
+		{  1600, 100 },
+		{ 20000, 100 },
+	}
+	for _, c := range cases {
+		size := sizer.size(c.nfragments)
+		if size != c.size {
+			t.Errorf(
+				"expected size = %d for %d fragments; got %d",
+				c.size,
+				c.nfragments,
+				size,
+			)
+		}
+	}
+}
+
+func TestTaskSizeFixed(t *testing.T) {
+	sizer := DefaultTaskSizer()
+	sizer.Fixed = 10
+	for _, nfragments := range []int { 1, 100, 10000 } {
+		if size := sizer.size(nfragments); size != 10 {
+			t.Errorf("expected fixed size = 10; got %d", size)
+		}
+	}
+}
+
+func TestTaskSizeIsAtLeastOne(t *testing.T) {
+	sizers := []TaskSizer {
+		{},
+		{ Workers: 4, TargetLatency: time.Millisecond, FragmentLatency: time.Second },
+	}
+	for _, sizer := range sizers {
+		if size := sizer.size(100); size < 1 {
+			t.Errorf("expected size >= 1 for %+v; got %d", sizer, size)
+		}
+	}
+}
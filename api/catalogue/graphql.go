@@ -3,12 +3,13 @@ package catalogue
 import (
 	"context"
 	_ "embed"
-	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	graphql "github.com/graph-gophers/graphql-go"
+	"go.uber.org/zap"
 
+	"github.com/equinor/oneseismic/api/internal/audit"
 	psql "github.com/equinor/oneseismic/api/internal/postgres"
 	"github.com/equinor/oneseismic/api/internal/util"
 )
@@ -60,7 +61,7 @@ func (g *gql) Post(ctx *gin.Context) {
 	body := util.GraphQLQuery {}
 	err := ctx.BindJSON(&body)
 	if err != nil {
-		log.Printf("%v", err)
+		zap.L().Warn("bad request body", zap.Error(err))
 		return
 	}
 
@@ -76,7 +77,12 @@ func (g *gql) execQuery(
 	}
 
 	c := context.WithValue(ctx, "queryctx", &qctx)
-	return g.schema.Exec(c, query.Query, query.OperationName, query.Variables)
+	response := g.schema.Exec(c, query.Query, query.OperationName, query.Variables)
+	record := audit.FromContext(ctx.Request.Context())
+	for _, err := range response.Errors {
+		record.AddError(err)
+	}
+	return response
 }
 
 type resolver struct {
@@ -1,87 +1,71 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/pborman/getopt/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v4/log/zapadapter"
 	"go.uber.org/zap"
 
 	"github.com/equinor/oneseismic/api/catalogue"
+	"github.com/equinor/oneseismic/api/internal/audit"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/health"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/metrics"
 	"github.com/equinor/oneseismic/api/internal/postgres"
+	"github.com/equinor/oneseismic/api/internal/server"
 )
 
 type opts struct {
-	authserver string
-	audience   string
-	connstring string
-	port       int
+	config.Server `yaml:",inline"`
+	AuthServer    string `yaml:"authserver"       env:"AUTHSERVER"       help:"OpenID Connect discovery server" required:"true"`
+	Audience      string `yaml:"audience"         env:"AUDIENCE"         help:"Application (client) ID" required:"true"`
+	ConnString    string `yaml:"connectionstring" env:"CONNECTIONSTRING" help:"Postgres DB connection string" required:"true" secret:"true"`
+	AuditLog      string `yaml:"audit-log"        env:"AUDIT_LOG"        help:"Audit log sink; stdout, stderr, a file path, or none. Defaults to stdout"`
 }
 
 func parseopts() opts {
-	help := getopt.BoolLong("help", 0, "help")
 	opts := opts {
-		authserver: os.Getenv("AUTHSERVER"),
-		audience:   os.Getenv("AUDIENCE"),
-		connstring: os.Getenv("CONNECTIONSTRING"),
-		port:       8080,
+		Server:   config.DefaultServer(),
+		AuditLog: "stdout",
 	}
-
-	getopt.FlagLong(
-		&opts.authserver,
-		"authserver",
-		0,
-		"OpenID Connect discovery server",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.audience,
-		"audience",
-		0,
-		"Application (client) ID",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.connstring,
-		"connectionstring",
-		0,
-		"Postgres DB connection string",
-		"string",
-	)
-
-	getopt.FlagLong(
-		&opts.port,
-		"port",
-		'p',
-		"Port to start server on. Defaults to 8080",
-		"int",
-	)
-
-	getopt.Parse()
-	if *help {
-		getopt.Usage()
-		os.Exit(0)
+	err := config.Load(&opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
-
 	return opts
 }
 
 func main() {
 	opts := parseopts()
 
-	logger, _ := zap.NewProduction()
+	logger, err := logging.Setup("oneseismic-catalogue")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set up logging: %v\n", err)
+		os.Exit(1)
+	}
 	defer logger.Sync()
+	logger.Info("configuration", zap.Any("config", config.Redacted(&opts)))
+
+	auditlog, err := audit.Open("oneseismic-catalogue", opts.AuditLog)
+	if err != nil {
+		logger.Fatal("unable to open audit log", zap.Error(err))
+	}
+	defer auditlog.Sync()
 
 	pool, err := postgres.MakeConnectionPool(
-		opts.connstring,
+		opts.ConnString,
 		zapadapter.NewLogger(logger),
 	)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("unable to connect to postgres", zap.Error(err))
 	}
 	defer pool.Close()
 
@@ -97,19 +81,43 @@ func main() {
 
 	gql := catalogue.MakeGraphQL(client)
 
-	provider := auth.GetJwksProvider(opts.authserver)
+	provider := auth.GetJwksProvider(opts.AuthServer)
 	tokenvalidator := auth.JWTvalidation(
-		opts.authserver,
-		opts.audience,
+		opts.AuthServer,
+		opts.Audience,
 		provider.KeyFunc,
 	)
 
-	app := gin.Default()
+	srv := server.New(fmt.Sprintf(":%d", opts.Port), opts.Drain)
+	probes := health.New()
+	probes.Add("postgres", health.PostgresAcquire(pool))
+	probes.ReadyWhen(srv.Ready)
+
+	app := gin.New()
+	app.Use(logging.Gin(logger), gin.Recovery())
+	/*
+	 * The probes and metrics are registered before the audit and token
+	 * validation middleware, since they are requested by the orchestrator and
+	 * not by users.
+	 */
+	probes.Register(app)
+	metrics.Register(app)
+	app.Use(audit.Middleware(auditlog))
 	app.Use(tokenvalidator)
 
 	graphql := app.Group("/graphql")
 	graphql.GET( "", gql.Get)
 	graphql.POST("", gql.Post)
 
-	app.Run(fmt.Sprintf(":%d", opts.port))
+	srv.Handler = app
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGTERM,
+		os.Interrupt,
+	)
+	defer stop()
+	err = srv.Run(ctx)
+	if err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
 }
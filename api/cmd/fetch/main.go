@@ -2,286 +2,173 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
-	"net/url"
-
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/equinor/oneseismic/api/fetch"
+	"github.com/equinor/oneseismic/api/internal/callback"
+	"github.com/equinor/oneseismic/api/internal/dedup"
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/health"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/metrics"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/quota"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/equinor/oneseismic/api/internal/util"
 
-	"github.com/go-redis/redis/v8"
-	"github.com/pborman/getopt/v2"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 )
 
 type opts struct {
-	redisURL          string
-	redisPassword     string
-	secureConnections bool
-	group             string
-	stream            string
-	consumerid        string
-	jobs              int
-	retries           int
+	config.Queue     `yaml:",inline"`
+	config.Retention `yaml:",inline"`
+	config.Quota     `yaml:",inline"`
+	config.Tracing   `yaml:",inline"`
+	config.Callback  `yaml:",inline"`
+	Group            string        `yaml:"group"            env:"GROUP"            short:"G" help:"Consumer group. All workers should belong to the same group for fair distribution of work. You should normally not need to change this."`
+	Stream           string        `yaml:"stream"           env:"STREAM"           short:"S" help:"Stream ID to read tasks from. Lower priority classes are read from <stream>-<class>, e.g. jobs-batch. Must be consistent with the producer. You should normally not need to change this."`
+	ConsumerID       string        `yaml:"consumer-id"      env:"CONSUMER_ID"      short:"C" help:"Consumer ID of this worker. This should be unique among all the workers in the consumer group. If no name is specified, a random ID will be generated. You should normally not need to specify a consumer ID."`
+	Jobs             int           `yaml:"jobs"             env:"JOBS"             short:"j" help:"Allow N concurrent connections at once. Defaults to 30"`
+	Retries          int           `yaml:"retries"          env:"RETRIES"          short:"r" help:"Max attempted retries when fetching from blobstore. Defaults to 0"`
+	Drain            time.Duration `yaml:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" help:"On shutdown, wait this long for in-flight tasks to complete before handing them back to the job queue. This should be shorter than the grace period given by the orchestrator (e.g. terminationGracePeriodSeconds). Defaults to 20s"`
+	ProbePort        int           `yaml:"probe-port"       env:"PROBE_PORT"       help:"Port to serve the /healthz and /readyz probes, and /metrics on. Defaults to 8080"`
 }
 
 func parseopts() opts {
-	help := getopt.BoolLong("help", 0, "print this help text")
-	opts := opts{
-		redisURL:      os.Getenv("REDIS_URL"),
-		redisPassword: os.Getenv("REDIS_PASSWORD"),
-		group:         "fetch",
-		stream:        "jobs",
+	opts := opts {
+		Tracing:   config.DefaultTracing(),
+		Quota:     config.DefaultQuota(),
+		Retention: config.DefaultRetention(),
+		Group:     "fetch",
+		Stream:    "jobs",
+		Jobs:      30,
+		Drain:     20 * time.Second,
+		ProbePort: 8080,
 	}
-	getopt.FlagLong(
-		&opts.redisURL,
-		"redis-url",
-		0,
-		"Redis URL (host:port)",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.redisPassword,
-		"redis-password",
-		0,
-		"Redis password. Empty by default",
-		"string",
-	)
-	secureConnections := getopt.BoolLong(
-		"secureConnections",
-		0,
-		"Connect to Redis securely",
-	)
-	getopt.FlagLong(
-		&opts.group,
-		"group",
-		'G',
-		"Consumer group. " +
-		    "All workers should belong to the same group for " +
-		    "fair distribution of work. " +
-		    "You should normally not need to change this.",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.stream,
-		"stream",
-		'S',
-		"Stream ID to read tasks from. Must be consistent with the producer. " +
-		    "You should normally not need to change this.",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.consumerid,
-		"consumer-id",
-		'C',
-		"Consumer ID of this worker. This should be unique among all the " +
-			"workers in the consumer group. If no name is specified, " +
-			"a random ID will be generated. You should normally not need " +
-			"to specify a consumer ID.",
-		"string",
-	)
-	jobs := getopt.IntLong(
-		"jobs",
-		'j',
-		30,
-		"Allow N concurrent connections at once. Defaults to 30",
-		"int",
-	)
-	retries := getopt.IntLong(
-		"retries",
-		'r',
-		0,
-		"Max attempted retries when fetching from blobstore. Defaults to 0",
-		"int",
-	)
-	getopt.Parse()
-
-	if *help {
-		getopt.Usage()
-		os.Exit(0)
+	err := config.Load(&opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
 
-	if opts.consumerid == "" {
-		opts.consumerid = fmt.Sprintf("consumer:%s", util.MakePID())
+	if opts.ConsumerID == "" {
+		opts.ConsumerID = fmt.Sprintf("consumer:%s", util.MakePID())
 	}
-	opts.jobs = *jobs
-	opts.retries = *retries
-	opts.secureConnections = *secureConnections
-
 	return opts
 }
 
-func run(
-	storage redis.Cmdable,
-	fetch   *fetch,
-	retries int,
-	process map[string]interface{},
-) {
-	/*
-	 * Curiously, the XReadGroup/XStream values end up being map[string]string
-	 * effectively. This is detail of the go library where it uses ReadLine()
-	 * internally - redis uses byte strings as strings anyway.
-	 *
-	 * The type assertion is not checked and will panic. This is a good thing
-	 * as it should only happen when the redis library is updated to no longer
-	 * return strings, and crash oneseismic properly. This should catch such a
-	 * change early.
-	 */
-	pid  := process["pid" ].(string)
-	part := process["part"].(string)
-	body := process["task"].(string)
-	msg  := [][]byte{ []byte(pid), []byte(part), []byte(body) }
-	proc, err := exec(msg)
+func serveProbes(probes *health.Checker, port int) {
+	gin.SetMode(gin.ReleaseMode)
+	app := gin.New()
+	app.Use(gin.Recovery())
+	probes.Register(app)
+	metrics.Register(app)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), app)
 	if err != nil {
-		log.Printf("%s dropping bad process %v", proc.logpid(), err)
-		return
+		zap.L().Fatal("unable to serve probes", zap.Error(err))
 	}
-	/*
-	 * Build the container-URL early, in case it should be broken,
-	 * so that no goroutines are scheduled before any sanity
-	 * checking of input.
-	 */
-	container, err := proc.container()
-	if err != nil {
-		log.Printf("%s dropping bad process %v", proc.logpid(), err)
-		return
-	}
-
-	fragments := proc.fragments()
-	blobs := make([]*url.URL, len(fragments))
-	for i, id := range fragments {
-		blob, err := proc.blob(container, id)
-		if err != nil {
-			log.Printf("%s dropping bad process %v", proc.logpid(), err)
-			return
-		}
-		blobs[i] = blob
-	}
-
-	fq := fetch.mkqueue()
-	go proc.gather(storage, len(fragments), fq)
-	fetch.enqueue(proc.ctx, fq, blobs)
 }
 
 func main() {
 	opts := parseopts()
-
-	redisOptions := &redis.Options{
-		Addr:     opts.redisURL,
-		Password: opts.redisPassword,
-		DB:       0,
+	logger, err := logging.Setup("oneseismic-fetch")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set up logging: %v\n", err)
+		os.Exit(1)
 	}
-
-	if opts.secureConnections {
-		redisOptions.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		}
+	defer logger.Sync()
+	logger = logger.With(logging.Consumer(opts.ConsumerID))
+	logger.Info("configuration", zap.Any("config", config.Redacted(&opts)))
+	zap.ReplaceGlobals(logger)
+
+	shutdownTracing, err := tracing.Setup(
+		context.Background(),
+		"oneseismic-fetch",
+		opts.Exporter,
+		opts.OtlpEndpoint,
+	)
+	if err != nil {
+		zap.L().Fatal("unable to set up tracing", zap.Error(err))
 	}
-	storage := redis.NewClient(redisOptions)
-	// TODO: err?
-	defer storage.Close()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+
+	conn, err := queue.Open(
+		opts.Queue,
+		opts.Stream,
+		opts.Group,
+		opts.Retention.Duration,
+	)
+	if err != nil {
+		zap.L().Fatal("unable to connect to queue", zap.Error(err))
+	}
+	defer conn.Close()
 
-	ctx := context.Background()
 	/*
-	 * Always try to create the group and stream on start-up. The stream may
-	 * have already been created, but that is a soft error to be discarded. In
-	 * fact, the stream and group *probably* exists already because nodes
-	 * connect in parallel.
-	 *
-	 * The XGroupCreate command is really just a try-create and fits well here,
-	 * it offloads all the concurrency issues to redis. Consequently, this
-	 * program can immediately go into the work loop assuming that the stream
-	 * and group exists, without having to do any chatter or sync.
+	 * The shutdown context is cancelled on SIGTERM (e.g. from kubernetes on
+	 * rollouts and scale-downs) or SIGINT, and signals that the worker should
+	 * stop reading new tasks.
 	 */
-	err := storage.XGroupCreateMkStream(ctx, opts.stream, opts.group, "0").Err()
+	ctx := context.Background()
+	shutdown, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	err = conn.Jobs.CreateGroup(ctx)
 	if err != nil {
-		 // Check if the response is a redis error (= BUSYGROUP), which just
-		 // means the group already exists and nothing happens, or if it is a
-		 // network error or something
-		_, busygroup := err.(interface{RedisError()});
-		if !busygroup {
-			log.Fatalf(
-				"Unable to create group %s for stream %s: %v",
-				opts.group,
-				opts.stream,
-				err,
-			)
-		}
+		zap.L().Fatal(
+			"unable to create group",
+			zap.String("group", opts.Group),
+			zap.String("stream", opts.Stream),
+			zap.Error(err),
+		)
 	}
-	log.Printf(
-		"consumer %s in group %s connecting to stream %s",
-		opts.consumerid,
-		opts.group,
-		opts.stream,
+	zap.L().Info(
+		"connecting to stream",
+		zap.String("group", opts.Group),
+		zap.String("stream", opts.Stream),
 	)
 
-	// TODO: destroy consumers on shutdown
-	// All reads can re-use the same group-args
-	// NoAck is turned on - we can afford to fail requests and lose messages
-	// should a node crash.
-	args := redis.XReadGroupArgs {
-		Group:    opts.group,
-		Consumer: opts.consumerid,
-		Streams:  []string { opts.stream, ">", },
-		Count:    1,
-		NoAck:    true,
+	/*
+	 * The worker has no HTTP interface, but a small listener for the
+	 * orchestrator probes and metrics. The worker is ready for as long as it
+	 * reads new tasks.
+	 */
+	probes := health.New()
+	probes.Add(conn.Backend, conn.Ping)
+	probes.ReadyWhen(func() bool { return shutdown.Err() == nil })
+	go serveProbes(probes, opts.ProbePort)
+
+	worker := fetch.NewWorker(
+		conn.Jobs,
+		conn.Results,
+		opts.ConsumerID,
+		opts.Jobs,
+	)
+	quotas, err := quota.Open(opts.Quota, conn, opts.Retention.Duration)
+	if err != nil {
+		zap.L().Fatal("unable to set up quotas", zap.Error(err))
 	}
-
-	fetch := newFetch(opts.jobs)
-	fetch.startWorkers()
-
-	for {
-		msgs, err := storage.XReadGroup(ctx, &args).Result()
-		if err != nil {
-			log.Fatalf("Unable to read from redis: %v", err)
-		}
-
-		go func() {
-			/*
-			 * Send a request-for-delete once the message has been read, in
-			 * order to stop the infinite growth of the job queue.
-			 *
-			 * This is the simplest solution that is correct [1] - the node
-			 * that gets a job also deletes it, which emulates a
-			 * fire-and-forget job queue. Unfortunately it also means more
-			 * traffic back to the central job queue node. In redis6.2 the
-			 * XTRIM MINID strategy is introduced, which opens up some
-			 * interesting strategies for cleaning up the job queue. This is
-			 * work for later though.
-			 *
-			 * [1] except in some crashing scenarios
-			 */
-			ids := make([]string, 0, 3)
-			for _, xmsg := range msgs {
-				for _, msg := range xmsg.Messages {
-					ids = append(ids, msg.ID)
-				}
-			}
-			err := storage.XDel(ctx, opts.stream, ids...).Err()
-			if err != nil {
-				log.Fatalf("Unable to XDEL: %v", err)
-			}
-		}()
-
-		/*
-		 * The redis interface is designed for asking for a set of messages per
-		 * XReadGroup command, but we really only ask for one [1]. The redis-go
-		 * API is is aware of this which means the message structure must be
-		 * unpacked with nested loops. As a consequence, the read-count can
-		 * be increased with little code change, but it also means more nested
-		 * loops.
-		 *
-		 * For ease of understanding, the loops can be ignored.
-		 *
-		 * [1] Instead opting for multiple fragments to download per message.
-		 *     This is a design decision from before redis streams, but it
-		 *     works well with redis streams too.
-		 */
-		for _, xmsg := range msgs {
-			for _, message := range xmsg.Messages {
-				// TODO: graceful shutdown and/or cancellation
-				run(storage, fetch, opts.retries, message.Values)
-			}
-		}
+	worker.SetQuotas(quotas)
+	worker.SetCallbacks(callback.Open(opts.Callback))
+	/*
+	 * Only the redis store is shared with query, and with other backends
+	 * there is nothing for fetch to forget.
+	 */
+	if conn.Redis != nil {
+		worker.SetDedup(dedup.NewRedisStore(conn.Redis))
+	}
+	err = worker.Run(shutdown, opts.Drain)
+	if err != nil {
+		zap.L().Fatal("unable to read from queue", zap.Error(err))
 	}
+	zap.L().Info("shut down")
 }
@@ -2,89 +2,37 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"os"
 	"time"
-	"crypto/tls"
 
-	"github.com/go-redis/redis/v8"
-	"github.com/pborman/getopt/v2"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/redisclient"
 )
 
 type opts struct {
-	redisURL          string
-	redisPassword     string
-	secureConnections bool
-	stream            string
-	group             string
-	threshold         time.Duration
-	dryrun            bool
+	config.Redis `yaml:",inline"`
+	Stream       string        `yaml:"stream"    env:"STREAM"    short:"S" help:"Stream to garbage collect, together with the streams of its lower priority classes, e.g. jobs-batch"`
+	Group        string        `yaml:"group"     env:"GROUP"     short:"G" help:"Consumer group to garbage collect"`
+	Threshold    time.Duration `yaml:"threshold" env:"THRESHOLD" short:"t" help:"Idle duration before consumer is a candidate for garbage collection"`
+	DryRun       bool          `yaml:"dry-run"   env:"DRY_RUN"   short:"n" help:"Do not actually remove anything, just show what would be done"`
 }
 
 func parseopts() opts {
-	help := getopt.BoolLong("help", 0, "print this help text")
 	opts := opts {
-		stream: "jobs",
-		group:  "fetch",
-		threshold: 30 * time.Minute,
-		redisURL:      os.Getenv("REDIS_URL"),
-		redisPassword: os.Getenv("REDIS_PASSWORD"),
+		Stream:    "jobs",
+		Group:     "fetch",
+		Threshold: 30 * time.Minute,
 	}
-
-	getopt.FlagLong(
-		&opts.redisURL,
-		"redis-url",
-		0,
-		"Redis URL (host:port)",
-		"string",
-	).Mandatory()
-	getopt.FlagLong(
-		&opts.redisPassword,
-		"redis-password",
-		'P',
-		"Redis password. Empty by default",
-		"string",
-	)
-	secureConnections := getopt.BoolLong(
-		"secureConnections",
-		0,
-		"Connect to Redis securely",
-	)
-	getopt.FlagLong(
-		&opts.stream,
-		"stream",
-		'S',
-		"Stream to garbage collect",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.group,
-		"group",
-		'G',
-		"Consumer group to garbage collect",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.threshold,
-		"threshold",
-		't',
-		"Idle duration before consumer is a candidate for garbage collection",
-		"int",
-	)
-	getopt.FlagLong(
-		&opts.dryrun,
-		"dry-run",
-		'n',
-		"Do not actually remove anything, just show what would be done",
-	).SetFlag()
-	getopt.Parse()
-
-	if *help {
-		getopt.Usage()
-		os.Exit(0)
+	err := config.Load(&opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
-
-	opts.secureConnections = *secureConnections
 	return opts
 }
 
@@ -104,58 +52,68 @@ func parseopts() opts {
  */
 func main() {
 	opts := parseopts()
-
-	redisOptions := &redis.Options{
-		Addr:     opts.redisURL,
-		Password: opts.redisPassword,
+	logger, err := logging.Setup("oneseismic-gc")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set up logging: %v\n", err)
+		os.Exit(1)
 	}
+	defer logger.Sync()
+	logger.Info("configuration", zap.Any("config", config.Redacted(&opts)))
 
-	if opts.secureConnections {
-		redisOptions.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		}
+	storage, err := redisclient.New(opts.Redis)
+	if err != nil {
+		logger.Fatal("unable to connect to redis", zap.Error(err))
 	}
-
-	storage := redis.NewClient(redisOptions)
 	defer storage.Close()
 	ctx := context.Background()
 
-	cmd := storage.XInfoConsumers(ctx, opts.stream, opts.group)
-	consumers, err := cmd.Result()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	garbage := []string{}
-	for _, consumer := range consumers {
-		if consumer.Idle > opts.threshold.Milliseconds() {
-			garbage = append(garbage, consumer.Name)
+	/*
+	 * Every priority class is a stream of its own, with its own consumers.
+	 */
+	for _, p := range queue.Priorities {
+		stream := queue.PriorityStream(opts.Stream, p)
+		cmd := storage.XInfoConsumers(ctx, stream, opts.Group)
+		consumers, err := cmd.Result()
+		if err != nil {
+			logger.Fatal("unable to list consumers", zap.Error(err))
 		}
-	}
 
-	for _, id := range garbage {
-		log.Printf(
-			"Removing consumer %s from group %s in stream %s",
-			id,
-			opts.group,
-			opts.stream,
-		)
-		if opts.dryrun {
-			continue
+		garbage := []string{}
+		for _, consumer := range consumers {
+			if consumer.Idle > opts.Threshold.Milliseconds() {
+				garbage = append(garbage, consumer.Name)
+			}
 		}
-		/*
-		 * The consumer could be idle both from being abandoned (e.g. the node
-		 * scaled down or restarted) and there just not being any work, but if
-		 * the node is still alive then the consumer will be re-iniated on the
-		 * next available job and nothing will be lost. This is ok because jobs
-		 * are fetched with NoAck so there are no pending-but-not-acked
-		 * messages. This has been tested manually to work well, but I have not
-		 * found a good reference with guarantees from redis, so this *might*
-		 * come to bite us later.
-		 */
-		err := storage.XGroupDelConsumer(ctx, opts.stream, opts.group, id).Err()
-		if err != nil {
-			log.Fatalf("Could not delete consumer %s; %v", id, err)
+
+		for _, id := range garbage {
+			logger.Info(
+				"removing consumer",
+				logging.Consumer(id),
+				zap.String("group", opts.Group),
+				zap.String("stream", stream),
+				zap.Bool("dry-run", opts.DryRun),
+			)
+			if opts.DryRun {
+				continue
+			}
+			/*
+			 * The consumer could be idle both from being abandoned (e.g. the node
+			 * scaled down or restarted) and there just not being any work, but if
+			 * the node is still alive then the consumer will be re-iniated on the
+			 * next available job and nothing will be lost. This is ok because jobs
+			 * are fetched with NoAck so there are no pending-but-not-acked
+			 * messages. This has been tested manually to work well, but I have not
+			 * found a good reference with guarantees from redis, so this *might*
+			 * come to bite us later.
+			 */
+			err := storage.XGroupDelConsumer(ctx, stream, opts.Group, id).Err()
+			if err != nil {
+				logger.Fatal(
+					"could not delete consumer",
+					logging.Consumer(id),
+					zap.Error(err),
+				)
+			}
 		}
 	}
 }
@@ -1,94 +1,76 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/equinor/oneseismic/api/api"
+	"github.com/equinor/oneseismic/api/internal/audit"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/callback"
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/dedup"
+	"github.com/equinor/oneseismic/api/internal/health"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/metrics"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/quota"
+	"github.com/equinor/oneseismic/api/internal/server"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/equinor/oneseismic/api/internal/util"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
-	"github.com/pborman/getopt/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
 type opts struct {
-	clientID          string
-	storageURL        string
-	redisURL          string
-	redisPassword     string
-	secureConnections bool
-	signkey           string
-	port              string
+	config.Queue     `yaml:",inline"`
+	config.Retention `yaml:",inline"`
+	config.Quota     `yaml:",inline"`
+	config.Server    `yaml:",inline"`
+	config.Tracing   `yaml:",inline"`
+	config.Callback  `yaml:",inline"`
+	ClientID         string        `yaml:"client-id"            env:"CLIENT_ID"            help:"Client ID for on-behalf tokens"`
+	AuthServer       string        `yaml:"authserver"           env:"AUTHSERVER"           help:"OpenID Connect discovery server, to verify users against. Quotas are only applied to verified users"`
+	Audience         string        `yaml:"audience"             env:"AUDIENCE"             help:"Audience of the bearer tokens. Defaults to the client-id"`
+	StorageURL       string        `yaml:"storage-url"          env:"STORAGE_URL"          help:"Storage URL, e.g. https://<account>.blob.core.windows.net" required:"true"`
+	SignKey          string        `yaml:"sign-key"             env:"SIGN_KEY"             help:"Signing key used for response authorization tokens" required:"true" secret:"true"`
+	CheckStorage     bool          `yaml:"health-check-storage" env:"HEALTH_CHECK_STORAGE" help:"Include storage account reachability in the health checks"`
+	AuditLog         string        `yaml:"audit-log"            env:"AUDIT_LOG"            help:"Audit log sink; stdout, stderr, a file path, or none. Defaults to stdout"`
+	BatchThreshold   int           `yaml:"batch-threshold"      env:"BATCH_THRESHOLD"      help:"Schedule queries with more tasks than this as batch, unless the query asks for a priority. 0 disables. Defaults to 25"`
+	MaxQueueDepth    int           `yaml:"max-queue-depth"      env:"MAX_QUEUE_DEPTH"      help:"Reject queries with BUSY when the job queue (of the query's priority) would have more tasks than this. 0 is unlimited"`
+	MaxQueueWait     time.Duration `yaml:"max-queue-wait"       env:"MAX_QUEUE_WAIT"       help:"Reject queries with BUSY when the oldest task in the job queue (of the query's priority) has waited longer than this. 0 is unlimited"`
+	TaskSize         int           `yaml:"task-size"            env:"TASK_SIZE"            help:"Fragments per task for all queries. 0 (default) chooses the task size per query"`
+	FetchWorkers     int           `yaml:"fetch-workers"        env:"FETCH_WORKERS"        help:"The number of tasks the fetch workers process concurrently, which small queries are spread over. Defaults to 16"`
+	TargetLatency    time.Duration `yaml:"target-latency"       env:"TARGET_LATENCY"       help:"Target latency of a single task, which caps the task size. Defaults to 1s"`
+	FragmentLatency  time.Duration `yaml:"fragment-latency"     env:"FRAGMENT_LATENCY"     help:"Estimated time to fetch and process a fragment. Defaults to 10ms"`
+	Dedup            bool          `yaml:"dedup"                env:"DEDUP"                help:"Give identical queries of the same version of a cube the process (and result) of the first, while it is kept. Defaults to true"`
 }
 
 func parseopts() opts {
-	help := getopt.BoolLong("help", 0, "print this help text")
-	opts := opts{
-		clientID:      os.Getenv("CLIENT_ID"),
-		storageURL:    os.Getenv("STORAGE_URL"),
-		redisURL:      os.Getenv("REDIS_URL"),
-		redisPassword: os.Getenv("REDIS_PASSWORD"),
-		signkey:       os.Getenv("SIGN_KEY"),
+	sizer := api.DefaultTaskSizer()
+	opts  := opts {
+		Server:          config.DefaultServer(),
+		Tracing:         config.DefaultTracing(),
+		Quota:           config.DefaultQuota(),
+		Retention:       config.DefaultRetention(),
+		AuditLog:        "stdout",
+		BatchThreshold:  api.DefaultBatchThreshold,
+		FetchWorkers:    sizer.Workers,
+		TargetLatency:   sizer.TargetLatency,
+		FragmentLatency: sizer.FragmentLatency,
+		Dedup:           true,
 	}
-
-	getopt.FlagLong(
-		&opts.clientID,
-		"client-id",
-		0,
-		"Client ID for on-behalf tokens",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.storageURL,
-		"storage-url",
-		0,
-		"Storage URL, e.g. https://<account>.blob.core.windows.net",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.redisURL,
-		"redis-url",
-		0,
-		"Redis URL (host:port)",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.redisPassword,
-		"redis-password",
-		0,
-		"Redis password. Empty by default",
-		"int",
-	)
-	secureConnections := getopt.BoolLong(
-		"secureConnections",
-		0,
-		"Connect to Redis securely",
-	)
-	getopt.FlagLong(
-		&opts.signkey,
-		"sign-key",
-		0,
-		"Signing key used for response authorization tokens",
-		"string",
-	)
-	opts.port = "8080"
-	getopt.FlagLong(
-		&opts.port,
-		"port",
-		0,
-		"Port to start server on. Defaults to 8080",
-	)
-
-	getopt.Parse()
-	if *help {
-		getopt.Usage()
-		os.Exit(0)
+	err := config.Load(&opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
-
-	opts.secureConnections = *secureConnections
 	return opts
 }
 
@@ -138,39 +120,141 @@ func (c *clientconfig) Get(ctx *gin.Context) {
 
 func main() {
 	opts := parseopts()
+	logger, err := logging.Setup("oneseismic-query")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set up logging: %v\n", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+	logger.Info("configuration", zap.Any("config", config.Redacted(&opts)))
 
-	keyring := auth.MakeKeyring([]byte(opts.signkey))
-	redisOptions := &redis.Options{
-		Addr:     opts.redisURL,
-		Password: opts.redisPassword,
-		DB:       0,
+	auditlog, err := audit.Open("oneseismic-query", opts.AuditLog)
+	if err != nil {
+		logger.Fatal("unable to open audit log", zap.Error(err))
 	}
+	defer auditlog.Sync()
 
-	if opts.secureConnections {
-		redisOptions.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		}
+	shutdownTracing, err := tracing.Setup(
+		context.Background(),
+		"oneseismic-query",
+		opts.Exporter,
+		opts.OtlpEndpoint,
+	)
+	if err != nil {
+		logger.Fatal("unable to set up tracing", zap.Error(err))
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+
+	keyring := auth.MakeKeyring([]byte(opts.SignKey))
+	conn, err := queue.Open(opts.Queue, "jobs", "fetch", opts.Retention.Duration)
+	if err != nil {
+		logger.Fatal("unable to connect to queue", zap.Error(err))
+	}
+	defer conn.Close()
+
+	quotas, err := quota.Open(opts.Quota, conn, opts.Retention.Duration)
+	if err != nil {
+		logger.Fatal("unable to set up quotas", zap.Error(err))
 	}
-	cmdable := redis.NewClient(redisOptions)
 
-	scheduler := api.NewScheduler(cmdable)
-	gql := api.MakeGraphQL(&keyring, opts.storageURL, scheduler)
+	scheduler := api.NewQueueScheduler(conn.Jobs, conn.Results)
+	if conn.Redis != nil {
+		err := api.CheckScheduler(conn.Redis)
+		if err != nil {
+			logger.Fatal("unable to set up scheduler", zap.Error(err))
+		}
+		scheduler = api.NewScheduler(conn.Redis)
+		if opts.FairShare > 0 {
+			scheduler = api.NewFairScheduler(conn.Redis, opts.FairShare)
+		}
+	}
+	gql := api.MakeGraphQL(&keyring, opts.StorageURL, scheduler)
+	gql.SetBatchThreshold(opts.BatchThreshold)
+	gql.SetRetention(opts.Retention.Duration)
+	gql.SetTaskSizer(api.TaskSizer {
+		Fixed:           opts.TaskSize,
+		Workers:         opts.FetchWorkers,
+		TargetLatency:   opts.TargetLatency,
+		FragmentLatency: opts.FragmentLatency,
+	})
+	gql.SetQuotas(quotas)
+	gql.SetAdmission(conn.Jobs, opts.MaxQueueDepth, opts.MaxQueueWait)
+	gql.SetDedup(dedup.Open(opts.Dedup, conn))
+	gql.SetResults(conn.Results)
+	gql.SetCallbacks(callback.ParseHosts(opts.Callback.Hosts))
 
 	cfg := clientconfig {
-		appid: opts.clientID,
+		appid: opts.ClientID,
 		scopes: []string{
-			fmt.Sprintf("api://%s/One.Read", opts.clientID),
+			fmt.Sprintf("api://%s/One.Read", opts.ClientID),
 		},
-		defaultStorageResource: opts.storageURL,
+		defaultStorageResource: opts.StorageURL,
 	}
 
-	app := gin.Default()
-	
+	app := gin.New()
+	app.Use(logging.Gin(logger), gin.Recovery())
+
 	graphql := app.Group("/graphql")
+	graphql.Use(audit.Middleware(auditlog))
+	if opts.AuthServer != "" {
+		audience := opts.Audience
+		if audience == "" {
+			audience = opts.ClientID
+		}
+		provider := auth.GetJwksProvider(opts.AuthServer)
+		graphql.Use(auth.VerifyUser(opts.AuthServer, audience, provider.KeyFunc))
+	} else if quotas != nil {
+		logger.Warn(
+			"quotas are enabled, but no authserver is set to verify users; " +
+			"per-user quotas are not applied",
+		)
+	}
 	graphql.Use(util.GeneratePID)
 	graphql.GET( "", gql.Get)
 	graphql.POST("", gql.Post)
 
 	app.GET("/config", cfg.Get)
-	app.Run(fmt.Sprintf(":%s", opts.port))
+
+	srv := server.New(fmt.Sprintf(":%d", opts.Port), opts.Drain)
+	probes := health.New()
+	probes.Add(conn.Backend, conn.Ping)
+	if opts.CheckStorage {
+		probes.Add("storage", health.HTTPReachable(opts.StorageURL))
+	}
+	probes.ReadyWhen(srv.Ready)
+	probes.Register(app)
+
+	/*
+	 * The query service is the producer of tasks, and is responsible for
+	 * exporting the length of the job queue, one stream per priority class.
+	 */
+	if conn.Redis != nil {
+		for _, p := range queue.Priorities {
+			stream    := queue.PriorityStream("jobs", p)
+			collector := metrics.NewStreamLengthCollector(conn.Redis, stream)
+			prometheus.MustRegister(collector)
+		}
+	}
+	metrics.Register(app)
+	srv.Handler = app
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGTERM,
+		os.Interrupt,
+	)
+	defer stop()
+	err = srv.Run(ctx)
+	if err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+	/*
+	 * The promises handed out must be kept, so wait for the scheduling in
+	 * progress to complete before closing the connection to the queue.
+	 */
+	gql.Wait()
 }
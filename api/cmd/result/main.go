@@ -1,112 +1,151 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"fmt"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
-	"github.com/pborman/getopt/v2"
+	"go.uber.org/zap"
 
 	"github.com/equinor/oneseismic/api/api"
+	"github.com/equinor/oneseismic/api/internal/archive"
+	"github.com/equinor/oneseismic/api/internal/audit"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/health"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/metrics"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/quota"
+	"github.com/equinor/oneseismic/api/internal/server"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/equinor/oneseismic/api/internal/util"
 )
 
 type opts struct {
-	redisURL          string
-	redisPassword     string
-	secureConnections bool
-	signkey           string
-	port              string
+	config.Archive     `yaml:",inline"`
+	config.Queue       `yaml:",inline"`
+	config.Retention   `yaml:",inline"`
+	config.Quota       `yaml:",inline"`
+	config.Server      `yaml:",inline"`
+	config.Tracing     `yaml:",inline"`
+	config.Compression `yaml:",inline"`
+	SignKey            string `yaml:"sign-key"  env:"SIGN_KEY"  help:"Signing key used for response authorization tokens. Must match signing key in api/query" required:"true" secret:"true"`
+	AuditLog           string `yaml:"audit-log" env:"AUDIT_LOG" help:"Audit log sink; stdout, stderr, a file path, or none. Defaults to stdout"`
 }
 
 func parseopts() opts {
-	help := getopt.BoolLong("help", 0, "print this help text")
-	opts := opts{
-		redisURL:      os.Getenv("REDIS_URL"),
-		redisPassword: os.Getenv("REDIS_PASSWORD"),
-		signkey:       os.Getenv("SIGN_KEY"),
+	opts := opts {
+		Archive:     config.DefaultArchive(),
+		Server:      config.DefaultServer(),
+		Tracing:     config.DefaultTracing(),
+		Compression: config.DefaultCompression(),
+		Quota:       config.DefaultQuota(),
+		Retention:   config.DefaultRetention(),
+		AuditLog:    "stdout",
 	}
-
-	getopt.FlagLong(
-		&opts.signkey,
-		"sign-key",
-		0,
-		"Signing key used for response authorization tokens. " +
-			"Must match signing key in api/query",
-		"string",
-	)
-
-	getopt.FlagLong(
-		&opts.redisURL,
-		"redis-url",
-		0,
-		"Redis URL (host:port)",
-		"string",
-	)
-	getopt.FlagLong(
-		&opts.redisPassword,
-		"redis-password",
-		'P',
-		"Redis password. Empty by default",
-		"string",
-	)
-	secureConnections := getopt.BoolLong(
-		"secureConnections",
-		0,
-		"Connect to Redis securely",
-	)
-
-	opts.port = "8080"
-	getopt.FlagLong(
-		&opts.port,
-		"port",
-		0,
-		"Port to start server on. Defaults to 8080",
-	)
-
-	getopt.Parse()
-	if *help {
-		getopt.Usage()
-		os.Exit(0)
+	err := config.Load(&opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
-
-	opts.secureConnections = *secureConnections
 	return opts
 }
 
 func main() {
 	opts := parseopts()
+	logger, err := logging.Setup("oneseismic-result")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set up logging: %v\n", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+	logger.Info("configuration", zap.Any("config", config.Redacted(&opts)))
 
-	keyring := auth.MakeKeyring([]byte(opts.signkey))
+	auditlog, err := audit.Open("oneseismic-result", opts.AuditLog)
+	if err != nil {
+		logger.Fatal("unable to open audit log", zap.Error(err))
+	}
+	defer auditlog.Sync()
 
-	redisOptions := &redis.Options{
-		Addr:     opts.redisURL,
-		Password: opts.redisPassword,
-		DB:       0,
+	shutdownTracing, err := tracing.Setup(
+		context.Background(),
+		"oneseismic-result",
+		opts.Exporter,
+		opts.OtlpEndpoint,
+	)
+	if err != nil {
+		logger.Fatal("unable to set up tracing", zap.Error(err))
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+
+	keyring := auth.MakeKeyring([]byte(opts.SignKey))
+
+	conn, err := queue.Open(opts.Queue, "jobs", "fetch", opts.Retention.Duration)
+	if err != nil {
+		logger.Fatal("unable to connect to queue", zap.Error(err))
+	}
+	defer conn.Close()
+
+	quotas, err := quota.Open(opts.Quota, conn, opts.Retention.Duration)
+	if err != nil {
+		logger.Fatal("unable to set up quotas", zap.Error(err))
 	}
 
-	if opts.secureConnections {
-		redisOptions.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
-		}
+	archived, err := archive.Open(opts.Archive)
+	if err != nil {
+		logger.Fatal("unable to open archive", zap.Error(err))
 	}
 
 	result := api.Result{
-		Timeout: time.Second * 15,
-		Storage: redis.NewClient(redisOptions),
-		Keyring: &keyring,
+		Timeout:          time.Second * 15,
+		Storage:          conn.Results,
+		Keyring:          &keyring,
+		Archive:          archived,
+		ArchiveRetention: opts.Archive.Retention,
 	}
 
-	app := gin.Default()
+	app := gin.New()
+	app.Use(logging.Gin(logger), gin.Recovery())
 	results := app.Group("/result")
+	results.Use(audit.Middleware(auditlog))
 	results.Use(auth.ResultAuth(&keyring))
-	results.Use(util.Compression())
+	if quotas != nil {
+		results.Use(quota.Middleware(quotas))
+	}
+	results.Use(util.Compression(opts.Compression))
 	results.GET("/:pid", result.Get)
 	results.GET("/:pid/stream", result.Stream)
 	results.GET("/:pid/status", result.Status)
-	app.Run(fmt.Sprintf(":%s", opts.port))
+	results.GET("/:pid/events", result.Events)
+	if archived != nil {
+		results.GET("/:pid/link", result.Link)
+	}
+
+	srv := server.New(fmt.Sprintf(":%d", opts.Port), opts.Drain)
+	probes := health.New()
+	probes.Add(conn.Backend, conn.Ping)
+	probes.ReadyWhen(srv.Ready)
+	probes.Register(app)
+	metrics.Register(app)
+	srv.Handler = app
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGTERM,
+		os.Interrupt,
+	)
+	defer stop()
+	err = srv.Run(ctx)
+	if err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/api"
+	"github.com/equinor/oneseismic/api/fetch"
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/callback"
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/dedup"
+	"github.com/equinor/oneseismic/api/internal/health"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/metrics"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/server"
+	"github.com/equinor/oneseismic/api/internal/tracing"
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+/*
+ * oneseismic-server runs query, result and fetch in a single process, with
+ * in-memory queues instead of redis, and cubes read from a local directory
+ * instead of blob storage. It is meant for laptops and CI, not production:
+ * nothing is shared between processes, and results do not survive restarts.
+ *
+ * The data directory has the same layout as a storage account, i.e. one
+ * directory per cube, named by the cube guid, with the manifest.json and
+ * fragments.
+ */
+type opts struct {
+	config.Retention   `yaml:",inline"`
+	config.Server      `yaml:",inline"`
+	config.Tracing     `yaml:",inline"`
+	config.Callback    `yaml:",inline"`
+	config.Compression `yaml:",inline"`
+	Data               string `yaml:"data"     env:"DATA"     short:"d" help:"Directory with the cubes, laid out like a storage account" required:"true"`
+	Jobs               int    `yaml:"jobs"     env:"JOBS"     short:"j" help:"Allow N concurrent fragment reads at once. Defaults to 30"`
+	SignKey            string `yaml:"sign-key" env:"SIGN_KEY" help:"Signing key used for response authorization tokens. Defaults to a random key" secret:"true"`
+	Dedup              bool   `yaml:"dedup"    env:"DEDUP"    help:"Give identical queries of the same version of a cube the process (and result) of the first, while it is kept. Defaults to true"`
+}
+
+func parseopts() opts {
+	opts := opts {
+		Server:      config.DefaultServer(),
+		Tracing:     config.DefaultTracing(),
+		Compression: config.DefaultCompression(),
+		Retention:   config.DefaultRetention(),
+		Jobs:        30,
+		Dedup:       true,
+	}
+	err := config.Load(&opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	/*
+	 * The tokens are only ever verified by this process, so any key will do
+	 */
+	if opts.SignKey == "" {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to generate sign-key: %v\n", err)
+			os.Exit(1)
+		}
+		opts.SignKey = hex.EncodeToString(key)
+	}
+	return opts
+}
+
+/*
+ * Make the file:// storage endpoint from the data directory
+ */
+func endpoint(data string) (string, error) {
+	path, err := filepath.Abs(data)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", path)
+	}
+	u := url.URL { Scheme: "file", Path: filepath.ToSlash(path) }
+	return u.String(), nil
+}
+
+func main() {
+	opts := parseopts()
+	logger, err := logging.Setup("oneseismic-server")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set up logging: %v\n", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+	logger.Info("configuration", zap.Any("config", config.Redacted(&opts)))
+
+	shutdownTracing, err := tracing.Setup(
+		context.Background(),
+		"oneseismic-server",
+		opts.Exporter,
+		opts.OtlpEndpoint,
+	)
+	if err != nil {
+		logger.Fatal("unable to set up tracing", zap.Error(err))
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+
+	storageURL, err := endpoint(opts.Data)
+	if err != nil {
+		logger.Fatal("bad data directory", zap.Error(err))
+	}
+
+	keyring := auth.MakeKeyring([]byte(opts.SignKey))
+	jobs    := queue.NewMemoryJobs()
+	results := queue.NewMemoryResults(opts.Retention.Duration)
+
+	scheduler := api.NewQueueScheduler(jobs, results)
+	gql := api.MakeGraphQL(&keyring, storageURL, scheduler)
+	gql.SetRetention(opts.Retention.Duration)
+	gql.SetResults(results)
+	gql.SetCallbacks(callback.ParseHosts(opts.Callback.Hosts))
+	var dedups dedup.Store
+	if opts.Dedup {
+		dedups = dedup.NewMemoryStore()
+		gql.SetDedup(dedups)
+	}
+	result := api.Result{
+		Timeout: time.Second * 15,
+		Storage: results,
+		Keyring: &keyring,
+	}
+
+	app := gin.New()
+	app.Use(logging.Gin(logger), gin.Recovery())
+
+	graphql := app.Group("/graphql")
+	graphql.Use(util.GeneratePID)
+	graphql.GET( "", gql.Get)
+	graphql.POST("", gql.Post)
+
+	resultgroup := app.Group("/result")
+	resultgroup.Use(auth.ResultAuth(&keyring))
+	resultgroup.Use(util.Compression(opts.Compression))
+	resultgroup.GET("/:pid", result.Get)
+	resultgroup.GET("/:pid/stream", result.Stream)
+	resultgroup.GET("/:pid/status", result.Status)
+	resultgroup.GET("/:pid/events", result.Events)
+
+	srv := server.New(fmt.Sprintf(":%d", opts.Port), opts.Drain)
+	probes := health.New()
+	probes.ReadyWhen(srv.Ready)
+	probes.Register(app)
+	metrics.Register(app)
+	srv.Handler = app
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGTERM,
+		os.Interrupt,
+	)
+	defer stop()
+
+	worker := fetch.NewWorker(jobs, results, "server", opts.Jobs)
+	worker.SetCallbacks(callback.Open(opts.Callback))
+	worker.SetDedup(dedups)
+	workerdone := make(chan error, 1)
+	go func() {
+		workerdone <- worker.Run(ctx, opts.Drain)
+	}()
+
+	logger.Info("serving", zap.String("data", storageURL))
+	err = srv.Run(ctx)
+	if err != nil {
+		logger.Fatal("server failed", zap.Error(err))
+	}
+	gql.Wait()
+	err = <-workerdone
+	if err != nil {
+		logger.Fatal("worker failed", zap.Error(err))
+	}
+}
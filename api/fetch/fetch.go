@@ -1,4 +1,4 @@
-package main
+package fetch
 
 // #cgo LDFLAGS: -loneseismic -lfmt
 // #include <stdlib.h>
@@ -9,15 +9,19 @@ import "unsafe"
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/equinor/oneseismic/api/internal"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 
-	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 /*
@@ -37,6 +41,11 @@ type process struct {
 	 */
 	pid  string
 	part string
+	/*
+	 * How long the result is kept, as given by the task. Zero for the result
+	 * store's time-to-live.
+	 */
+	retention time.Duration
 	/*
 	 * The parsed and raw task specification, as read from the input message
 	 * queue.
@@ -47,6 +56,9 @@ type process struct {
 	 * The azblob API uses a context to communicate status to the caller, which
 	 * in turn can be shared between multiple concurrent downloads. Useful for
 	 * signalling failures to cancel pending downloads.
+	 *
+	 * The context also carries the task span, which is ended when the process
+	 * is cleaned up.
 	 */
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -68,14 +80,18 @@ type process struct {
 }
 
 /*
- * Automation - return the pid=, proc= log line prefix to make log formatting
- * less noisy.
+ * Automation - return the pid, part and guid log fields to make logging less
+ * noisy. The guid is empty if the task could not be unpacked.
  *
  * This is the only function allowed to call on a process if exec() returns an
  * error.
  */
-func (p *process) logpid() string {
-	return fmt.Sprintf("pid=%s, part=%s", p.pid, p.part)
+func (p *process) logfields(fields ...zap.Field) []zap.Field {
+	return append([]zap.Field {
+		logging.Pid(p.pid),
+		logging.Part(p.part),
+		logging.Guid(p.task.Guid),
+	}, fields...)
 }
 
 /*
@@ -94,31 +110,51 @@ func (p *process) c_error() error {
  * > new process image.
  */
 func exec(msg [][]byte) (*process, error) {
-	ctx, cancel := context.WithCancel(context.Background())
 	proc := &process {
 		pid:     string(msg[0]),
 		part:    string(msg[1]),
 		rawtask: msg[2],
-		ctx:     ctx,
-		cancel:  cancel,
 	}
 	_, err := proc.task.Unpack(proc.rawtask)
 	if err != nil {
-		return nil, err
+		return proc, err
 	}
 
+	/*
+	 * Continue the trace started by the query, if any. The task span is ended
+	 * in cleanup(), or here if the process cannot be created, since the
+	 * caller does not clean up a process that exec() returns an error for.
+	 */
+	parent := tracing.Extract(context.Background(), proc.task.TraceContext)
+	spanctx, span := tracing.Tracer().Start(
+		parent,
+		"task",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			tracing.Pid(proc.pid),
+			tracing.Part(proc.part),
+			tracing.Guid(proc.task.Guid),
+			tracing.Function(proc.task.Function),
+		),
+	)
+	proc.ctx, proc.cancel = context.WithCancel(spanctx)
+
 	kind := C.CString(proc.task.Function)
 	defer C.free(unsafe.Pointer(kind))
 	proc.cpp = C.newproc(kind);
 	if proc.cpp == nil {
-		msg := "%s unable to new() proc of kind %s"
-		return proc, fmt.Errorf(msg, proc.logpid(), proc.task.Function)
+		proc.cancel()
+		span.End()
+		msg := "unable to new() proc of kind %s"
+		return proc, fmt.Errorf(msg, proc.task.Function)
 	}
 	buffer := unsafe.Pointer(&proc.rawtask[0])
 	length := C.int(len(proc.rawtask))
 	ok := C.init(proc.cpp, buffer, length)
 	if !ok {
-		return proc, proc.c_error()
+		err := proc.c_error()
+		proc.cleanup()
+		return proc, err
 	}
 	return proc, nil
 }
@@ -131,6 +167,7 @@ func (p *process) cleanup() {
 	C.cleanup(p.cpp)
 	p.cpp = nil
 	p.cancel()
+	trace.SpanFromContext(p.ctx).End()
 }
 
 /*
@@ -145,8 +182,10 @@ func (p *process) cleanup() {
 func (p *process) fragments() []string {
 	cfrags := C.fragments(p.cpp)
 	if cfrags == nil {
-		msg := "%s unable to get fragment IDs: %w"
-		log.Fatalf(msg, p.logpid(), p.c_error())
+		zap.L().Fatal(
+			"unable to get fragment IDs",
+			p.logfields(zap.Error(p.c_error()))...,
+		)
 	}
 
 	/*
@@ -210,8 +249,10 @@ func (p *process) add(f fragment) error {
 func (p *process) pack() []byte {
 	packed := C.pack(p.cpp)
 	if packed.err {
-		msg := "%s unable to pack result: %v"
-		log.Fatalf(msg, p.logpid(), p.c_error())
+		zap.L().Fatal(
+			"unable to pack result",
+			p.logfields(zap.Error(p.c_error()))...,
+		)
 	}
 	return C.GoBytes(packed.body, packed.size)
 }
@@ -263,46 +304,82 @@ func (p *process) blob(container *url.URL, blob string) (*url.URL, error) {
  * doesn't have to without introducing deadlocks if the channels are
  * sufficiently buffered.
  *
+ * The returned error is nil if, and only if, the result was written to
+ * storage. Failures are logged here, so the error is mostly useful for the
+ * caller to determine if the task was completed or should be retried.
+ *
  * This function finalizes the process.
  */
 func (p *process) gather(
-	storage    redis.Cmdable,
+	storage    queue.Results,
 	nfragments int,
-	queue      fetchQueue,
-) {
+	fq         fetchQueue,
+) (err error) {
 	defer p.cleanup()
+	start := time.Now()
+	defer func() {
+		outcome := "ok"
+		if err != nil {
+			outcome = "failed"
+			span := trace.SpanFromContext(p.ctx)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "task failed")
+		}
+		gatherDuration.WithLabelValues(outcome).Observe(
+			time.Since(start).Seconds(),
+		)
+	}()
 	for i := 0; i < nfragments; i++ {
 		select {
-		case f := <-queue.fragments:
+		case f := <-fq.fragments:
 			err := p.add(f)
 			if err != nil {
-				log.Fatalf("%s add failed: %v", p.logpid(), err)
+				zap.L().Fatal("add failed", p.logfields(zap.Error(err))...)
 			}
-		case e := <-queue.errors:
-			log.Printf("%s download failed: %v", p.logpid(), e)
+		case e := <-fq.errors:
+			zap.L().Error("download failed", p.logfields(zap.Error(e))...)
 			for {
 				// Grab the remaining available errors to log them, but don't
 				// wait around for any new ones to come in
 				select {
-				case e := <-queue.errors:
-					log.Printf("%s download failed: %v", p.logpid(), e)
+				case e := <-fq.errors:
+					zap.L().Error(
+						"download failed",
+						p.logfields(zap.Error(e))...,
+					)
 				default:
-					return
+					return e
 				}
 			}
 		}
 	}
 
+	_, span := tracing.Tracer().Start(p.ctx, "pack")
 	packed := p.pack()
-	log.Printf("%s ready", p.logpid())
-	args := redis.XAddArgs{
-		Stream: p.pid,
-		Values: map[string]interface{}{p.part: packed},
+	span.End()
+	zap.L().Debug("ready", p.logfields()...)
+
+	/*
+	 * The trace context is passed along with the result, so that the result
+	 * service can continue the trace when the result is streamed to the
+	 * client. It's the trace context of the process (as received in the
+	 * task), not the task span, so that the stream-out is a sibling of the
+	 * tasks.
+	 */
+	part := queue.Part {
+		Name:         p.part,
+		Body:         packed,
+		TraceContext: p.task.TraceContext,
+		Retention:    p.retention,
 	}
-	err := storage.XAdd(p.ctx, &args).Err()
+	err = storage.Append(p.ctx, p.pid, part)
 	if err != nil {
-		log.Printf("%s write to storage failed: %v", p.logpid(), err)
+		zap.L().Error(
+			"write to storage failed",
+			p.logfields(zap.Error(err))...,
+		)
+		return err
 	}
-	storage.Expire(p.ctx, p.pid, 10 * time.Minute)
-	log.Printf("%s written to storage", p.logpid())
+	zap.L().Info("written to storage", p.logfields()...)
+	return nil
 }
@@ -0,0 +1,321 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/callback"
+	"github.com/equinor/oneseismic/api/internal/dedup"
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+func testurl() *url.URL {
+	addr, _ := url.Parse("https://example.com")
+	return addr
+}
+
+func TestCancelledDownloadErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	blob, err := azblob.NewBlobClientWithNoCredential(testurl().String(), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = downloadBlob(ctx, blob, &azblob.DownloadBlobOptions{})
+	if err == nil {
+		t.Errorf("expected downloadBlob() to fail; err was nil")
+	}
+
+	msg := "context canceled"
+	assert.Containsf(t, err.Error(), msg, "want err =~ '%s'; was %v", msg, err)
+}
+
+func TestCancelledDownloadPostsOnErrorChannel(t *testing.T) {
+	/* 
+	 * Cancel the context immediately, to emulating a failure from the process
+	 * controller. This tests that the messages flow onto the right channel in
+	 * the presence of cancelled sibling fetches, not the actual fetch being
+	 * processed by this thread.
+	 */
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fetch := newFetch(1)
+	blobs := []*url.URL{testurl()}
+
+	fq := fetch.mkqueue()
+	fetch.enqueue(ctx, fq, blobs)
+	close(fetch.requests)
+	fetch.run()
+
+	select {
+	case <-fq.errors:
+	case <-fq.fragments:
+		t.Errorf("Pending message on fragments; should be message on error")
+	}
+}
+
+func TestFetchblobReadsFileURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "0-0-0.f32")
+	err = ioutil.WriteFile(path, []byte("fragment"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := &url.URL { Scheme: "file", Path: filepath.ToSlash(path) }
+	chunk, err := fetchblob(context.Background(), blob, &nocache{})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("fragment"), chunk)
+
+	blob.Path += ".missing"
+	_, err = fetchblob(context.Background(), blob, &nocache{})
+	assert.Error(t, err)
+}
+
+func TestMessageOnErrorCancelsGather(t *testing.T) {
+	o := fetchQueue {
+		fragments: make(chan fragment, 1),
+		errors:    make(chan error, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// directly construct the process by populating fields manually. This is to
+	// avoid having to shuffle bytes about and init the C++ object, which
+	// should not be used at all for this test. This is vulnerable to changes
+	// in the struct layout, but such changes should probably be detected
+	// compile time anyway, and this test is then easily updated.
+	proc := process {
+		ctx: ctx,
+		cancel: cancel,
+		cpp: nil,
+	}
+
+	o.errors <- fmt.Errorf("Test error")
+	// Pretend that there are 2 fragments to be fetched. None will be sent, but
+	// it increases the confidence that the worker loop is aborted immediately
+	// rather than waiting for more data.
+	proc.gather(nil, 2, o)
+	select {
+	case <-ctx.Done():
+	default:
+		t.Errorf("Expected context to be cancelled, but it is not")
+	}
+}
+
+func TestDrainReturnsNothingWhenTasksComplete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := &process { ctx: ctx, cancel: cancel }
+
+	tasks := newInflight()
+	tasks.add(proc, queue.Task { Pid: "pid", Part: "0/1" })
+	go tasks.done(proc, nil)
+
+	unfinished := tasks.drain(time.Second)
+	assert.Empty(t, unfinished, "want no unfinished tasks")
+}
+
+func TestDrainCancelsAndReturnsUnfinishedTasks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := &process { ctx: ctx, cancel: cancel }
+	task := queue.Task { Pid: "pid", Part: "0/1" }
+
+	tasks := newInflight()
+	tasks.add(proc, task)
+	// Emulate a process that is stuck until it is cancelled, e.g. a slow
+	// download, which fails once the context is cancelled
+	go func() {
+		<-proc.ctx.Done()
+		tasks.done(proc, proc.ctx.Err())
+	}()
+
+	unfinished := tasks.drain(10 * time.Millisecond)
+	assert.Equal(t, []queue.Task{ task }, unfinished)
+}
+
+/*
+ * A callback receiver that passes the payloads on to called.
+ */
+func receiver(called chan<- callback.Payload) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			payload := callback.Payload {}
+			json.NewDecoder(r.Body).Decode(&payload)
+			called <- payload
+		},
+	))
+}
+
+/*
+ * A worker that calls back to the receiver.
+ */
+func callbackWorker(results queue.Results, srv *httptest.Server) *Worker {
+	addr, _ := url.Parse(srv.URL)
+	keyring := auth.MakeKeyring([]byte("callback-key"))
+	worker  := NewWorker(queue.NewMemoryJobs(), results, "consumer", 1)
+	worker.SetCallbacks(callback.NewSender(keyring, callback.Hosts { addr.Host }))
+	return worker
+}
+
+func TestLastPartCallsBack(t *testing.T) {
+	ctx := context.Background()
+	called := make(chan callback.Payload, 2)
+	srv    := receiver(called)
+	defer srv.Close()
+
+	results := queue.NewMemoryResults(time.Minute)
+	worker  := callbackWorker(results, srv)
+
+	tasks := []queue.Task {
+		{ Pid: "pid", Part: "0/2", Callback: srv.URL },
+		{ Pid: "pid", Part: "1/2", Callback: srv.URL },
+	}
+	assert.NoError(t, results.SetHeader(ctx, "pid", []byte("header"), 0))
+	for _, task := range tasks {
+		part := queue.Part { Name: task.Part, Body: []byte("part") }
+		assert.NoError(t, results.Append(ctx, "pid", part))
+		worker.complete(task, nil)
+	}
+	worker.callbacks.Wait()
+
+	assert.Len(t, called, 1, "want callback for the last part only")
+	payload := <-called
+	assert.Equal(t, "pid",        payload.Pid)
+	assert.Equal(t, "finished",   payload.Status)
+	assert.Equal(t, "result/pid", payload.Location)
+}
+
+func TestFailedTaskCallsBack(t *testing.T) {
+	called := make(chan callback.Payload, 1)
+	srv    := receiver(called)
+	defer srv.Close()
+
+	worker := callbackWorker(queue.NewMemoryResults(time.Minute), srv)
+
+	task := queue.Task { Pid: "pid", Part: "0/2", Callback: srv.URL }
+	worker.complete(task, fmt.Errorf("download failed"))
+	worker.callbacks.Wait()
+
+	payload := <-called
+	assert.Equal(t, "pid",    payload.Pid)
+	assert.Equal(t, "failed", payload.Status)
+	assert.Equal(t, "",       payload.Location)
+}
+
+func TestProcessCallsBackOnce(t *testing.T) {
+	ctx := context.Background()
+	called := make(chan callback.Payload, 4)
+	srv    := receiver(called)
+	defer srv.Close()
+
+	results := queue.NewMemoryResults(time.Minute)
+	worker  := callbackWorker(results, srv)
+
+	/*
+	 * Both parts land before either worker checks the count, so that both
+	 * see the process as finished
+	 */
+	tasks := []queue.Task {
+		{ Pid: "pid", Part: "0/2", Callback: srv.URL },
+		{ Pid: "pid", Part: "1/2", Callback: srv.URL },
+	}
+	for _, task := range tasks {
+		part := queue.Part { Name: task.Part, Body: []byte("part") }
+		assert.NoError(t, results.Append(ctx, "pid", part))
+	}
+	for _, task := range tasks {
+		worker.complete(task, nil)
+	}
+
+	failed := []queue.Task {
+		{ Pid: "failed", Part: "0/2", Callback: srv.URL },
+		{ Pid: "failed", Part: "1/2", Callback: srv.URL },
+	}
+	for _, task := range failed {
+		worker.complete(task, fmt.Errorf("download failed"))
+	}
+	worker.callbacks.Wait()
+
+	assert.Len(t, called, 2, "want one callback per process")
+	statuses := map[string]string {}
+	for len(called) > 0 {
+		payload := <-called
+		statuses[payload.Pid] = payload.Status
+	}
+	assert.Equal(t, map[string]string {
+		"pid":    "finished",
+		"failed": "failed",
+	}, statuses)
+}
+
+func TestFailedTaskForgetsProcess(t *testing.T) {
+	ctx    := context.Background()
+	dedups := dedup.NewMemoryStore()
+	assert.NoError(t, dedups.Put(ctx, "failed", "pid-0", time.Minute))
+	assert.NoError(t, dedups.Put(ctx, "working", "pid-1", time.Minute))
+
+	results := queue.NewMemoryResults(time.Minute)
+	worker  := NewWorker(queue.NewMemoryJobs(), results, "consumer", 1)
+	worker.SetDedup(dedups)
+	worker.complete(queue.Task { Pid: "pid-0", Part: "0/2" }, fmt.Errorf("failed"))
+	worker.complete(queue.Task { Pid: "pid-1", Part: "0/2" }, nil)
+
+	_, _, err := dedups.Get(ctx, "failed")
+	assert.Equal(t, dedup.ErrNotFound, err)
+	pid, _, err := dedups.Get(ctx, "working")
+	assert.NoError(t, err)
+	assert.Equal(t, "pid-1", pid)
+}
+
+/*
+ * Compare the cost of sending the (regular) payload with a smaller structure.
+ * Sending blob objects as pointers is much faster, but might possibly
+ * pessimize garbage collection or other parts of the program, so it must be
+ * optimized with much care.
+ *
+ * So far it seems that the cost of sending by-value is so small that *any* gc
+ * hit or other indirection will eat up the gain and more.
+ *
+ * BenchmarkSendTask-4             15701625                75.2 ns/op
+ * BenchmarkSendSmallStruct-4      20805266                55.6 ns/op
+ */
+func BenchmarkSendTask(b *testing.B) {
+	type payload = request
+	p := payload {}
+	c := make(chan payload, 100)
+	for n := 0; n < b.N; n++ {
+		c <- p
+		<-c
+	}
+}
+
+func BenchmarkSendSmallStruct(b *testing.B) {
+	type payload struct {
+		i int
+		b []byte
+		e chan error
+	}
+	p := payload {}
+	c := make(chan payload, 100)
+	for n := 0; n < b.N; n++ {
+		c <- p
+		<-c
+	}
+}
@@ -0,0 +1,65 @@
+package fetch
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/equinor/oneseismic/api/internal/metrics"
+)
+
+var (
+	downloadDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "fetch",
+			Name:      "download_duration_seconds",
+			Help:      "Time spent downloading (or revalidating) fragments",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+	)
+
+	downloadBytes = promauto.NewCounter(
+		prometheus.CounterOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "fetch",
+			Name:      "download_bytes_total",
+			Help:      "Bytes downloaded from storage",
+		},
+	)
+
+	/*
+	 * Cache lookups. A hit is not necessarily served from cache, as it is
+	 * revalidated with the ETag, see cacheRevalidations.
+	 */
+	cacheLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "fetch",
+			Name:      "cache_lookups_total",
+			Help:      "Fragment cache lookups, by result (hit, miss)",
+		},
+		[]string{ "result" },
+	)
+
+	cacheRevalidations = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "fetch",
+			Name:      "cache_revalidations_total",
+			Help:      "ETag revalidations of cached fragments, " +
+			           "by result (not-modified, modified)",
+		},
+		[]string{ "result" },
+	)
+
+	gatherDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: metrics.Namespace,
+			Subsystem: "fetch",
+			Name:      "gather_duration_seconds",
+			Help:      "Time to complete a task, from download to written result",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		},
+		[]string{ "outcome" },
+	)
+)
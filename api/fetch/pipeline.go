@@ -1,17 +1,20 @@
-package main
+package fetch
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/url"
 	"net/http"
+	"time"
 
 	"github.com/equinor/oneseismic/api/internal"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/equinor/oneseismic/api/internal/util"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/dgraph-io/ristretto"
+	"go.uber.org/zap"
 )
 
 /*
@@ -183,12 +186,21 @@ func fetchblob(
 	cache fragmentcache,
 ) ([]byte, error) {
 	if blob == nil  {
-		log.Printf("Empty bloburl")
+		zap.L().Error("empty bloburl")
 		return nil, internal.NewInternalError()
 	}
 
+	if blob.Scheme == "file" {
+		return readfile(ctx, blob)
+	}
+
 	key := blob.Path
 	cached, hit := cache.get(key)
+	if hit {
+		cacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		cacheLookups.WithLabelValues("miss").Inc()
+	}
 
 	options := &azblob.DownloadBlobOptions{
 		BlobAccessConditions: &azblob.BlobAccessConditions{
@@ -207,18 +219,24 @@ func fetchblob(
 		return nil, err
 	}
 
+	ctx, span := tracing.Tracer().Start(ctx, "download")
+	defer span.End()
+	start := time.Now()
 	cold, err := downloadBlob(ctx, client, options)
+	downloadDuration.Observe(time.Since(start).Seconds())
 	if err == nil {
 		/* nil means the azblob.Download succeeded *and* was not etag match */
+		downloadBytes.Add(float64(len(cold.chunk)))
 		if hit {
+			cacheRevalidations.WithLabelValues("modified").Inc()
 			/* This probably means expired ETag, which again means a fragment
 			* has been updated since cached. This should not happen in a
 			* healthy system and must be investigated immediately.
 			 */
-			log.Printf(
-				"ETag (= %s) expired for %v; investigate immediately",
-				*cached.etag,
-				blob,
+			zap.L().Error(
+				"ETag expired; investigate immediately",
+				zap.String("etag", *cached.etag),
+				zap.Stringer("blob", blob),
 			)
 			return nil, internal.NewInternalError()
 		} else {
@@ -232,18 +250,43 @@ func fetchblob(
 	case azblob.StorageError:
 		status := e.Response().StatusCode
 		if status == http.StatusNotModified {
+			cacheRevalidations.WithLabelValues("not-modified").Inc()
 			return cached.chunk, nil
 		}
 		// TODO: what other codes can actually show up here? Forbidden? No such
 		// resource? For now, don't leak anything back, but log and add
 		// case-by-case
-		log.Printf("Unhandled azblob.StorageError: %v", err)
+		zap.L().Error("unhandled azblob.StorageError", zap.Error(err))
 		return nil, internal.NewInternalError()
 
 	default:
-		log.Printf("Unhandled error type %T (= %v)", e, e)
+		zap.L().Error(
+			"unhandled error",
+			zap.String("type", fmt.Sprintf("%T", e)),
+			zap.Error(e),
+		)
+		return nil, internal.NewInternalError()
+	}
+}
+
+/*
+ * Read a fragment from the local filesystem, for the file:// storage backend
+ * used in single-binary mode. The fragments are not cached since the files
+ * are local already, and most likely in the page cache anyway.
+ */
+func readfile(ctx context.Context, blob *url.URL) ([]byte, error) {
+	_, span := tracing.Tracer().Start(ctx, "read")
+	defer span.End()
+	chunk, err := ioutil.ReadFile(blob.Path)
+	if err != nil {
+		zap.L().Error(
+			"unable to read fragment",
+			zap.Stringer("blob", blob),
+			zap.Error(err),
+		)
 		return nil, internal.NewInternalError()
 	}
+	return chunk, nil
 }
 
 func (f *fetch) run() {
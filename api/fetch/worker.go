@@ -0,0 +1,448 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/callback"
+	"github.com/equinor/oneseismic/api/internal/dedup"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/quota"
+	"github.com/equinor/oneseismic/api/internal/tracing"
+)
+
+/*
+ * Book-keeping of the tasks currently being worked on by this worker, i.e.
+ * read from the job queue but not yet written to storage.
+ *
+ * Tasks are removed from the job queue immediately when read, so this worker
+ * is the only one that knows about them. On shutdown, the worker waits for
+ * the in-flight tasks to complete, but if they don't complete in time they
+ * are cancelled and handed back to the job queue so that some other worker
+ * can pick them up.
+ */
+type inflight struct {
+	sync.Mutex
+	wg        sync.WaitGroup
+	tasks     map[*process]queue.Task
+	/*
+	 * Set when the in-flight processes are cancelled. Processes that fail
+	 * after this point failed because of the shutdown, and not because of the
+	 * task itself.
+	 */
+	cancelled bool
+	unfinished []queue.Task
+}
+
+func newInflight() *inflight {
+	return &inflight {
+		tasks: make(map[*process]queue.Task),
+	}
+}
+
+func (in *inflight) add(proc *process, task queue.Task) {
+	in.Lock()
+	defer in.Unlock()
+	in.wg.Add(1)
+	in.tasks[proc] = task
+}
+
+/*
+ * Mark a process as done, successful or not. This must be called exactly once
+ * for every process passed to add(). Returns false if the process failed
+ * because of the shutdown, i.e. the task will be handed back.
+ */
+func (in *inflight) done(proc *process, err error) bool {
+	in.Lock()
+	defer in.Unlock()
+	task := in.tasks[proc]
+	delete(in.tasks, proc)
+	in.wg.Done()
+	if err != nil && in.cancelled {
+		in.unfinished = append(in.unfinished, task)
+		return false
+	}
+	return true
+}
+
+/*
+ * Wait for the in-flight tasks to complete, and return the tasks that did not
+ * complete within the timeout. The unfinished tasks are cancelled, and this
+ * function will not return until all processes are cleaned up.
+ *
+ * No new tasks must be added after drain() is called.
+ */
+func (in *inflight) drain(timeout time.Duration) []queue.Task {
+	completed := make(chan struct{})
+	go func() {
+		in.wg.Wait()
+		close(completed)
+	}()
+
+	select {
+	case <-completed:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	in.Lock()
+	in.cancelled = true
+	for proc := range in.tasks {
+		proc.cancel()
+	}
+	in.Unlock()
+
+	<-completed
+	return in.unfinished
+}
+
+/*
+ * The fetch worker, which reads tasks from the job queue, downloads the
+ * fragments, and writes the results to the result store.
+ *
+ * The worker is the main loop of the fetch service, but the queues can be
+ * in-memory so that the worker can run in the same process as query and
+ * result (oneseismic-server).
+ */
+type Worker struct {
+	jobs      queue.Jobs
+	results   queue.Results
+	consumer  string
+	fetch     *fetch
+	tasks     *inflight
+	quotas    quota.Store
+	callbacks *callback.Sender
+	dedup     dedup.Store
+}
+
+/*
+ * Make a new worker that reads as the consumer, and downloads at most njobs
+ * fragments concurrently.
+ */
+func NewWorker(
+	jobs     queue.Jobs,
+	results  queue.Results,
+	consumer string,
+	njobs    int,
+) *Worker {
+	return &Worker {
+		jobs:     jobs,
+		results:  results,
+		consumer: consumer,
+		fetch:    newFetch(njobs),
+		tasks:    newInflight(),
+	}
+}
+
+/*
+ * Mark the tasks of users as done in the quota store, so that the users can
+ * be admitted more processes. Quotas are disabled by default.
+ */
+func (w *Worker) SetQuotas(quotas quota.Store) {
+	w.quotas = quotas
+}
+
+/*
+ * Send the callbacks of processes that ask for them. Callbacks are disabled
+ * by default.
+ */
+func (w *Worker) SetCallbacks(callbacks *callback.Sender) {
+	w.callbacks = callbacks
+}
+
+/*
+ * Forget the processes of failed tasks in the deduplication store, so that
+ * identical queries are not given a process that will never finish. Disabled
+ * (nil) by default.
+ */
+func (w *Worker) SetDedup(store dedup.Store) {
+	w.dedup = store
+}
+
+/*
+ * The task is done, successfully or not (err), and will not be handed back.
+ */
+func (w *Worker) complete(task queue.Task, err error) {
+	w.notify(task, err)
+	if err != nil {
+		w.forget(task)
+	}
+	if w.quotas == nil || task.User == "" {
+		return
+	}
+	err = w.quotas.Done(context.Background(), task.User, task.Pid)
+	if err != nil {
+		zap.L().Warn(
+			"unable to mark task as done in quota",
+			logging.Pid(task.Pid),
+			logging.Part(task.Part),
+			zap.Error(err),
+		)
+	}
+}
+
+func (w *Worker) forget(task queue.Task) {
+	if w.dedup == nil {
+		return
+	}
+	err := w.dedup.Forget(context.Background(), task.Pid)
+	if err != nil {
+		zap.L().Warn(
+			"unable to forget failed process for identical queries",
+			logging.Pid(task.Pid),
+			logging.Part(task.Part),
+			zap.Error(err),
+		)
+	}
+}
+
+/*
+ * Call back if the task was the last of its process, or if it failed, in
+ * which case the process will never finish. The parts are written by
+ * different workers, so the last part is the one after which the result store
+ * has all of them.
+ *
+ * More than one worker can see the last part land, and every failed task
+ * fails the process, so the callback is claimed in the result store first,
+ * and only the worker that gets the claim calls back.
+ */
+func (w *Worker) notify(task queue.Task, err error) {
+	if task.Callback == "" {
+		return
+	}
+	/*
+	 * Warn once per process (on its first part) rather than for every task.
+	 */
+	if w.callbacks == nil {
+		if strings.HasPrefix(task.Part, "0/") {
+			zap.L().Warn(
+				"callbacks are disabled; not calling back",
+				logging.Pid(task.Pid),
+			)
+		}
+		return
+	}
+	if err != nil {
+		if w.claimCallback(task) {
+			w.callbacks.Send(task.Callback, callback.Payload {
+				Pid:    task.Pid,
+				Status: "failed",
+			})
+		}
+		return
+	}
+
+	var n, m int
+	_, err = fmt.Sscanf(task.Part, "%d/%d", &n, &m)
+	if err != nil {
+		zap.L().Error(
+			"unable to parse part; not calling back",
+			logging.Pid(task.Pid),
+			logging.Part(task.Part),
+			zap.Error(err),
+		)
+		return
+	}
+	count, err := w.results.Count(context.Background(), task.Pid)
+	if err != nil {
+		zap.L().Error(
+			"unable to count parts; not calling back",
+			logging.Pid(task.Pid),
+			logging.Part(task.Part),
+			zap.Error(err),
+		)
+		return
+	}
+	if count < m || !w.claimCallback(task) {
+		return
+	}
+	w.callbacks.Send(task.Callback, callback.Payload {
+		Pid:      task.Pid,
+		Status:   "finished",
+		Location: fmt.Sprintf("result/%s", task.Pid),
+	})
+}
+
+/*
+ * Claim the final callback of the process. Should the claim fail, the
+ * callback is not sent, rather than risk sending it more than once.
+ */
+func (w *Worker) claimCallback(task queue.Task) bool {
+	claimed, err := w.results.Claim(
+		context.Background(),
+		task.Pid,
+		"callback",
+		task.Retention,
+	)
+	if err != nil {
+		zap.L().Error(
+			"unable to claim callback; not calling back",
+			logging.Pid(task.Pid),
+			logging.Part(task.Part),
+			zap.Error(err),
+		)
+		return false
+	}
+	return claimed
+}
+
+/*
+ * Start working on a task, as read from the job queue. The task is done in
+ * the background, and this function returns as soon as the fragments are
+ * scheduled for download.
+ */
+func (w *Worker) start(task queue.Task) {
+	msg  := [][]byte{ []byte(task.Pid), []byte(task.Part), task.Body }
+	proc, err := exec(msg)
+	if err != nil {
+		zap.L().Error("dropping bad process", proc.logfields(zap.Error(err))...)
+		w.complete(task, err)
+		return
+	}
+	proc.retention = task.Retention
+
+	/*
+	 * Record the time spent in the queue as a span in the trace of the
+	 * process.
+	 */
+	if !task.Enqueued.IsZero() {
+		parent := tracing.Extract(context.Background(), proc.task.TraceContext)
+		_, span := tracing.Tracer().Start(
+			parent,
+			"queue",
+			trace.WithTimestamp(task.Enqueued),
+			trace.WithAttributes(
+				tracing.Pid(task.Pid),
+				tracing.Part(task.Part),
+			),
+		)
+		span.End()
+	}
+
+	/*
+	 * Build the container-URL early, in case it should be broken,
+	 * so that no goroutines are scheduled before any sanity
+	 * checking of input.
+	 */
+	container, err := proc.container()
+	if err != nil {
+		zap.L().Error("dropping bad process", proc.logfields(zap.Error(err))...)
+		w.complete(task, err)
+		return
+	}
+
+	fragments := proc.fragments()
+	blobs := make([]*url.URL, len(fragments))
+	for i, id := range fragments {
+		blob, err := proc.blob(container, id)
+		if err != nil {
+			zap.L().Error(
+				"dropping bad process",
+				proc.logfields(zap.Error(err))...,
+			)
+			w.complete(task, err)
+			return
+		}
+		blobs[i] = blob
+	}
+
+	fq := w.fetch.mkqueue()
+	w.tasks.add(proc, task)
+	go func() {
+		err := proc.gather(w.results, len(fragments), fq)
+		if w.tasks.done(proc, err) {
+			w.complete(task, err)
+		}
+	}()
+	w.fetch.enqueue(proc.ctx, fq, blobs)
+}
+
+/*
+ * Hand tasks back to the job queue. Once a task is handed back it is up to
+ * the other workers to complete it.
+ */
+func (w *Worker) handback(ctx context.Context, tasks []queue.Task) {
+	for _, task := range tasks {
+		pid  := logging.Pid(task.Pid)
+		part := logging.Part(task.Part)
+		err  := w.jobs.Enqueue(ctx, task)
+		if err != nil {
+			zap.L().Error(
+				"unable to hand back task",
+				pid,
+				part,
+				zap.Error(err),
+			)
+			continue
+		}
+		zap.L().Info("task handed back", pid, part)
+	}
+}
+
+/*
+ * Run the worker until the shutdown context is cancelled. On shutdown, the
+ * worker stops reading new tasks and waits for up to drain for the in-flight
+ * tasks to complete, before handing the rest back to the job queue and
+ * leaving.
+ *
+ * The error is non-nil only if the job queue could not be read.
+ */
+func (w *Worker) Run(shutdown context.Context, drain time.Duration) error {
+	/*
+	 * The ctx is used for the queues and is never cancelled, so that
+	 * in-flight work can be completed and cleaned up after a shutdown is
+	 * requested.
+	 */
+	ctx := context.Background()
+	w.fetch.startWorkers()
+
+	for shutdown.Err() == nil {
+		/*
+		 * The read blocks for a short while only, so that the worker
+		 * regularly gets to check if it should shut down.
+		 *
+		 * Tasks that are read are always started, even if a shutdown has been
+		 * requested in the meantime. They are already removed from the job
+		 * queue, and would otherwise be lost.
+		 */
+		tasks, err := w.jobs.Read(ctx, w.consumer, 2 * time.Second)
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			w.start(task)
+		}
+	}
+
+	zap.L().Info(
+		"shutting down; waiting for in-flight tasks",
+		zap.Duration("timeout", drain),
+	)
+	unfinished := w.tasks.drain(drain)
+	w.handback(ctx, unfinished)
+	if w.callbacks != nil {
+		w.callbacks.Wait()
+	}
+
+	/*
+	 * Remove this consumer from the job queue, since it will never come back.
+	 * Consumer IDs are (usually) randomly generated per process, so a
+	 * restarted worker gets a new ID anyway.
+	 *
+	 * Should this fail (or the worker crash), the consumer is eventually
+	 * removed by the garbage collector.
+	 */
+	err := w.jobs.Leave(ctx, w.consumer)
+	if err != nil {
+		zap.L().Error("unable to leave job queue", zap.Error(err))
+	}
+	return nil
+}
@@ -7,13 +7,25 @@ require (
 	github.com/auth0/go-jwt-middleware/v2 v2.0.0
 	github.com/dgraph-io/ristretto v0.1.0
 	github.com/gin-gonic/gin v1.7.0
-	github.com/go-redis/redis/v8 v8.6.0
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.2.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/graph-gophers/graphql-go v1.3.0
 	github.com/jackc/pgx/v4 v4.15.0
+	github.com/klauspost/compress v1.13.4
+	github.com/nats-io/nats-server/v2 v2.7.0
+	github.com/nats-io/nats.go v1.13.1-0.20211122170419-d7c1d78a50fc
 	github.com/pborman/getopt/v2 v2.1.0
+	github.com/pierrec/lz4/v4 v4.1.17
+	github.com/prometheus/client_golang v1.11.0
 	github.com/stretchr/testify v1.7.0
 	github.com/vmihailenco/msgpack/v5 v5.2.3
+	go.opentelemetry.io/otel v1.3.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.3.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.3.0
+	go.opentelemetry.io/otel/sdk v1.3.0
+	go.opentelemetry.io/otel/trace v1.3.0
 	go.uber.org/zap v1.13.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/config"
+)
+
+/*
+ * The archive of finished results. Results are only kept in the result store
+ * (redis) for the retention of the process, which is short by design, since
+ * the results take up memory. When archiving is enabled the result service
+ * writes finished results to the archive, a container in object storage,
+ * from where they are served after the result store has expired them.
+ *
+ * Archived results are kept until they expire, which is decided when they are
+ * written. Object storage does not delete the results by itself, so expired
+ * results are not served, and should be cleaned up by a lifecycle management
+ * policy on the container.
+ */
+
+/*
+ * Returned by Get and Stat when the result is not archived, or has expired.
+ */
+var ErrNotFound = errors.New("not found")
+
+/*
+ * The size of an archived result, and when it expires.
+ */
+type Info struct {
+	Size    int64
+	Expires time.Time
+}
+
+/*
+ * Results can be large, so they are streamed both in and out of the archive,
+ * and never held in memory as a whole.
+ */
+type Archive interface {
+	/*
+	 * Archive the (complete) result of the process, read from result until
+	 * EOF, to be kept until expires. Archiving the result of a process again
+	 * replaces it. Should reading the result fail, nothing is archived.
+	 */
+	Put(
+		ctx     context.Context,
+		pid     string,
+		result  io.Reader,
+		expires time.Time,
+	) error
+	/*
+	 * Get length bytes of the result of the process, from offset. The caller
+	 * must close the reader. Returns ErrNotFound if it is not archived, or has
+	 * expired.
+	 */
+	Get(
+		ctx    context.Context,
+		pid    string,
+		offset int64,
+		length int64,
+	) (io.ReadCloser, error)
+	/*
+	 * The size of the archived result of the process, and when it expires.
+	 * Returns ErrNotFound if it is not archived, or has expired.
+	 */
+	Stat(ctx context.Context, pid string) (Info, error)
+}
+
+/*
+ * Open the archive, or nil if archiving is disabled.
+ */
+func Open(cfg config.Archive) (Archive, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	return NewBlobArchive(cfg.URL)
+}
@@ -0,0 +1,72 @@
+package archive
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryArchiveExpires(t *testing.T) {
+	ctx     := context.Background()
+	archive := NewMemoryArchive()
+	expires := time.Now().Add(time.Hour)
+	err := archive.Put(ctx, "pid", strings.NewReader("result"), expires)
+	assert.NoError(t, err)
+
+	body, err := archive.Get(ctx, "pid", 0, 6)
+	assert.NoError(t, err)
+	result, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("result"), result)
+	info, err := archive.Stat(ctx, "pid")
+	assert.NoError(t, err)
+	assert.Equal(t, Info { Size: 6, Expires: expires }, info)
+
+	expired := time.Now().Add(-time.Second)
+	err = archive.Put(ctx, "pid", strings.NewReader("result"), expired)
+	assert.NoError(t, err)
+	_, err = archive.Get(ctx, "pid", 0, 6)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = archive.Stat(ctx, "pid")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryArchiveGetsRange(t *testing.T) {
+	ctx     := context.Background()
+	archive := NewMemoryArchive()
+	err := archive.Put(
+		ctx,
+		"pid",
+		strings.NewReader("result"),
+		time.Now().Add(time.Hour),
+	)
+	assert.NoError(t, err)
+
+	body, err := archive.Get(ctx, "pid", 2, 3)
+	assert.NoError(t, err)
+	result, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("sul"), result)
+}
+
+func TestMemoryArchiveNotFound(t *testing.T) {
+	_, err := NewMemoryArchive().Get(context.Background(), "pid", 0, 1)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestExpiryFromMetadataIgnoresCase(t *testing.T) {
+	expected := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	for _, key := range []string { "expires", "Expires", "EXPIRES" } {
+		metadata := map[string]string { key: "2021-11-01T12:00:00Z" }
+		expires, err := expiry(metadata)
+		assert.NoError(t, err)
+		assert.True(t, expected.Equal(expires), "key = %s", key)
+	}
+
+	_, err := expiry(map[string]string{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+/*
+ * The archive as a blob container, one blob per process named by the pid.
+ * The container URL should include a shared access signature (SAS) with read
+ * and write permissions, since the archive is written by the result service
+ * itself, and not on behalf of a user.
+ *
+ * The expiry is stored in the blob metadata.
+ */
+type BlobArchive struct {
+	container azblob.ContainerClient
+}
+
+const expireskey = "expires"
+
+func NewBlobArchive(containerURL string) (*BlobArchive, error) {
+	container, err := azblob.NewContainerClientWithNoCredential(
+		containerURL,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobArchive { container: container }, nil
+}
+
+/*
+ * Map a not-found from the storage to ErrNotFound.
+ */
+func unpackError(err error) error {
+	err = util.UnpackAzStorageError(err)
+	if e, ok := err.(azblob.StorageError); ok {
+		if e.Response() != nil && e.Response().StatusCode == http.StatusNotFound {
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+/*
+ * Get the expiry from the blob metadata. The metadata keys are read back from
+ * the HTTP headers, which may have changed their case.
+ */
+func expiry(metadata map[string]string) (time.Time, error) {
+	for key, val := range metadata {
+		if strings.EqualFold(key, expireskey) {
+			return time.Parse(time.RFC3339, val)
+		}
+	}
+	return time.Time{}, fmt.Errorf("archived result without %s", expireskey)
+}
+
+/*
+ * The result is uploaded in blocks as it is read, and the blob is only
+ * committed once all of it is read. Should reading the result fail, the
+ * uncommitted blocks are left for the storage to garbage collect.
+ */
+func (b *BlobArchive) Put(
+	ctx     context.Context,
+	pid     string,
+	result  io.Reader,
+	expires time.Time,
+) error {
+	blob := b.container.NewBlockBlobClient(pid)
+	_, err := blob.UploadStreamToBlockBlob(
+		ctx,
+		result,
+		azblob.UploadStreamToBlockBlobOptions {
+			Metadata: map[string]string {
+				expireskey: expires.UTC().Format(time.RFC3339),
+			},
+		},
+	)
+	return util.UnpackAzStorageError(err)
+}
+
+func (b *BlobArchive) Get(
+	ctx    context.Context,
+	pid    string,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	blob := b.container.NewBlobClient(pid)
+	dl, err := blob.Download(ctx, &azblob.DownloadBlobOptions {
+		Offset: &offset,
+		Count:  &length,
+	})
+	if err != nil {
+		return nil, unpackError(err)
+	}
+	body := dl.Body(&azblob.RetryReaderOptions{})
+
+	expires, err := expiry(dl.Metadata)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if time.Now().After(expires) {
+		body.Close()
+		return nil, ErrNotFound
+	}
+	return body, nil
+}
+
+func (b *BlobArchive) Stat(ctx context.Context, pid string) (Info, error) {
+	blob := b.container.NewBlobClient(pid)
+	props, err := blob.GetProperties(ctx, nil)
+	if err != nil {
+		return Info{}, unpackError(err)
+	}
+	expires, err := expiry(props.Metadata)
+	if err != nil {
+		return Info{}, err
+	}
+	if time.Now().After(expires) {
+		return Info{}, ErrNotFound
+	}
+	if props.ContentLength == nil {
+		return Info{}, fmt.Errorf("archived result without size")
+	}
+	return Info { Size: *props.ContentLength, Expires: expires }, nil
+}
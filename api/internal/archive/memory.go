@@ -0,0 +1,91 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+type archived struct {
+	result  []byte
+	expires time.Time
+}
+
+/*
+ * An archive kept in memory, for tests.
+ */
+type MemoryArchive struct {
+	sync.Mutex
+	results map[string]archived
+}
+
+func NewMemoryArchive() *MemoryArchive {
+	return &MemoryArchive {
+		results: make(map[string]archived),
+	}
+}
+
+func (m *MemoryArchive) Put(
+	ctx     context.Context,
+	pid     string,
+	result  io.Reader,
+	expires time.Time,
+) error {
+	body, err := ioutil.ReadAll(result)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.results[pid] = archived { result: body, expires: expires }
+	return nil
+}
+
+/*
+ * Get the archived result, if it exists and has not expired.
+ *
+ * Must be called with the lock held.
+ */
+func (m *MemoryArchive) get(pid string) (archived, error) {
+	a, ok := m.results[pid]
+	if !ok || time.Now().After(a.expires) {
+		return archived{}, ErrNotFound
+	}
+	return a, nil
+}
+
+func (m *MemoryArchive) Get(
+	ctx    context.Context,
+	pid    string,
+	offset int64,
+	length int64,
+) (io.ReadCloser, error) {
+	m.Lock()
+	defer m.Unlock()
+	a, err := m.get(pid)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(a.result))
+	if offset > size {
+		offset = size
+	}
+	if offset + length < size {
+		size = offset + length
+	}
+	body := bytes.NewReader(a.result[offset:size])
+	return ioutil.NopCloser(body), nil
+}
+
+func (m *MemoryArchive) Stat(ctx context.Context, pid string) (Info, error) {
+	m.Lock()
+	defer m.Unlock()
+	a, err := m.get(pid)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info { Size: int64(len(a.result)), Expires: a.expires }, nil
+}
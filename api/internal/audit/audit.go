@@ -0,0 +1,261 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+)
+
+/*
+ * The audit log records who accessed what, as described in doc/Logging.md.
+ * It is separate from the operational log (see the logging package), both in
+ * content and in where it is written, so that it can be collected, retained
+ * and accessed independently, e.g. by compliance.
+ *
+ * Every request through the audit middleware results in exactly one entry,
+ * including requests that are denied or fail. Handlers and resolvers add to
+ * the entry through the Record found in the request context.
+ */
+
+/*
+ * The subject (user) of a request, as claimed by the token in the
+ * Authorization header. The object ID (oid) is the stable identifier, the
+ * user principal name (upn) is for humans.
+ */
+type Subject struct {
+	Oid string
+	Upn string
+}
+
+/*
+ * A query against a cube, i.e. the function (slice, curtain) and its
+ * arguments.
+ */
+type Query struct {
+	Guid     string      `json:"guid"`
+	Function string      `json:"function"`
+	Args     interface{} `json:"args"`
+}
+
+/*
+ * The record of a single request, which is built as the request is processed,
+ * and written when the request is completed. Graphql resolvers may run
+ * concurrently, so the record must be safe for concurrent use.
+ *
+ * All methods are safe to call on a nil record, which is a no-op. This is to
+ * not require the audit middleware in tests, or in services that don't audit.
+ */
+type Record struct {
+	sync.Mutex
+	subject Subject
+	guids   []string
+	queries []Query
+	errors  []string
+}
+
+type recordKey struct {}
+
+/*
+ * Store the record on the context, for retrieval with FromContext.
+ */
+func WithRecord(ctx context.Context, record *Record) context.Context {
+	return context.WithValue(ctx, recordKey{}, record)
+}
+
+/*
+ * Get the record from the context, or nil if there is none.
+ */
+func FromContext(ctx context.Context) *Record {
+	record, _ := ctx.Value(recordKey{}).(*Record)
+	return record
+}
+
+func (r *Record) Subject() Subject {
+	if r == nil {
+		return Subject{}
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.subject
+}
+
+/*
+ * Record that the cube guid was accessed. Reading metadata is accessing the
+ * cube too, even if no data is read.
+ */
+func (r *Record) AddCube(guid string) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, g := range r.guids {
+		if g == guid {
+			return
+		}
+	}
+	r.guids = append(r.guids, guid)
+}
+
+func (r *Record) AddQuery(guid, function string, args interface{}) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.queries = append(r.queries, Query {
+		Guid:     guid,
+		Function: function,
+		Args:     args,
+	})
+}
+
+/*
+ * Record an error that does not show up in the HTTP status code, e.g. errors
+ * in graphql responses which are always 200 OK.
+ */
+func (r *Record) AddError(err error) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.errors = append(r.errors, err.Error())
+}
+
+/*
+ * Get the subject from the (bearer) token in the Authorization header.
+ *
+ * The token is *not* validated here, which is the responsibility of the
+ * authorization middleware or, for query, blob storage. This is a record of
+ * what the user claimed to be, and the outcome of the request tells if that
+ * was accepted. Tokens that can't be parsed give an empty subject.
+ */
+func SubjectFromHeader(authorization string) Subject {
+	token := ""
+	_, err := fmt.Sscanf(authorization, "Bearer %s", &token)
+	if err != nil {
+		return Subject{}
+	}
+
+	claims := jwt.MapClaims{}
+	_, _, err = (&jwt.Parser{}).ParseUnverified(token, claims)
+	if err != nil {
+		return Subject{}
+	}
+
+	str := func(key string) string {
+		s, _ := claims[key].(string)
+		return s
+	}
+	oid := str("oid")
+	if oid == "" {
+		oid = str("sub")
+	}
+	return Subject {
+		Oid: oid,
+		Upn: str("upn"),
+	}
+}
+
+/*
+ * Open the audit log for the service. The sink is either "stdout", "stderr",
+ * a file path, or "none" which discards the audit log. The operational log is
+ * written to stderr, so stdout is a natural default for the audit log.
+ */
+func Open(service, sink string) (*zap.Logger, error) {
+	if sink == "none" {
+		return zap.NewNop(), nil
+	}
+
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	cfg.Sampling = nil
+	cfg.DisableCaller = true
+	cfg.DisableStacktrace = true
+	cfg.EncoderConfig.TimeKey = "time"
+	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	cfg.OutputPaths = []string{ sink }
+	return cfg.Build(zap.Fields(
+		zap.String("service", service),
+		zap.String("log", "audit"),
+	))
+}
+
+func outcome(status int, errors []string) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "denied"
+	case status >= 400 || len(errors) > 0:
+		return "failure"
+	default:
+		return "success"
+	}
+}
+
+/*
+ * The audit middleware. It should be registered before the authorization
+ * middleware, so that denied requests are recorded too.
+ *
+ * The subject is the user verified by the authorization middleware (see
+ * auth.VerifiedUser) when there is one, e.g. the user a shared result link
+ * (?key=) was signed on behalf of, and otherwise the subject claimed by the
+ * Authorization header.
+ *
+ * The pid is picked up from the gin context (see util.GeneratePID) or the
+ * path.
+ */
+func Middleware(logger *zap.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		record := &Record {
+			subject: SubjectFromHeader(ctx.GetHeader("Authorization")),
+		}
+		ctx.Request = ctx.Request.WithContext(
+			WithRecord(ctx.Request.Context(), record),
+		)
+		ctx.Next()
+
+		record.Lock()
+		defer record.Unlock()
+		if user := auth.VerifiedUser(ctx); user != (auth.User{}) {
+			record.subject = Subject { Oid: user.Oid, Upn: user.Upn }
+		}
+		pid := ctx.GetString("pid")
+		if pid == "" {
+			pid = ctx.Param("pid")
+		}
+		size := ctx.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		status := ctx.Writer.Status()
+		fields := []zap.Field {
+			zap.String("oid",      record.subject.Oid),
+			zap.String("upn",      record.subject.Upn),
+			zap.String("method",   ctx.Request.Method),
+			zap.String("endpoint", ctx.FullPath()),
+			zap.String("pid",      pid),
+			zap.Int("status",      status),
+			zap.String("outcome",  outcome(status, record.errors)),
+			zap.Int("bytes",       size),
+		}
+		if len(record.guids) > 0 {
+			fields = append(fields, zap.Strings("guids", record.guids))
+		}
+		if len(record.queries) > 0 {
+			fields = append(fields, zap.Any("queries", record.queries))
+		}
+		if len(record.errors) > 0 {
+			fields = append(fields, zap.Strings("errors", record.errors))
+		}
+		logger.Info("access", fields...)
+	}
+}
@@ -0,0 +1,191 @@
+package audit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+)
+
+func makeToken(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString([]byte("key"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return signed
+}
+
+func TestSubjectFromHeader(t *testing.T) {
+	token := makeToken(t, jwt.MapClaims {
+		"oid": "<oid>",
+		"upn": "user@example.com",
+	})
+	subject := SubjectFromHeader(fmt.Sprintf("Bearer %s", token))
+	expected := Subject { Oid: "<oid>", Upn: "user@example.com" }
+	if subject != expected {
+		t.Errorf("expected %v; got %v", expected, subject)
+	}
+}
+
+func TestSubjectFromHeaderFallsBackToSub(t *testing.T) {
+	token := makeToken(t, jwt.MapClaims { "sub": "<sub>" })
+	subject := SubjectFromHeader(fmt.Sprintf("Bearer %s", token))
+	if subject.Oid != "<sub>" {
+		t.Errorf("expected oid = <sub>; got %v", subject.Oid)
+	}
+}
+
+func TestSubjectFromBadHeaderIsEmpty(t *testing.T) {
+	headers := []string {
+		"",
+		"sans-token-type",
+		"Bearer not-a-jwt",
+	}
+	for _, header := range headers {
+		subject := SubjectFromHeader(header)
+		if subject != (Subject{}) {
+			t.Errorf("expected empty subject for %s; got %v", header, subject)
+		}
+	}
+}
+
+func TestNilRecordIsNoop(t *testing.T) {
+	var record *Record
+	record.AddCube("guid")
+	record.AddQuery("guid", "slice", nil)
+	record.AddError(fmt.Errorf("error"))
+	if record.Subject() != (Subject{}) {
+		t.Errorf("expected empty subject from nil record")
+	}
+}
+
+func serve(
+	t      *testing.T,
+	header string,
+	status int,
+	fn     func(*gin.Context),
+) observer.LoggedEntry {
+	core, logs := observer.New(zapcore.InfoLevel)
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(Middleware(zap.New(core)))
+	app.GET("/result/:pid", func(ctx *gin.Context) {
+		fn(ctx)
+		ctx.String(status, "0123456789")
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/some-pid", nil)
+	req.Header.Set("Authorization", header)
+	app.ServeHTTP(w, req)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry; got %d", len(entries))
+	}
+	return entries[0]
+}
+
+func TestMiddlewareRecordsAccess(t *testing.T) {
+	token := makeToken(t, jwt.MapClaims { "oid": "<oid>" })
+	entry := serve(t, fmt.Sprintf("Bearer %s", token), http.StatusOK,
+		func(ctx *gin.Context) {
+			record := FromContext(ctx.Request.Context())
+			record.AddCube("<guid>")
+			record.AddQuery("<guid>", "slice", map[string]int{ "dim": 0 })
+		},
+	)
+
+	fields := entry.ContextMap()
+	expected := map[string]interface{} {
+		"oid":      "<oid>",
+		"method":   "GET",
+		"endpoint": "/result/:pid",
+		"pid":      "some-pid",
+		"outcome":  "success",
+		"bytes":    int64(10),
+	}
+	for key, val := range expected {
+		if fields[key] != val {
+			t.Errorf("expected %s = %v; got %v", key, val, fields[key])
+		}
+	}
+	if _, ok := fields["queries"]; !ok {
+		t.Errorf("expected queries in audit entry; got %v", fields)
+	}
+}
+
+func TestMiddlewareRecordsOutcome(t *testing.T) {
+	noop := func(*gin.Context) {}
+	fails := func(ctx *gin.Context) {
+		FromContext(ctx.Request.Context()).AddError(fmt.Errorf("failed"))
+	}
+
+	cases := []struct {
+		status  int
+		fn      func(*gin.Context)
+		outcome string
+	} {
+		{ http.StatusOK,                  noop,  "success" },
+		{ http.StatusOK,                  fails, "failure" },
+		{ http.StatusForbidden,           noop,  "denied"  },
+		{ http.StatusUnauthorized,        noop,  "denied"  },
+		{ http.StatusNotFound,            noop,  "failure" },
+		{ http.StatusInternalServerError, noop,  "failure" },
+	}
+	for _, c := range cases {
+		entry := serve(t, "", c.status, c.fn)
+		outcome := entry.ContextMap()["outcome"]
+		if outcome != c.outcome {
+			t.Errorf(
+				"expected outcome = %s for %d; got %v",
+				c.outcome,
+				c.status,
+				outcome,
+			)
+		}
+	}
+}
+
+func TestMiddlewareRecordsVerifiedUserOfLink(t *testing.T) {
+	keyring := auth.MakeKeyring([]byte("key"))
+	key, err := keyring.SignOnBehalfOf("some-pid", "<oid>", "<upn>", time.Minute)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(Middleware(zap.New(core)))
+	app.GET("/result/:pid", auth.ResultAuth(&keyring), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "0123456789")
+	})
+
+	w := httptest.NewRecorder()
+	target := fmt.Sprintf("/result/some-pid?key=%s", key)
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", w.Code)
+	}
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry; got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["oid"] != "<oid>" || fields["upn"] != "<upn>" {
+		t.Errorf("expected the user of the link; got %v", fields)
+	}
+}
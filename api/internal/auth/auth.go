@@ -2,15 +2,20 @@ package auth
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
 
 	"github.com/auth0/go-jwt-middleware/v2"
 	jwkeyset "github.com/auth0/go-jwt-middleware/v2/jwks"
@@ -31,6 +36,36 @@ type Keyring struct {
 	key []byte
 }
 
+/*
+ * The user of a request, as verified from a token. The object ID (oid) is
+ * the stable identifier, and what per-user quotas are keyed on. The user
+ * principal name (upn) is for humans.
+ *
+ * Unlike the subject in the audit log, which is what the caller claimed to be,
+ * the user is only set when the token is verified, i.e. by ResultAuth and
+ * VerifyUser.
+ */
+type User struct {
+	Oid string
+	Upn string
+}
+
+const userKey = "verified-user"
+
+func setUser(ctx *gin.Context, user User) {
+	ctx.Set(userKey, user)
+}
+
+/*
+ * Get the verified user of the request, or the empty user if the request has
+ * no verified token.
+ */
+func VerifiedUser(ctx *gin.Context) User {
+	value, _ := ctx.Get(userKey)
+	user, _  := value.(User)
+	return user
+}
+
 /*
  * A stupid constructor function, really only to hide the key field and maybe
  * at some point do validation.
@@ -42,15 +77,60 @@ func MakeKeyring(key []byte) Keyring {
 }
 
 /*
- * Sign with the default timeout - in practice, this is the only sign function
- * there should be a need for, and gives a single point for updates, bugfixes
- * and reasonable configuration.
+ * Sign for the retention of the process, i.e. the token expires no later than
+ * the result it gives access to. The result is kept for the retention after
+ * the process is scheduled, which happens after the token is signed.
  */
-func (k *Keyring) Sign(pid string) (string, error) {
-	expiration := time.Now().Add(5 * time.Minute)
+func (k *Keyring) Sign(pid string, retention time.Duration) (string, error) {
+	expiration := time.Now().Add(retention)
 	return k.SignWithTimeout(pid, expiration)
 }
 
+/*
+ * Sign on behalf of a user. The user's object ID (oid) and principal name
+ * (upn) are included in the token, so that requests for the result can be
+ * attributed to the user that made the query, e.g. in the audit log.
+ */
+func (k *Keyring) SignOnBehalfOf(
+	pid       string,
+	oid       string,
+	upn       string,
+	retention time.Duration,
+) (string, error) {
+	user := User { Oid: oid, Upn: upn }
+	return k.sign(onBehalfOf(pid, user, time.Now().Add(retention)))
+}
+
+/*
+ * Sign the key of a shared link to the result of the process. The link is
+ * valid until expires, i.e. for as long as the archived result is, which is
+ * much longer than the retention of the process.
+ *
+ * The key is signed on behalf of the user that made the link, so that opening
+ * it is attributed to that user in the audit log, whoever it is shared with.
+ */
+func (k *Keyring) SignLink(
+	pid     string,
+	user    User,
+	expires time.Time,
+) (string, error) {
+	return k.sign(onBehalfOf(pid, user, expires))
+}
+
+func onBehalfOf(pid string, user User, exp time.Time) jwt.MapClaims {
+	claims := jwt.MapClaims {
+		"pid": pid,
+		"exp": exp.Unix(),
+	}
+	if user.Oid != "" {
+		claims["oid"] = user.Oid
+	}
+	if user.Upn != "" {
+		claims["upn"] = user.Upn
+	}
+	return claims
+}
+
 /*
  * Sign, but with a custom timeout. This function is largely an implementation
  * detail, and is intended for testing (e.g. creating already-expired tokens).
@@ -61,10 +141,14 @@ func (r *Keyring) SignWithTimeout(
 	pid string,
 	exp time.Time,
 ) (string, error) {
-	claims := &jwt.MapClaims {
+	claims := jwt.MapClaims {
 		"pid": pid,
 		"exp": exp.Unix(),
 	}
+	return r.sign(claims)
+}
+
+func (r *Keyring) sign(claims jwt.MapClaims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(r.key)
 }
@@ -74,6 +158,26 @@ func (r *Keyring) SignWithTimeout(
  * accessing the result and status of the process $pid.
  */
 func (r *Keyring) Validate(tokenstr string, pid string) error {
+	_, err := r.validate(tokenstr, pid)
+	return err
+}
+
+/*
+ * Validate, and get the user the token was signed on behalf of (see
+ * SignOnBehalfOf). The user is empty if the token was not signed on behalf of
+ * anyone.
+ */
+func (r *Keyring) ValidateUser(tokenstr string, pid string) (User, error) {
+	claims, err := r.validate(tokenstr, pid)
+	if err != nil {
+		return User{}, err
+	}
+	oid, _ := claims["oid"].(string)
+	upn, _ := claims["upn"].(string)
+	return User { Oid: oid, Upn: upn }, nil
+}
+
+func (r *Keyring) validate(tokenstr string, pid string) (jwt.MapClaims, error) {
 	/*
 	 * The jwt library is built around having multiple keys available, and
 	 * choosing the right one from the token header (see the key-id (kid) logic
@@ -88,7 +192,7 @@ func (r *Keyring) Validate(tokenstr string, pid string) error {
 	token, err := jwt.Parse(tokenstr, keyfunc)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if token.Valid {
@@ -105,7 +209,7 @@ func (r *Keyring) Validate(tokenstr string, pid string) error {
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
 			msg := "expected 'claims' of type jwt.MapClaims; was %T"
-			return fmt.Errorf(msg, claims)
+			return nil, fmt.Errorf(msg, claims)
 		}
 
 		/*
@@ -121,12 +225,40 @@ func (r *Keyring) Validate(tokenstr string, pid string) error {
 		 */
 		tokenpid := claims["pid"]
 		if tokenpid == pid {
-			return nil
+			return claims, nil
 		}
-		return fmt.Errorf("token with invalid pid; got %v", tokenpid)
+		return nil, fmt.Errorf("token with invalid pid; got %v", tokenpid)
 	}
 
-	return fmt.Errorf("Keyring.Validate fell through; This is a logic error")
+	return nil, fmt.Errorf("Keyring.Validate fell through; This is a logic error")
+}
+
+/*
+ * Sign an arbitrary payload, e.g. the body of a callback, rather than a
+ * token. The signature is the hex-encoded HMAC-SHA256 of the payload, which
+ * receivers that have the key can verify without parsing the payload first.
+ */
+func (r *Keyring) SignPayload(payload []byte) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Verify the signature of a payload, as made by SignPayload. Returns nil if,
+ * and only if, the payload was signed with the key of this keyring.
+ */
+func (r *Keyring) VerifyPayload(payload []byte, signature string) error {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
 }
 
 /*
@@ -142,13 +274,20 @@ func (r *Keyring) Validate(tokenstr string, pid string) error {
  *
  * That way, only the one who made the request can query the status or get the
  * result.
+ *
+ * Without an Authorization header, the token can be given as the key query
+ * parameter instead, so that links to (archived) results can be shared and
+ * opened in a browser.
  */
 func ResultAuth(keyring *Keyring) gin.HandlerFunc {
 	return func (ctx *gin.Context) {
 		pid := ctx.Param("pid")
 		authorization := ctx.GetHeader("Authorization")
+		if key := ctx.Query("key"); authorization == "" && key != "" {
+			authorization = fmt.Sprintf("Bearer %s", key)
+		}
 		if authorization == "" {
-			log.Printf("%s No Authorization header", pid)
+			zap.L().Info("no Authorization header", logging.Pid(pid))
 			/*
 			 * MDN docs
 			 * --------
@@ -165,10 +304,10 @@ func ResultAuth(keyring *Keyring) gin.HandlerFunc {
 		token := ""
 		_, err := fmt.Sscanf(authorization, "Bearer %s", &token)
 		if err != nil {
-			log.Printf(
-				"%s malformed header Authorization; was %s",
-				pid,
-				authorization,
+			zap.L().Info(
+				"malformed Authorization header",
+				logging.Pid(pid),
+				zap.String("authorization", authorization),
 			)
 			/*
 			 * Malformed authorization header - not quite sure if this is
@@ -180,11 +319,90 @@ func ResultAuth(keyring *Keyring) gin.HandlerFunc {
 			return
 		}
 
-		err = keyring.Validate(token, pid)
+		user, err := keyring.ValidateUser(token, pid)
 		if err != nil {
-			log.Printf("%s %v", pid, err)
+			zap.L().Info(
+				"token validation failed",
+				logging.Pid(pid),
+				zap.Error(err),
+			)
 			ctx.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		setUser(ctx, user)
+	}
+}
+
+/*
+ * The claims that identify the user in tokens from the OpenID Connect
+ * server, i.e. Azure AD.
+ */
+type userClaims struct {
+	Oid string `json:"oid"`
+	Upn string `json:"upn"`
+}
+
+func (*userClaims) Validate(context.Context) error {
+	return nil
+}
+
+/*
+ * Middleware that verifies the bearer token, if any, against the keys of the
+ * OpenID Connect server, and records the user (see VerifiedUser).
+ *
+ * Unlike JWTvalidation, requests without a token are let through with no
+ * user, since query is authorized by blob storage, either with the token or a
+ * shared access signature. A request with a token that cannot be verified is
+ * rejected, rather than let through with no user, since it would otherwise
+ * escape the per-user quotas.
+ */
+func VerifyUser(
+	issuer   string,
+	audience string,
+	keyFunc  func(context.Context) (interface{}, error),
+) gin.HandlerFunc {
+	customClaims := func() validator.CustomClaims {
+		return &userClaims{}
+	}
+
+	jwtValidator, err := validator.New(
+		keyFunc,
+		validator.RS256,
+		issuer,
+		[]string{audience},
+		validator.WithCustomClaims(customClaims),
+	)
+
+	if err != nil {
+		zap.L().Fatal("failed to setup JWT validator", zap.Error(err))
+	}
+
+	return func (ctx *gin.Context) {
+		token, err := jwtmiddleware.AuthHeaderTokenExtractor(ctx.Request)
+		if err != nil {
+			zap.L().Info("unable to extract token", zap.Error(err))
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if token == "" {
+			return
+		}
+		validated, err := jwtValidator.ValidateToken(
+			ctx.Request.Context(),
+			token,
+		)
+		if err != nil {
+			zap.L().Info("token validation failed", zap.Error(err))
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		claims := validated.(*validator.ValidatedClaims)
+		custom := claims.CustomClaims.(*userClaims)
+		oid    := custom.Oid
+		if oid == "" {
+			oid = claims.RegisteredClaims.Subject
 		}
+		setUser(ctx, User { Oid: oid, Upn: custom.Upn })
 	}
 }
 
@@ -219,7 +437,7 @@ func (c *CustomClaims) Validate(ctx context.Context) error {
 func GetJwksProvider(issuer string) *jwkeyset.CachingProvider {
 	issuerURL, err := url.Parse(issuer)
 	if err != nil {
-		log.Fatalf("failed to parse the issuer url: %v", err)
+		zap.L().Fatal("failed to parse the issuer url", zap.Error(err))
 	}
 	return jwkeyset.NewCachingProvider(issuerURL, 60*time.Minute)
 }
@@ -248,24 +466,24 @@ func JWTvalidation(
 	)
 
 	if err != nil {
-		log.Fatalf("failed to setup JWT validator: %v", err)
+		zap.L().Fatal("failed to setup JWT validator", zap.Error(err))
 	}
 
 	return func (ctx *gin.Context) {
 		token, err := jwtmiddleware.AuthHeaderTokenExtractor(ctx.Request)
 		if err != nil {
-			log.Println(err)
+			zap.L().Info("unable to extract token", zap.Error(err))
 			ctx.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 		if token == "" {
-			log.Println("Request without JWT in authorization header")
+			zap.L().Info("request without JWT in authorization header")
 			ctx.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
 		_, err = jwtValidator.ValidateToken(ctx.Request.Context(), token)
 		if err != nil {
-			log.Println(err)
+			zap.L().Info("token validation failed", zap.Error(err))
 			ctx.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
@@ -20,7 +20,7 @@ func TestTokenSignRoundTrip(t *testing.T) {
 	keyring := MakeKeyring(key)
 
 	pid := "pid"
-	token, err := keyring.Sign(pid)
+	token, err := keyring.Sign(pid, 5 * time.Minute)
 	if err != nil {
 		t.Fatalf("Error creating token; %v", err)
 	}
@@ -36,6 +36,28 @@ func TestTokenSignRoundTrip(t *testing.T) {
 	}
 }
 
+func TestPayloadSignRoundTrip(t *testing.T) {
+	keyring := MakeKeyring([]byte("pre-shared-key"))
+	payload := []byte(`{"pid":"pid","status":"finished"}`)
+
+	signature := keyring.SignPayload(payload)
+	err := keyring.VerifyPayload(payload, signature)
+	if err != nil {
+		t.Errorf("Expected valid signature; was %v", err)
+	}
+
+	err = keyring.VerifyPayload([]byte(`{"pid":"other"}`), signature)
+	if err == nil {
+		t.Errorf("Expected signature of other payload to be invalid")
+	}
+
+	other := MakeKeyring([]byte("other-key"))
+	err = other.VerifyPayload(payload, signature)
+	if err == nil {
+		t.Errorf("Expected signature with other key to be invalid")
+	}
+}
+
 func TestExpiredTokenIsInvalid(t *testing.T) {
 	key := []byte("pre-shared-key")
 	keyring := MakeKeyring(key)
@@ -58,7 +80,7 @@ func TestTokenInvalidPid(t *testing.T) {
 	keyring := MakeKeyring(key)
 
 	pid := "pid"
-	token, err := keyring.Sign(pid)
+	token, err := keyring.Sign(pid, 5 * time.Minute)
 	if err != nil {
 		t.Fatalf("Error creating token; %v", err)
 	}
@@ -69,6 +91,84 @@ func TestTokenInvalidPid(t *testing.T) {
 	}
 }
 
+func TestSignOnBehalfOfIncludesSubject(t *testing.T) {
+	key := []byte("pre-shared-key")
+	keyring := MakeKeyring(key)
+
+	token, err := keyring.SignOnBehalfOf(
+		"pid",
+		"<oid>",
+		"user@example.com",
+		5 * time.Minute,
+	)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	err = keyring.Validate(token, "pid")
+	if err != nil {
+		t.Fatalf("Expected valid token; got %v", err)
+	}
+
+	keyfunc := func (tok *jwt.Token) (interface {}, error) {
+		return key, nil
+	}
+	parsed, _ := jwt.Parse(token, keyfunc)
+	claims := parsed.Claims.(jwt.MapClaims)
+	if claims["oid"] != "<oid>" || claims["upn"] != "user@example.com" {
+		t.Errorf("Expected oid and upn claims; token was %v", claims)
+	}
+}
+
+func TestTokenExpiresWithRetention(t *testing.T) {
+	key := []byte("pre-shared-key")
+	keyring := MakeKeyring(key)
+
+	token, err := keyring.SignOnBehalfOf("pid", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	keyfunc := func (tok *jwt.Token) (interface {}, error) {
+		return key, nil
+	}
+	parsed, _ := jwt.Parse(token, keyfunc)
+	claims := parsed.Claims.(jwt.MapClaims)
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	if d := time.Until(exp); d < 59 * time.Minute || d > time.Hour {
+		t.Errorf("Expected token to expire in 1h; expires in %s", d)
+	}
+}
+
+func TestSignLinkExpiresWithArchive(t *testing.T) {
+	keyring := MakeKeyring([]byte("pre-shared-key"))
+	user    := User { Oid: "<oid>", Upn: "user@example.com" }
+	expires := time.Now().Add(7 * 24 * time.Hour)
+
+	token, err := keyring.SignLink("pid", user, expires)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	verified, err := keyring.ValidateUser(token, "pid")
+	if err != nil {
+		t.Fatalf("Expected valid token; got %v", err)
+	}
+	if verified != user {
+		t.Errorf("Expected user %v; got %v", user, verified)
+	}
+
+	keyfunc := func (tok *jwt.Token) (interface {}, error) {
+		return []byte("pre-shared-key"), nil
+	}
+	parsed, _ := jwt.Parse(token, keyfunc)
+	claims := parsed.Claims.(jwt.MapClaims)
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	if exp.Unix() != expires.Unix() {
+		t.Errorf("Expected token to expire at %s; expires at %s", expires, exp)
+	}
+}
+
 func TestValidTokenInvalidSignature(t *testing.T) {
 	pid := "pid"
 	/*
@@ -77,7 +177,7 @@ func TestValidTokenInvalidSignature(t *testing.T) {
 	 * implementation
 	 */
 	keyringA := MakeKeyring([]byte("pre-shared-key"))
-	token, err := keyringA.Sign(pid)
+	token, err := keyringA.Sign(pid, 5 * time.Minute)
 	if err != nil {
 		t.Fatalf("Error creating token; %v", err)
 	}
@@ -91,7 +191,7 @@ func TestValidTokenInvalidSignature(t *testing.T) {
 
 func TestResultAuthTokens(t *testing.T) {
 	keyring := MakeKeyring([]byte("psk"))
-	good, err := keyring.Sign("pid")
+	good, err := keyring.Sign("pid", 5 * time.Minute)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -128,6 +228,39 @@ func TestResultAuthTokens(t *testing.T) {
 	}
 }
 
+func TestResultAuthKeyParameter(t *testing.T) {
+	keyring := MakeKeyring([]byte("psk"))
+	good, err := keyring.Sign("pid", 5 * time.Minute)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	keys := map[string]int {
+		fmt.Sprintf("/result/pid?key=%s", good): http.StatusOK,
+		"/result/pid?key=bad-key":               http.StatusForbidden,
+		"/result/pid?key=":                      http.StatusUnauthorized,
+	}
+
+	authfn := ResultAuth(&keyring)
+	for target, expected := range keys {
+		w := httptest.NewRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/result/:pid", authfn)
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		r.ServeHTTP(w, req)
+		if w.Result().StatusCode != expected {
+			msg := "Got %v for %s; want %d %s"
+			t.Errorf(
+				msg,
+				w.Result().Status,
+				target,
+				expected,
+				http.StatusText(expected),
+			)
+		}
+	}
+}
+
 func TestJWTValidation(t *testing.T) {
 	hs256key := []byte("secret")
 	
@@ -325,3 +458,100 @@ func TestJWTValidation(t *testing.T) {
 		}
 	}
 }
+
+func TestVerifyUser(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		log.Fatal("failed to generate key")
+	}
+	keyFunc := func (context.Context) (interface{}, error) {
+		return &key.PublicKey, nil
+	}
+	sign := func(key interface{}, alg jwt.SigningMethod, oid string) string {
+		token, err := jwt.NewWithClaims(alg, jwt.MapClaims{
+			"iss" : "valid issuer",
+			"aud" : "valid audience",
+			"sub" : "subject",
+			"oid" : oid,
+			"upn" : "user@example.com",
+			"exp" : time.Now().Add(time.Minute *  1).Unix(),
+			"iat" : time.Now().Add(time.Second * -1).Unix(),
+		}).SignedString(key)
+		if err != nil {
+			log.Fatalf("Invalid token, %v", err)
+		}
+		return token
+	}
+
+	testcases := []struct{
+		name     string
+		token    string
+		expected int
+		user     User
+	}{
+		{
+			name:     "No token",
+			token:    "nil",
+			expected: http.StatusOK,
+		},
+		{
+			name:     "Bad token",
+			token:    "bad token",
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "Forged token",
+			token:    sign([]byte("secret"), jwt.SigningMethodHS256, "oid"),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "Valid token",
+			token:    sign(key, jwt.SigningMethodRS256, "oid"),
+			expected: http.StatusOK,
+			user:     User { Oid: "oid", Upn: "user@example.com" },
+		},
+		{
+			name:     "Valid token without oid",
+			token:    sign(key, jwt.SigningMethodRS256, ""),
+			expected: http.StatusOK,
+			user:     User { Oid: "subject", Upn: "user@example.com" },
+		},
+	}
+
+	for _, testcase := range testcases {
+		w := httptest.NewRecorder()
+		_, r := gin.CreateTestContext(w)
+
+		var user User
+		r.GET(
+			"/graphql",
+			VerifyUser("valid issuer", "valid audience", keyFunc),
+			func (ctx *gin.Context) { user = VerifiedUser(ctx) },
+		)
+		req, _ := http.NewRequest(http.MethodGet, "/graphql", nil)
+		if testcase.token != "nil" {
+			req.Header.Add(
+				"Authorization",
+				fmt.Sprintf("Bearer %s", testcase.token),
+			)
+		}
+
+		r.ServeHTTP(w, req)
+		if w.Result().StatusCode != testcase.expected {
+			t.Errorf(
+				"Got %v; want %d in case '%s'",
+				w.Result().Status,
+				testcase.expected,
+				testcase.name,
+			)
+		}
+		if user != testcase.user {
+			t.Errorf(
+				"Got user %v; want %v in case '%s'",
+				user,
+				testcase.user,
+				testcase.name,
+			)
+		}
+	}
+}
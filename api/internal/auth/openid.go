@@ -5,9 +5,10 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math/big"
 	"net/http"
+
+	"go.uber.org/zap"
 )
 
 /*
@@ -220,21 +221,35 @@ func GetOpenIDConfig(c HttpClient, authserver string) (*OpenIDConfig, error) {
 			 * so skip it and look for other viable keys.
 			 */
 	                if key.E == "" {
-				log.Printf("missing field 'e'")
+				zap.L().Warn(
+					"skipping key: missing field 'e'",
+					zap.String("kid", key.Kid),
+				)
 				continue
 	                }
 	                if key.N == "" {
-				log.Printf("missing field 'n'")
+				zap.L().Warn(
+					"skipping key: missing field 'n'",
+					zap.String("kid", key.Kid),
+				)
 				continue
 	                }
 			e, err := fromB64(key.E)
 			if err != nil {
-				log.Printf("Key.E (id = %s): %v", key.Kid, err)
+				zap.L().Warn(
+					"skipping key: bad Key.E",
+					zap.String("kid", key.Kid),
+					zap.Error(err),
+				)
 				continue
 			}
 			n, err := fromB64(key.N)
 			if err != nil {
-				log.Printf("Key.N (id = %s): %v", key.Kid, err)
+				zap.L().Warn(
+					"skipping key: bad Key.N",
+					zap.String("kid", key.Kid),
+					zap.Error(err),
+				)
 				continue
 			}
 
@@ -248,7 +263,7 @@ func GetOpenIDConfig(c HttpClient, authserver string) (*OpenIDConfig, error) {
 	err = nil
 	if len(keys) == 0 {
 		err = &noRSAKeys{}
-		log.Printf("Keyset: %v", keyset)
+		zap.L().Error("no RSA keys in keyset", zap.Any("keyset", keyset))
 	}
 
 	return &OpenIDConfig {
@@ -0,0 +1,258 @@
+package callback
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/logging"
+)
+
+/*
+ * Completion callbacks (webhooks). Rather than polling the status of a
+ * process, a caller can give a callback URL with the query, and the fetch
+ * worker that writes the last part of the result POSTs the outcome of the
+ * process to it:
+ *
+ *     {"pid": "...", "status": "finished", "location": "result/<pid>"}
+ *     {"pid": "...", "status": "failed"}
+ *
+ * The body is signed with the callback key, and the signature is sent in the
+ * Oneseismic-Signature header as sha256=<hex>, the hex-encoded HMAC-SHA256 of
+ * the body (see auth.Keyring.SignPayload). Receivers that have the key should
+ * verify the signature before trusting the body.
+ *
+ * A process is called back once, finished or failed, by the worker that
+ * claims the callback in the result store (see queue.Results.Claim). Failed
+ * deliveries are retried with exponential backoff, and a retry can arrive
+ * twice should the receiver get the body but the response be lost, so
+ * receivers should be idempotent on the pid.
+ *
+ * Callbacks are only sent to the configured hosts, so that the workers cannot
+ * be used to make requests to arbitrary (e.g. internal) services.
+ */
+
+const SignatureHeader = "Oneseismic-Signature"
+
+type Payload struct {
+	Pid      string `json:"pid"`
+	Status   string `json:"status"`
+	Location string `json:"location,omitempty"`
+}
+
+/*
+ * The hosts callbacks can be sent to, as host or host:port. A host without a
+ * port allows any port, and * allows any host.
+ */
+type Hosts []string
+
+func ParseHosts(hosts string) Hosts {
+	var h Hosts
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			h = append(h, host)
+		}
+	}
+	return h
+}
+
+func (h Hosts) allows(u *url.URL) bool {
+	host := strings.ToLower(u.Host)
+	name := strings.ToLower(u.Hostname())
+	for _, allowed := range h {
+		if allowed == "*" || allowed == host || allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Check that the callback is an absolute http(s) URL to one of the hosts.
+ */
+func (h Hosts) Check(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return fmt.Errorf("malformed callback: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback must be http or https; was %s", callback)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("callback must be an absolute URL; was %s", callback)
+	}
+	if !h.allows(u) {
+		return fmt.Errorf("callback host %s is not allowed", u.Host)
+	}
+	return nil
+}
+
+/*
+ * The default number of attempts, and the wait before the first retry, which
+ * is doubled for every retry. The last attempt is made about 15s after the
+ * first.
+ */
+const (
+	DefaultAttempts = 5
+	DefaultBackoff  = time.Second
+)
+
+/*
+ * The Sender signs and delivers callbacks in the background.
+ */
+type Sender struct {
+	keyring  auth.Keyring
+	hosts    Hosts
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	wg       sync.WaitGroup
+}
+
+func NewSender(keyring auth.Keyring, hosts Hosts) *Sender {
+	return &Sender {
+		keyring:  keyring,
+		hosts:    hosts,
+		client:   &http.Client { Timeout: 10 * time.Second },
+		attempts: DefaultAttempts,
+		backoff:  DefaultBackoff,
+	}
+}
+
+/*
+ * Open the sender, or nil if callbacks are disabled.
+ */
+func Open(cfg config.Callback) *Sender {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return NewSender(auth.MakeKeyring([]byte(cfg.Key)), ParseHosts(cfg.Hosts))
+}
+
+/*
+ * Set the number of attempts, and the wait before the first retry. This is
+ * mostly for tests, which should not wait for seconds.
+ */
+func (s *Sender) SetRetries(attempts int, backoff time.Duration) {
+	s.attempts = attempts
+	s.backoff  = backoff
+}
+
+/*
+ * Send the payload to the callback in the background. Failures are logged,
+ * and never reported to the caller.
+ */
+func (s *Sender) Send(callback string, payload Payload) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.deliver(context.Background(), callback, payload)
+	}()
+}
+
+/*
+ * Wait for the callbacks in flight to be delivered, or given up on.
+ */
+func (s *Sender) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Sender) deliver(
+	ctx      context.Context,
+	callback string,
+	payload  Payload,
+) {
+	fields := []zap.Field {
+		logging.Pid(payload.Pid),
+		zap.String("callback", callback),
+		zap.String("status", payload.Status),
+	}
+	/*
+	 * The callback was checked by the query service, but the hosts are
+	 * checked again since the task could come from anywhere that can write to
+	 * the job queue.
+	 */
+	if err := s.hosts.Check(callback); err != nil {
+		zap.L().Error("dropping callback", append(fields, zap.Error(err))...)
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		zap.L().Error("dropping callback", append(fields, zap.Error(err))...)
+		return
+	}
+	signature := fmt.Sprintf("sha256=%s", s.keyring.SignPayload(body))
+
+	wait := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := s.post(ctx, callback, body, signature)
+		if err == nil {
+			zap.L().Info(
+				"callback delivered",
+				append(fields, zap.Int("attempt", attempt))...,
+			)
+			return
+		}
+		if attempt >= s.attempts {
+			zap.L().Error(
+				"callback not delivered; giving up",
+				append(fields, zap.Int("attempt", attempt), zap.Error(err))...,
+			)
+			return
+		}
+		zap.L().Warn(
+			"callback failed; retrying",
+			append(
+				fields,
+				zap.Int("attempt", attempt),
+				zap.Duration("backoff", wait),
+				zap.Error(err),
+			)...,
+		)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+/*
+ * POST the body once. Any 2xx response is a delivery, and everything else is
+ * retried.
+ */
+func (s *Sender) post(
+	ctx       context.Context,
+	callback  string,
+	body      []byte,
+	signature string,
+) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		callback,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package callback
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+)
+
+func TestHostsCheckCallbacks(t *testing.T) {
+	hosts := ParseHosts(" hooks.example.com , localhost:9000")
+	assert.NoError(t, hosts.Check("https://hooks.example.com/done"))
+	assert.NoError(t, hosts.Check("http://HOOKS.example.com:8080/done"))
+	assert.NoError(t, hosts.Check("http://localhost:9000/done"))
+
+	assert.Error(t, hosts.Check("http://localhost:9001/done"))
+	assert.Error(t, hosts.Check("https://other.example.com/done"))
+	assert.Error(t, hosts.Check("ftp://hooks.example.com/done"))
+	assert.Error(t, hosts.Check("/done"))
+	assert.Error(t, hosts.Check("::"))
+
+	anyhost := ParseHosts("*")
+	assert.NoError(t, anyhost.Check("https://other.example.com/done"))
+	assert.Error(t, anyhost.Check("file:///etc/passwd"))
+
+	var none Hosts
+	assert.Error(t, none.Check("https://hooks.example.com/done"))
+}
+
+/*
+ * A receiver that records the callbacks, and fails the first failures of
+ * them.
+ */
+type receiver struct {
+	sync.Mutex
+	failures   int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.Lock()
+	defer r.Unlock()
+	r.bodies     = append(r.bodies, body)
+	r.signatures = append(r.signatures, req.Header.Get(SignatureHeader))
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newSender(t *testing.T, srv *httptest.Server, keyring auth.Keyring) *Sender {
+	u, err := url.Parse(srv.URL)
+	assert.NoError(t, err)
+	sender := NewSender(keyring, Hosts { u.Host })
+	sender.SetRetries(3, time.Millisecond)
+	return sender
+}
+
+func TestCallbackIsSignedAndDelivered(t *testing.T) {
+	keyring := auth.MakeKeyring([]byte("callback-key"))
+	rcv := &receiver {}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	sender := newSender(t, srv, keyring)
+	sender.Send(srv.URL + "/done", Payload {
+		Pid:      "pid-0",
+		Status:   "finished",
+		Location: "result/pid-0",
+	})
+	sender.Wait()
+
+	assert.Len(t, rcv.bodies, 1)
+	payload := Payload {}
+	assert.NoError(t, json.Unmarshal(rcv.bodies[0], &payload))
+	assert.Equal(t, "pid-0",        payload.Pid)
+	assert.Equal(t, "finished",     payload.Status)
+	assert.Equal(t, "result/pid-0", payload.Location)
+
+	signature := strings.TrimPrefix(rcv.signatures[0], "sha256=")
+	assert.NoError(t, keyring.VerifyPayload(rcv.bodies[0], signature))
+}
+
+func TestFailedCallbackIsRetried(t *testing.T) {
+	rcv := &receiver { failures: 2 }
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	sender := newSender(t, srv, auth.MakeKeyring([]byte("callback-key")))
+	sender.Send(srv.URL, Payload { Pid: "pid-0", Status: "finished" })
+	sender.Wait()
+
+	assert.Len(t, rcv.bodies, 3)
+	assert.Equal(t, rcv.bodies[0], rcv.bodies[2])
+	assert.Equal(t, 0, rcv.failures)
+}
+
+func TestCallbackIsGivenUpOn(t *testing.T) {
+	rcv := &receiver { failures: 10 }
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	sender := newSender(t, srv, auth.MakeKeyring([]byte("callback-key")))
+	sender.Send(srv.URL, Payload { Pid: "pid-0", Status: "finished" })
+	sender.Wait()
+
+	assert.Len(t, rcv.bodies, 3)
+}
+
+func TestCallbackToOtherHostIsDropped(t *testing.T) {
+	rcv := &receiver {}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	keyring := auth.MakeKeyring([]byte("callback-key"))
+	sender  := NewSender(keyring, Hosts { "hooks.example.com" })
+	sender.Send(srv.URL, Payload { Pid: "pid-0", Status: "finished" })
+	sender.Wait()
+
+	assert.Len(t, rcv.bodies, 0)
+}
@@ -0,0 +1,512 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Configuration for the oneseismic binaries, as described in doc/Config.md.
+ *
+ * Every binary describes its configuration as a struct, with the defaults set
+ * before calling Load(). Options are read from (in order of increasing
+ * precedence):
+ *
+ * 1. the YAML config file given by --config or ONESEISMIC_CONFIG
+ * 2. the environment
+ * 3. the command line
+ *
+ * The fields are described with struct tags:
+ *
+ *     yaml:"name"      key in the config file, and the long option name
+ *     env:"NAME"       environment variable, if any
+ *     short:"c"        short option, if any
+ *     help:"text"      help text for --help
+ *     required:"true"  the option must be set (non-zero) after loading
+ *     secret:"true"    redact the value in Redacted()
+ *     secret:"userinfo" redact the user and password of the URL (or the
+ *                      comma-separated URLs) in Redacted()
+ *
+ * Groups of options that are shared between binaries (e.g. Redis) are
+ * embedded structs, which should be tagged yaml:",inline". Groups can
+ * implement Validator, which is then responsible for validating the groups
+ * embedded in it.
+ *
+ * Supported field types are string, bool, int and time.Duration.
+ */
+
+/*
+ * Configuration structs that implement Validator are validated after loading,
+ * in addition to the required check.
+ */
+type Validator interface {
+	Validate() error
+}
+
+/*
+ * Options shared by all binaries that connect to Redis. See the redisclient
+ * package for how they are used.
+ *
+ * The redis-url is required, but not tagged as such since redis is optional
+ * when it is embedded in the Queue options.
+ */
+type Redis struct {
+	URL              string `yaml:"redis-url"               env:"REDIS_URL"               help:"Redis address (host:port) or URL (redis://[user:password@]host:port[/db], or rediss:// for TLS). A comma-separated list of addresses for sentinel and cluster mode" secret:"userinfo"`
+	Mode             string `yaml:"redis-mode"              env:"REDIS_MODE"              help:"One of standalone, sentinel, cluster. Defaults to standalone"`
+	Username         string `yaml:"redis-username"          env:"REDIS_USERNAME"          help:"Redis ACL username. Overrides the username in the URL"`
+	Password         string `yaml:"redis-password"          env:"REDIS_PASSWORD"          help:"Redis password. Overrides the password in the URL. Empty by default" secret:"true" short:"P"`
+	DB               int    `yaml:"redis-db"                env:"REDIS_DB"                help:"Redis database. Overrides the database in the URL. Not supported in cluster mode"`
+	MasterName       string `yaml:"redis-master"            env:"REDIS_MASTER"            help:"Name of the master set, for sentinel mode"`
+	SentinelPassword string `yaml:"redis-sentinel-password" env:"REDIS_SENTINEL_PASSWORD" help:"Password for the sentinels, if different from the Redis password" secret:"true"`
+	Secure           bool   `yaml:"secureConnections"       env:"REDIS_SECURE"            help:"Connect to Redis securely (TLS)"`
+	CA               string `yaml:"redis-ca"                env:"REDIS_CA"                help:"PEM file with the certificate authorities to verify Redis with, instead of the system CAs. Implies TLS"`
+	Cert             string `yaml:"redis-cert"              env:"REDIS_CERT"              help:"PEM file with the client certificate. Implies TLS"`
+	Key              string `yaml:"redis-key"               env:"REDIS_KEY"               help:"PEM file with the client certificate key"`
+}
+
+func (r *Redis) Validate() error {
+	if r.URL == "" {
+		return fmt.Errorf("missing required option redis-url (or REDIS_URL)")
+	}
+	return nil
+}
+
+/*
+ * Options shared by the binaries that use the job queue and result store. See
+ * the queue package for how they are used.
+ */
+type Queue struct {
+	Backend string `yaml:"queue"    env:"QUEUE"    help:"Queue backend; one of redis, nats. Defaults to redis"`
+	NatsURL string `yaml:"nats-url" env:"NATS_URL" help:"NATS server URL, or a comma-separated list of URLs, for the nats queue backend" secret:"userinfo"`
+	Redis   `yaml:",inline"`
+}
+
+func (q *Queue) Validate() error {
+	switch q.Backend {
+	case "", "redis":
+		return q.Redis.Validate()
+	case "nats":
+		if q.NatsURL == "" {
+			return fmt.Errorf("missing required option nats-url (or NATS_URL)")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown queue %s; want redis or nats", q.Backend)
+	}
+}
+
+/*
+ * Per-user quotas, shared by the binaries that admit processes (query), mark
+ * tasks as done (fetch) and serve results (result), which must all agree. See
+ * the quota package for how they are used.
+ */
+type Quota struct {
+	Processes int           `yaml:"quota-processes" env:"QUOTA_PROCESSES" help:"Max concurrent processes per user. 0 is unlimited"`
+	Tasks     int           `yaml:"quota-tasks"     env:"QUOTA_TASKS"     help:"Max tasks not yet done per user, across all processes. 0 is unlimited"`
+	Bytes     int           `yaml:"quota-bytes"     env:"QUOTA_BYTES"     help:"Max bytes served per user per quota-window. 0 is unlimited"`
+	Window    time.Duration `yaml:"quota-window"    env:"QUOTA_WINDOW"    help:"The window of quota-bytes. Defaults to 1h"`
+	FairShare int           `yaml:"fair-share"      env:"FAIR_SHARE"      help:"Max tasks per user in the job queue at once. The rest are held back until the user's tasks are done, so that one user cannot monopolise the fetch workers. The share of query applies, but fetch only releases held-back tasks with quotas enabled, e.g. fair-share set too. 0 disables"`
+}
+
+func DefaultQuota() Quota {
+	return Quota { Window: time.Hour }
+}
+
+/*
+ * Quotas are enabled if any limit is set, or tasks are fairly shared.
+ */
+func (q *Quota) Enabled() bool {
+	return q.Processes > 0 || q.Tasks > 0 || q.Bytes > 0 || q.FairShare > 0
+}
+
+func (q *Quota) Validate() error {
+	if q.Bytes > 0 && q.Window <= 0 {
+		return fmt.Errorf("quota-bytes requires a positive quota-window")
+	}
+	return nil
+}
+
+/*
+ * How long the results of a process are kept. The process header, the parts,
+ * and the tokens handed out for the result all share this retention, so that
+ * a token is never valid for longer than the data it gives access to.
+ */
+type Retention struct {
+	Duration time.Duration `yaml:"retention" env:"RETENTION" help:"How long results are kept, and how long result tokens are valid. Queries can ask for a shorter retention. Defaults to 10m"`
+}
+
+func DefaultRetention() Retention {
+	return Retention { Duration: 10 * time.Minute }
+}
+
+func (r *Retention) Validate() error {
+	if r.Duration <= 0 {
+		return fmt.Errorf("retention must be positive; was %s", r.Duration)
+	}
+	return nil
+}
+
+/*
+ * The archive of finished results in object storage (see internal/archive),
+ * which keeps results for longer than the retention. Disabled unless the
+ * archive-url is set.
+ */
+type Archive struct {
+	URL       string        `yaml:"archive-url"       env:"ARCHIVE_URL"       help:"URL of the container to archive finished results in, with a shared access signature (SAS) that allows read and write. Disabled if not set" secret:"true"`
+	Retention time.Duration `yaml:"archive-retention" env:"ARCHIVE_RETENTION" help:"How long archived results are kept, and how long the links to them are valid. Defaults to 168h (7 days)"`
+}
+
+func DefaultArchive() Archive {
+	return Archive { Retention: 7 * 24 * time.Hour }
+}
+
+func (a *Archive) Enabled() bool {
+	return a.URL != ""
+}
+
+func (a *Archive) Validate() error {
+	if a.Enabled() && a.Retention <= 0 {
+		return fmt.Errorf("archive-retention must be positive; was %s", a.Retention)
+	}
+	return nil
+}
+
+/*
+ * Completion callbacks, which are POSTed to a URL given in the query when the
+ * process is done (see internal/callback). The query service checks the URL
+ * against the hosts, and the fetch workers sign and send the callbacks.
+ * Disabled unless the callback-key is set.
+ */
+type Callback struct {
+	Key   string `yaml:"callback-key"   env:"CALLBACK_KEY"   help:"Key to sign completion callbacks with, so that receivers can verify them. This should not be the sign-key, which must be kept secret. Callbacks are disabled if not set" secret:"true"`
+	Hosts string `yaml:"callback-hosts" env:"CALLBACK_HOSTS" help:"Comma-separated list of the hosts (host or host:port) callbacks can be sent to, or * for any host. Queries cannot ask for callbacks if not set. Required with callback-key"`
+}
+
+func (c *Callback) Enabled() bool {
+	return c.Key != ""
+}
+
+func (c *Callback) Validate() error {
+	if c.Enabled() && strings.TrimSpace(c.Hosts) == "" {
+		return fmt.Errorf("callback-hosts must be set with callback-key")
+	}
+	return nil
+}
+
+/*
+ * Compression of the responses from /result, which is negotiated with the
+ * client (see util.Compression).
+ */
+type Compression struct {
+	ZstdLevel int `yaml:"zstd-level" env:"ZSTD_LEVEL" help:"Compression level of zstd responses, from 1 (fastest) to 22 (best). Defaults to 1"`
+}
+
+func DefaultCompression() Compression {
+	return Compression { ZstdLevel: 1 }
+}
+
+func (c *Compression) Validate() error {
+	if c.ZstdLevel < 1 || c.ZstdLevel > 22 {
+		return fmt.Errorf("zstd-level must be in [1, 22]; was %d", c.ZstdLevel)
+	}
+	return nil
+}
+
+/*
+ * Options shared by the HTTP services.
+ */
+type Server struct {
+	Port  int           `yaml:"port"             env:"PORT"             help:"Port to start server on. Defaults to 8080" short:"p"`
+	Drain time.Duration `yaml:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" help:"On shutdown, wait this long for active requests to complete before closing connections. Defaults to 20s"`
+}
+
+func DefaultServer() Server {
+	return Server {
+		Port:  8080,
+		Drain: 20 * time.Second,
+	}
+}
+
+/*
+ * Options shared by the binaries that export traces.
+ */
+type Tracing struct {
+	Exporter     string `yaml:"tracing"       env:"TRACING"       help:"Trace exporter; one of none, stdout, otlp. Defaults to none"`
+	OtlpEndpoint string `yaml:"otlp-endpoint" env:"OTLP_ENDPOINT" help:"OTLP/HTTP endpoint (host:port) for the otlp trace exporter. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318"`
+}
+
+func DefaultTracing() Tracing {
+	return Tracing { Exporter: "none" }
+}
+
+/*
+ * A field in the configuration struct, flattened from the embedded groups.
+ */
+type field struct {
+	value reflect.Value
+	tag   reflect.StructTag
+	name  string
+}
+
+func fields(v reflect.Value) []field {
+	out := []field{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			out = append(out, fields(v.Field(i))...)
+			continue
+		}
+		name := f.Tag.Get("yaml")
+		if name == "" || name == "-" {
+			continue
+		}
+		out = append(out, field {
+			value: v.Field(i),
+			tag:   f.Tag,
+			name:  name,
+		})
+	}
+	return out
+}
+
+func structof(cfg interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return v, fmt.Errorf("config must be a pointer to struct; was %T", cfg)
+	}
+	return v.Elem(), nil
+}
+
+/*
+ * Set the field from its string representation, as it would be in the
+ * environment.
+ */
+func (f *field) set(s string) error {
+	switch p := f.value.Addr().Interface().(type) {
+	case *string:
+		*p = s
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		*p = b
+	case *int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		*p = i
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		*p = d
+	default:
+		return fmt.Errorf("%s: unsupported type %T", f.name, p)
+	}
+	return nil
+}
+
+/*
+ * Load the configuration from the config file, environment and command line,
+ * and validate it. On --help, the usage is printed and the program exits.
+ */
+func Load(cfg interface{}) error {
+	help, err := load(cfg, os.Args, os.Getenv)
+	if help != nil {
+		help.PrintUsage(os.Stdout)
+		os.Exit(0)
+	}
+	return err
+}
+
+func load(
+	cfg    interface{},
+	args   []string,
+	getenv func(string) string,
+) (*getopt.Set, error) {
+	v, err := structof(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fs := fields(v)
+
+	/*
+	 * The command line is parsed first to find the config file, but applied
+	 * last. The options are parsed into copies of the fields, which start
+	 * out with the defaults so that they show up in --help.
+	 */
+	set := getopt.New()
+	if len(args) > 0 {
+		set.SetProgram(filepath.Base(args[0]))
+	}
+	help := set.BoolLong("help", 0, "print this help text")
+	path := set.StringLong(
+		"config",
+		0,
+		getenv("ONESEISMIC_CONFIG"),
+		"YAML config file. Defaults to ONESEISMIC_CONFIG",
+		"path",
+	)
+	options := make([]getopt.Option, len(fs))
+	copies  := make([]reflect.Value, len(fs))
+	for i, f := range fs {
+		copies[i] = reflect.New(f.value.Type())
+		copies[i].Elem().Set(f.value)
+
+		short := rune(0)
+		if s := f.tag.Get("short"); s != "" {
+			short = rune(s[0])
+		}
+		help := f.tag.Get("help")
+		if env := f.tag.Get("env"); env != "" {
+			help = fmt.Sprintf("%s [%s]", help, env)
+		}
+		options[i] = set.FlagLong(copies[i].Interface(), f.name, short, help)
+	}
+	err = set.Getopt(args, nil)
+	if err != nil {
+		return nil, err
+	}
+	if *help {
+		return set, nil
+	}
+
+	if *path != "" {
+		doc, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config: %w", err)
+		}
+		err = yaml.UnmarshalStrict(doc, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse config %s: %w", *path, err)
+		}
+	}
+
+	for _, f := range fs {
+		env := f.tag.Get("env")
+		if env == "" {
+			continue
+		}
+		if s, ok := lookup(getenv, env); ok {
+			if err := f.set(s); err != nil {
+				return nil, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+
+	for i, f := range fs {
+		if options[i].Seen() {
+			f.value.Set(copies[i].Elem())
+		}
+	}
+
+	return nil, validate(cfg, fs)
+}
+
+/*
+ * Empty environment variables are considered unset. This is mostly so that
+ * docker-compose files and kubernetes manifests that pass through unset
+ * variables (e.g. - LOG_LEVEL) don't override the config file.
+ */
+func lookup(getenv func(string) string, key string) (string, bool) {
+	s := getenv(key)
+	return s, s != ""
+}
+
+func validate(cfg interface{}, fs []field) error {
+	for _, f := range fs {
+		if f.tag.Get("required") == "true" && f.value.IsZero() {
+			msg := "missing required option %s"
+			if env := f.tag.Get("env"); env != "" {
+				msg += fmt.Sprintf(" (or %s)", env)
+			}
+			return fmt.Errorf(msg, f.name)
+		}
+	}
+	v, err := structof(cfg)
+	if err != nil {
+		return err
+	}
+	return validators(v)
+}
+
+/*
+ * Run the validator of the config struct, or if it has none, the validators
+ * of the embedded groups.
+ */
+func validators(v reflect.Value) error {
+	if validator, ok := v.Addr().Interface().(Validator); ok {
+		return validator.Validate()
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.Anonymous || f.Type.Kind() != reflect.Struct {
+			continue
+		}
+		if err := validators(v.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * The effective configuration, with secrets redacted, for printing on
+ * startup. The keys are the names used in the config file.
+ */
+func Redacted(cfg interface{}) map[string]interface{} {
+	v, err := structof(cfg)
+	if err != nil {
+		return nil
+	}
+	out := make(map[string]interface{})
+	for _, f := range fields(v) {
+		value := f.value.Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		switch f.tag.Get("secret") {
+		case "true":
+			if !f.value.IsZero() {
+				value = "<redacted>"
+			}
+		case "userinfo":
+			value = redactUserinfo(f.value.String())
+		}
+		out[f.name] = value
+	}
+	return out
+}
+
+/*
+ * Replace the user and password in the URLs with xxxxx. Anything that does
+ * not parse as a URL with userinfo, e.g. plain host:port addresses, is left
+ * as-is.
+ */
+func redactUserinfo(urls string) string {
+	redacted := strings.Split(urls, ",")
+	for i, addr := range redacted {
+		u, err := url.Parse(strings.TrimSpace(addr))
+		if err != nil || u.User == nil {
+			continue
+		}
+		u.User = url.User("xxxxx")
+		redacted[i] = u.String()
+	}
+	return strings.Join(redacted, ",")
+}
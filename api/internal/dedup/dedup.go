@@ -0,0 +1,70 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+/*
+ * Deduplication of identical queries. Popular queries, e.g. the same inline of
+ * a popular survey, are asked for over and over, and planning, scheduling and
+ * fetching them every time is wasted work. The query service records the
+ * process of every query under the query's identity, and a later identical
+ * query is given a promise for the same process, whether it is still in
+ * flight or already finished.
+ *
+ * The identity (key) is made by the query service, from the cube, the version
+ * (ETag) of its manifest, and the function, arguments and options of the
+ * query. A new version of the cube is a new identity, so results are never
+ * reused across versions.
+ *
+ * The record expires with the result of the process, and the store gives the
+ * time it has left, so that the token handed out for a reused process is not
+ * valid for longer than the result. A process that fails will never finish,
+ * and the fetch worker that fails it forgets the process, so that identical
+ * queries are planned and scheduled anew rather than given the broken
+ * process.
+ *
+ * The store is not the access check. The caller must be allowed to read the
+ * cube (i.e. the manifest, with the caller's credentials) before the store is
+ * asked for a process.
+ */
+type Store interface {
+	/*
+	 * Get the process recorded for the key, and how long it has left. Returns
+	 * ErrNotFound if there is none, or it has expired.
+	 */
+	Get(ctx context.Context, key string) (string, time.Duration, error)
+	/*
+	 * Record the process for the key, for ttl. Should two identical queries
+	 * race, the last one is kept. Both results are correct, it is only the
+	 * work that is not shared.
+	 */
+	Put(ctx context.Context, key, pid string, ttl time.Duration) error
+	/*
+	 * Forget the process, so that it is no longer given to identical
+	 * queries. Should a later process have replaced it, the later one is
+	 * kept.
+	 */
+	Forget(ctx context.Context, pid string) error
+}
+
+var ErrNotFound = errors.New("not found")
+
+/*
+ * Open the store of the queue backend, or nil if disabled. The redis store is
+ * shared by all the query services, whereas with other backends every query
+ * service deduplicates only the queries it gets itself.
+ */
+func Open(enabled bool, conn *queue.Conn) Store {
+	if !enabled {
+		return nil
+	}
+	if conn.Redis != nil {
+		return NewRedisStore(conn.Redis)
+	}
+	return NewMemoryStore()
+}
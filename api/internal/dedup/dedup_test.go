@@ -0,0 +1,67 @@
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreGetsRecordedProcess(t *testing.T) {
+	ctx   := context.Background()
+	store := NewMemoryStore()
+
+	_, _, err := store.Get(ctx, "key")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, store.Put(ctx, "key", "pid-0", time.Minute))
+	pid, left, err := store.Get(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "pid-0", pid)
+	assert.True(t, left > 0 && left <= time.Minute, "left = %s", left)
+
+	_, _, err = store.Get(ctx, "other")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryStoreRecordsExpire(t *testing.T) {
+	ctx   := context.Background()
+	store := NewMemoryStore()
+	assert.NoError(t, store.Put(ctx, "key", "pid-0", time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, _, err := store.Get(ctx, "key")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryStoreForgetsProcess(t *testing.T) {
+	ctx   := context.Background()
+	store := NewMemoryStore()
+	assert.NoError(t, store.Put(ctx, "key", "pid-0", time.Minute))
+	assert.NoError(t, store.Forget(ctx, "pid-0"))
+	_, _, err := store.Get(ctx, "key")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, store.Forget(ctx, "unknown"))
+}
+
+func TestMemoryStoreForgetKeepsLaterProcess(t *testing.T) {
+	ctx   := context.Background()
+	store := NewMemoryStore()
+	assert.NoError(t, store.Put(ctx, "key", "pid-0", time.Minute))
+	assert.NoError(t, store.Put(ctx, "key", "pid-1", time.Minute))
+	assert.NoError(t, store.Forget(ctx, "pid-0"))
+	pid, _, err := store.Get(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "pid-1", pid)
+}
+
+func TestMemoryStoreKeepsLastProcess(t *testing.T) {
+	ctx   := context.Background()
+	store := NewMemoryStore()
+	assert.NoError(t, store.Put(ctx, "key", "pid-0", time.Minute))
+	assert.NoError(t, store.Put(ctx, "key", "pid-1", time.Minute))
+	pid, _, err := store.Get(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "pid-1", pid)
+}
@@ -0,0 +1,81 @@
+package dedup
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type record struct {
+	pid     string
+	expires time.Time
+}
+
+/*
+ * Processes kept in memory, for single-binary mode (oneseismic-server) and
+ * tests. Expired records are removed when they are looked up.
+ */
+type MemoryStore struct {
+	sync.Mutex
+	records map[string]record
+	/*
+	 * The key every process is recorded under, for Forget
+	 */
+	keys    map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore {
+		records: make(map[string]record),
+		keys:    make(map[string]string),
+	}
+}
+
+func (m *MemoryStore) Get(
+	ctx context.Context,
+	key string,
+) (string, time.Duration, error) {
+	m.Lock()
+	defer m.Unlock()
+	r, ok := m.records[key]
+	if !ok {
+		return "", 0, ErrNotFound
+	}
+	left := time.Until(r.expires)
+	if left <= 0 {
+		delete(m.records, key)
+		delete(m.keys, r.pid)
+		return "", 0, ErrNotFound
+	}
+	return r.pid, left, nil
+}
+
+func (m *MemoryStore) Put(
+	ctx context.Context,
+	key string,
+	pid string,
+	ttl time.Duration,
+) error {
+	m.Lock()
+	defer m.Unlock()
+	m.records[key] = record {
+		pid:     pid,
+		expires: time.Now().Add(ttl),
+	}
+	m.keys[pid] = key
+	return nil
+}
+
+func (m *MemoryStore) Forget(ctx context.Context, pid string) error {
+	m.Lock()
+	defer m.Unlock()
+	key, ok := m.keys[pid]
+	if !ok {
+		return nil
+	}
+	delete(m.keys, pid)
+	if m.records[key].pid == pid {
+		delete(m.records, key)
+	}
+	return nil
+}
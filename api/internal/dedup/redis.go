@@ -0,0 +1,100 @@
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * Processes in redis, one key per query identity, and one per process:
+ *
+ *     dedup/{key}       the pid, which expires with the result
+ *     dedup/pid/{pid}   the key of the process, for Forget
+ *
+ * The commands only use one key at a time, so that the store works with
+ * redis cluster.
+ */
+type RedisStore struct {
+	client redis.Cmdable
+}
+
+func NewRedisStore(client redis.Cmdable) *RedisStore {
+	return &RedisStore { client: client }
+}
+
+func rediskey(key string) string {
+	return fmt.Sprintf("dedup/%s", key)
+}
+
+func pidkey(pid string) string {
+	return fmt.Sprintf("dedup/pid/%s", pid)
+}
+
+/*
+ * Delete the record only if it is still of the process.
+ *
+ * KEYS = record
+ * ARGV = pid
+ */
+var forgetscript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (r *RedisStore) Get(
+	ctx context.Context,
+	key string,
+) (string, time.Duration, error) {
+	pipe := r.client.Pipeline()
+	pid  := pipe.Get(ctx, rediskey(key))
+	ttl  := pipe.PTTL(ctx, rediskey(key))
+	_, err := pipe.Exec(ctx)
+	if err == redis.Nil {
+		return "", 0, ErrNotFound
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	/*
+	 * A key without an expiry gives a negative ttl. The keys are always set
+	 * with an expiry, so treat it as missing rather than live forever.
+	 */
+	if ttl.Val() <= 0 {
+		return "", 0, ErrNotFound
+	}
+	return pid.Val(), ttl.Val(), nil
+}
+
+func (r *RedisStore) Put(
+	ctx context.Context,
+	key string,
+	pid string,
+	ttl time.Duration,
+) error {
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, rediskey(key), pid, ttl)
+		pipe.Set(ctx, pidkey(pid), key, ttl)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisStore) Forget(ctx context.Context, pid string) error {
+	key, err := r.client.Get(ctx, pidkey(pid)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = forgetscript.Run(ctx, r.client, []string { rediskey(key) }, pid).Err()
+	if err != nil {
+		return err
+	}
+	return r.client.Del(ctx, pidkey(pid)).Err()
+}
@@ -1,7 +1,9 @@
 package internal
 
 import (
+	"math"
 	"net/http"
+	"time"
 )
 
 type InternalE struct {
@@ -58,3 +60,66 @@ func NewNotFoundError() *NotFoundE {
 func (nf *NotFoundE) Error() string {
 	return "Not found"
 }
+
+/*
+ * The user is over quota. It carries the exceeded limit and a retry-after hint
+ * (in seconds) in the GraphQL error extensions, so that clients can back off
+ * without parsing the message. A retry-after of zero means the query can
+ * never be admitted.
+ */
+type QuotaExceededE struct {
+	msg        string
+	limit      string
+	retryAfter time.Duration
+}
+
+func QuotaExceeded(
+	msg        string,
+	limit      string,
+	retryAfter time.Duration,
+) *QuotaExceededE {
+	return &QuotaExceededE {
+		msg:        msg,
+		limit:      limit,
+		retryAfter: retryAfter,
+	}
+}
+
+func (qe *QuotaExceededE) Error() string {
+	return qe.msg
+}
+
+func (qe *QuotaExceededE) Extensions() map[string]interface{} {
+	return map[string]interface{} {
+		"code":       "QUOTA_EXCEEDED",
+		"limit":      qe.limit,
+		"retryAfter": int(math.Ceil(qe.retryAfter.Seconds())),
+	}
+}
+
+/*
+ * The service is too busy to accept the query. Like QuotaExceededE it carries
+ * a retry-after hint (in seconds) in the GraphQL error extensions.
+ */
+type BusyE struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func Busy(msg string, retryAfter time.Duration) *BusyE {
+	return &BusyE {
+		msg:        msg,
+		retryAfter: retryAfter,
+	}
+}
+
+func (be *BusyE) Error() string {
+	return be.msg
+}
+
+func (be *BusyE) Extensions() map[string]interface{} {
+	return map[string]interface{} {
+		"code":       "BUSY",
+		"retryAfter": int(math.Ceil(be.retryAfter.Seconds())),
+	}
+}
@@ -0,0 +1,184 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+/*
+ * A Check verifies that a dependency of the service (a database, a queue,
+ * storage etc.) is available. A nil return means healthy.
+ *
+ * Checks are run for every probe, so they should be cheap. They are run
+ * concurrently and should respect the context deadline.
+ */
+type Check func(context.Context) error
+
+/*
+ * Checker implements the /healthz and /readyz endpoints, intended for
+ * orchestrator (e.g. kubernetes) liveness and readiness probes.
+ *
+ * Both endpoints run all the registered checks, so that a service that cannot
+ * reach its dependencies is reported as unhealthy. The readiness endpoint is
+ * also gated by the ready function, which is used to report not-ready when a
+ * service is shutting down, even though its dependencies are fine.
+ *
+ * Since liveness failures cause restarts, liveness probes should be
+ * configured with more slack (failureThreshold) than readiness probes, so
+ * that a short network hiccup to e.g. redis does not restart every instance.
+ */
+type Checker struct {
+	/*
+	 * Max duration of a single probe, including all checks.
+	 */
+	Timeout time.Duration
+
+	names  []string
+	checks []Check
+	ready  func() bool
+}
+
+func New() *Checker {
+	return &Checker {
+		Timeout: 2 * time.Second,
+		ready:   func() bool { return true },
+	}
+}
+
+/*
+ * Register a check. The name is used in the probe response to tell which
+ * dependency is failing.
+ */
+func (c *Checker) Add(name string, check Check) {
+	c.names  = append(c.names,  name)
+	c.checks = append(c.checks, check)
+}
+
+/*
+ * Set the readiness gate. The /readyz endpoint reports not-ready whenever
+ * ready() returns false.
+ */
+func (c *Checker) ReadyWhen(ready func() bool) {
+	c.ready = ready
+}
+
+/*
+ * Run all checks, and return the name -> status map. The status is "ok" for
+ * successful checks, and the error message otherwise.
+ */
+func (c *Checker) run(ctx context.Context) (gin.H, bool) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	errs := make([]error, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			errs[i] = check(ctx)
+		}(i, check)
+	}
+	wg.Wait()
+
+	healthy := true
+	status  := gin.H {}
+	for i, name := range c.names {
+		if errs[i] != nil {
+			healthy = false
+			status[name] = errs[i].Error()
+		} else {
+			status[name] = "ok"
+		}
+	}
+	return status, healthy
+}
+
+func (c *Checker) respond(ctx *gin.Context, healthy bool, checks gin.H) {
+	if healthy {
+		ctx.JSON(http.StatusOK, gin.H {
+			"status": "ok",
+			"checks": checks,
+		})
+	} else {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H {
+			"status": "unavailable",
+			"checks": checks,
+		})
+	}
+}
+
+func (c *Checker) Healthz(ctx *gin.Context) {
+	checks, healthy := c.run(ctx.Request.Context())
+	c.respond(ctx, healthy, checks)
+}
+
+func (c *Checker) Readyz(ctx *gin.Context) {
+	if !c.ready() {
+		c.respond(ctx, false, gin.H { "ready": "shutting down" })
+		return
+	}
+	checks, healthy := c.run(ctx.Request.Context())
+	c.respond(ctx, healthy, checks)
+}
+
+/*
+ * Register the /healthz and /readyz endpoints on the router.
+ */
+func (c *Checker) Register(router gin.IRoutes) {
+	router.GET("/healthz", c.Healthz)
+	router.GET("/readyz",  c.Readyz)
+}
+
+/*
+ * Check that redis is reachable and responding.
+ */
+func RedisPing(client redis.Cmdable) Check {
+	return func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	}
+}
+
+/*
+ * Check that a connection can be acquired from the postgres pool. Acquire
+ * will connect if there are no idle connections in the pool, and ping the
+ * database if the connection has been idle for a while.
+ */
+func PostgresAcquire(pool *pgxpool.Pool) Check {
+	return func(ctx context.Context) error {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		conn.Release()
+		return nil
+	}
+}
+
+/*
+ * Check that an HTTP endpoint (e.g. the storage account) is reachable. The
+ * request is unauthenticated, so any response, including errors like 403
+ * Forbidden, means the endpoint is reachable. Only failing to get a response
+ * at all is considered unhealthy.
+ */
+func HTTPReachable(endpoint string) Check {
+	client := &http.Client{}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		return nil
+	}
+}
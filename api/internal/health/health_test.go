@@ -0,0 +1,85 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(c *Checker, path string) (int, map[string]interface{}) {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	c.Register(app)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	app.ServeHTTP(w, req)
+
+	body := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func ok(context.Context) error {
+	return nil
+}
+
+func failing(context.Context) error {
+	return fmt.Errorf("connection refused")
+}
+
+func TestHealthyWhenAllChecksPass(t *testing.T) {
+	c := New()
+	c.Add("redis", ok)
+	c.Add("storage", ok)
+
+	for _, path := range []string{ "/healthz", "/readyz" } {
+		status, body := probe(c, path)
+		assert.Equal(t, http.StatusOK, status, "GET %s", path)
+		assert.Equal(t, "ok", body["status"], "GET %s", path)
+	}
+}
+
+func TestUnhealthyWhenCheckFails(t *testing.T) {
+	c := New()
+	c.Add("redis", ok)
+	c.Add("storage", failing)
+
+	for _, path := range []string{ "/healthz", "/readyz" } {
+		status, body := probe(c, path)
+		assert.Equal(t, http.StatusServiceUnavailable, status, "GET %s", path)
+		checks := body["checks"].(map[string]interface{})
+		assert.Equal(t, "ok", checks["redis"])
+		assert.Equal(t, "connection refused", checks["storage"])
+	}
+}
+
+func TestNotReadyWhenGateIsClosed(t *testing.T) {
+	c := New()
+	c.Add("redis", ok)
+	c.ReadyWhen(func() bool { return false })
+
+	status, _ := probe(c, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	status, _ = probe(c, "/healthz")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestCheckRespectsTimeout(t *testing.T) {
+	c := New()
+	c.Timeout = 0
+	c.Add("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	status, _ := probe(c, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+/*
+ * The shared, structured logger for all oneseismic services.
+ *
+ * Services call Setup() once on startup, which installs the logger globally.
+ * After that, log with zap.L(), and use the field helpers in this package for
+ * the oneseismic specific fields, so that the field names are consistent
+ * across services and can be queried on:
+ *
+ *     zap.L().Info("task written", logging.Pid(pid), logging.Part(part))
+ *
+ * Output is JSON, one object per line.
+ */
+
+/*
+ * Build the logger with level from the LOG_LEVEL environment variable (debug,
+ * info, warn, error), and info if unset. The logger is installed as the
+ * global zap logger, and the standard library log package is redirected to
+ * it, so that logs from dependencies end up in the same stream.
+ *
+ * The returned logger should be synced before the program exits.
+ */
+func Setup(service string) (*zap.Logger, error) {
+	level, err := parseLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(level)
+	cfg.EncoderConfig.TimeKey = "time"
+	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	/*
+	 * Sampling drops repeated messages under load, which is a bad fit for
+	 * per-process messages that are expected to be repeated a lot.
+	 */
+	cfg.Sampling = nil
+
+	logger, err := cfg.Build(zap.Fields(zap.String("service", service)))
+	if err != nil {
+		return nil, err
+	}
+	zap.ReplaceGlobals(logger)
+	zap.RedirectStdLog(logger)
+	return logger, nil
+}
+
+func parseLevel(level string) (zapcore.Level, error) {
+	if level == "" {
+		return zapcore.InfoLevel, nil
+	}
+	var l zapcore.Level
+	err := l.UnmarshalText([]byte(strings.ToLower(level)))
+	if err != nil {
+		return l, fmt.Errorf("invalid LOG_LEVEL '%s': %w", level, err)
+	}
+	return l, nil
+}
+
+/*
+ * The process ID, as generated by the query service.
+ */
+func Pid(pid string) zap.Field {
+	return zap.String("pid", pid)
+}
+
+/*
+ * The part of a process, on the form n/m
+ */
+func Part(part string) zap.Field {
+	return zap.String("part", part)
+}
+
+/*
+ * The guid (id) of the cube.
+ */
+func Guid(guid string) zap.Field {
+	return zap.String("guid", guid)
+}
+
+/*
+ * The consumer ID of a fetch worker.
+ */
+func Consumer(consumer string) zap.Field {
+	return zap.String("consumer", consumer)
+}
+
+/*
+ * Request logging middleware for gin, a replacement for gin.Logger() which
+ * logs through the shared logger. If the request has a pid (see
+ * util.GeneratePID), it is included.
+ */
+func Gin(logger *zap.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		fields := []zap.Field {
+			zap.String("method",  ctx.Request.Method),
+			zap.String("path",    ctx.Request.URL.Path),
+			zap.Int("status",     ctx.Writer.Status()),
+			zap.Int("size",       ctx.Writer.Size()),
+			zap.Duration("latency", time.Since(start)),
+			zap.String("client",  ctx.ClientIP()),
+		}
+		if pid := ctx.GetString("pid"); pid != "" {
+			fields = append(fields, Pid(pid))
+		} else if pid := ctx.Param("pid"); pid != "" {
+			fields = append(fields, Pid(pid))
+		}
+		if len(ctx.Errors) > 0 {
+			fields = append(fields, zap.String("errors", ctx.Errors.String()))
+		}
+
+		status := ctx.Writer.Status()
+		switch {
+		case status >= 500:
+			logger.Error("request", fields...)
+		case status >= 400:
+			logger.Warn("request", fields...)
+		default:
+			logger.Info("request", fields...)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParseLevelDefaultsToInfo(t *testing.T) {
+	level, err := parseLevel("")
+	if err != nil {
+		t.Fatalf("expected success; got %v", err)
+	}
+	if level != zapcore.InfoLevel {
+		t.Errorf("expected level = info; got %v", level)
+	}
+}
+
+func TestParseLevelIsCaseInsensitive(t *testing.T) {
+	level, err := parseLevel("DEBUG")
+	if err != nil {
+		t.Fatalf("expected success; got %v", err)
+	}
+	if level != zapcore.DebugLevel {
+		t.Errorf("expected level = debug; got %v", level)
+	}
+}
+
+func TestParseLevelFailsOnUnknownLevel(t *testing.T) {
+	_, err := parseLevel("loud")
+	if err == nil {
+		t.Errorf("expected error on unknown level")
+	}
+}
+
+func TestGinLogsRequestWithPid(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(Gin(zap.New(core)))
+	app.GET("/result/:pid", func(ctx *gin.Context) {
+		ctx.Status(http.StatusNotFound)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/some-pid", nil)
+	app.ServeHTTP(w, req)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry; got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Level != zapcore.WarnLevel {
+		t.Errorf("expected level = warn for 404; got %v", entry.Level)
+	}
+	fields := entry.ContextMap()
+	if fields["pid"] != "some-pid" {
+		t.Errorf("expected pid = some-pid; got %v", fields["pid"])
+	}
+	if fields["status"] != int64(http.StatusNotFound) {
+		t.Errorf("expected status = 404; got %v", fields["status"])
+	}
+}
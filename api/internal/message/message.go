@@ -24,6 +24,11 @@ type Query struct {
 	Function        string          `json:"function"`
 	Args            interface {}    `json:"args"`
 	Opts            interface {}    `json:"opts"`
+	/*
+	 * The trace context (W3C traceparent/tracestate) of the query. It is
+	 * copied to every task, so that the workers can continue the trace.
+	 */
+	TraceContext    map[string]string `json:"trace-context,omitempty"`
 }
 
 func (msg *Query) Pack() ([]byte, error) {
@@ -34,6 +39,12 @@ func (msg *Query) Unpack(doc []byte) (*Query, error) {
 	return msg, json.Unmarshal(doc, msg)
 }
 
+/*
+ * The key of the trace context in result stream entries. The remaining keys
+ * are the parts of the result.
+ */
+const TraceContextKey = "trace-context"
+
 /*
  * Corresponds to basic_task and derivatives in oneseismic/messages.hpp, and
  * is read from the worker nodes when performing a task, which combined makes
@@ -49,6 +60,7 @@ type Task struct {
 	Guid            string       `json:"guid"`
 	StorageEndpoint string       `json:"storage_endpoint"`
 	Function        string       `json:"function"`
+	TraceContext    map[string]string `json:"trace-context,omitempty"`
 }
 
 func (msg *Task) Pack() ([]byte, error) {
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+/*
+ * Prometheus metrics for oneseismic. The metrics themselves are defined in
+ * the packages that record them, and registered with the default registry.
+ * This package holds the shared bits, like serving the /metrics endpoint.
+ *
+ * All oneseismic metrics are prefixed with the namespace.
+ */
+const Namespace = "oneseismic"
+
+/*
+ * Register the /metrics endpoint on the router.
+ */
+func Register(router gin.IRoutes) {
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+}
+
+/*
+ * Collector for the length of a redis stream, e.g. the jobs queue. The length
+ * is read (with XLEN) when metrics are scraped.
+ *
+ * The stream length is a global property, so it should only be exported by a
+ * single component. Otherwise the same number would be reported once per
+ * instance, which makes for confusing aggregates.
+ */
+type streamLength struct {
+	client  redis.Cmdable
+	stream  string
+	timeout time.Duration
+	desc    *prometheus.Desc
+}
+
+func NewStreamLengthCollector(
+	client redis.Cmdable,
+	stream string,
+) prometheus.Collector {
+	return &streamLength {
+		client:  client,
+		stream:  stream,
+		timeout: time.Second,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(Namespace, "queue", "length"),
+			"Number of messages in the stream",
+			nil,
+			prometheus.Labels { "stream": stream },
+		),
+	}
+}
+
+func (s *streamLength) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s *streamLength) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	length, err := s.client.XLen(ctx, s.stream).Result()
+	if err != nil {
+		zap.L().Warn(
+			"unable to get length of stream",
+			zap.String("stream", s.stream),
+			zap.Error(err),
+		)
+		ch <- prometheus.NewInvalidMetric(s.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		s.desc,
+		prometheus.GaugeValue,
+		float64(length),
+	)
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type redisXLen struct {
+	redis.Cmdable
+	length int64
+	err    error
+}
+
+func (r *redisXLen) XLen(ctx context.Context, stream string) *redis.IntCmd {
+	return redis.NewIntResult(r.length, r.err)
+}
+
+func TestStreamLengthIsCollected(t *testing.T) {
+	c := NewStreamLengthCollector(&redisXLen{ length: 17 }, "jobs")
+	expected := `
+# HELP oneseismic_queue_length Number of messages in the stream
+# TYPE oneseismic_queue_length gauge
+oneseismic_queue_length{stream="jobs"} 17
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected))
+	assert.NoError(t, err)
+}
+
+func TestStreamLengthFailureIsReported(t *testing.T) {
+	c := NewStreamLengthCollector(
+		&redisXLen{ err: fmt.Errorf("connection refused") },
+		"jobs",
+	)
+	err := testutil.CollectAndCompare(c, strings.NewReader(""))
+	assert.Error(t, err)
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
 
 	"github.com/equinor/oneseismic/api/internal"
 )
@@ -282,7 +282,7 @@ func MakeConnectionPool(
 	config, err := pgxpool.ParseConfig(connstring)
     if err != nil {
 		msg := fmt.Sprintf("Unable to parse config: %v\n", err)
-		log.Println(msg)
+		zap.L().Error("unable to parse config", zap.Error(err))
 		return nil, internal.InternalError(msg)
     }
 
@@ -290,7 +290,7 @@ func MakeConnectionPool(
     pool, err := pgxpool.ConnectConfig(context.Background(), config)
     if err != nil {
 		msg := fmt.Sprintf("Unable to connect to database: %v\n", err)
-		log.Println(msg)
+		zap.L().Error("unable to connect to database", zap.Error(err))
 		return nil, internal.InternalError(msg)
     }
     return pool, nil
@@ -381,7 +381,7 @@ func (c *PgClient) GetManifests(
 	rows, err := c.connPool.Query(context.Background(), query, limit, offset)
 	if err != nil {
 		msg := fmt.Sprintf("Query failed with: %v", err)
-		log.Println(msg)
+		zap.L().Error("query failed", zap.Error(err))
 		return nil, internal.QueryError(msg)
 	}
 
@@ -391,7 +391,7 @@ func (c *PgClient) GetManifests(
 		err := rows.Scan(&m)
 
 		if err != nil {
-			log.Fatal(err)
+			zap.L().Fatal("unable to scan manifest", zap.Error(err))
 		}
 
 		manifests = append(manifests, &m)
@@ -0,0 +1,279 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * In-memory queues, for running all the services in a single process
+ * (oneseismic-server) and for tests. Nothing is persisted, and the queues are
+ * not shared between processes.
+ */
+
+/*
+ * A broadcast signal - waiters grab the channel, which is closed and replaced
+ * when something happens. Must be guarded by the owner's lock.
+ */
+type signal struct {
+	c chan struct{}
+}
+
+func (s *signal) wait() <-chan struct{} {
+	if s.c == nil {
+		s.c = make(chan struct{})
+	}
+	return s.c
+}
+
+func (s *signal) broadcast() {
+	if s.c != nil {
+		close(s.c)
+		s.c = nil
+	}
+}
+
+type MemoryJobs struct {
+	sync.Mutex
+	tasks   map[Priority][]Task
+	seqno   int
+	pending signal
+	order   readorder
+}
+
+func NewMemoryJobs() *MemoryJobs {
+	return &MemoryJobs {
+		tasks: make(map[Priority][]Task),
+	}
+}
+
+func (m *MemoryJobs) Enqueue(ctx context.Context, tasks ...Task) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, task := range tasks {
+		m.seqno++
+		task.ID = strconv.Itoa(m.seqno)
+		task.Enqueued = time.Now()
+		m.tasks[task.Priority] = append(m.tasks[task.Priority], task)
+	}
+	m.pending.broadcast()
+	return nil
+}
+
+func (m *MemoryJobs) Read(
+	ctx      context.Context,
+	consumer string,
+	block    time.Duration,
+) ([]Task, error) {
+	timeout := time.NewTimer(block)
+	defer timeout.Stop()
+	order := m.order.next()
+	for {
+		m.Lock()
+		for _, p := range order {
+			if tasks := m.tasks[p]; len(tasks) > 0 {
+				m.tasks[p] = tasks[1:]
+				m.Unlock()
+				return []Task{ tasks[0] }, nil
+			}
+		}
+		pending := m.pending.wait()
+		m.Unlock()
+
+		select {
+		case <-pending:
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (m *MemoryJobs) Backlog(ctx context.Context, p Priority) (Backlog, error) {
+	m.Lock()
+	defer m.Unlock()
+	tasks   := m.tasks[p]
+	backlog := Backlog { Tasks: len(tasks) }
+	if len(tasks) > 0 {
+		backlog.Oldest = tasks[0].Enqueued
+	}
+	return backlog, nil
+}
+
+func (m *MemoryJobs) CreateGroup(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryJobs) Leave(ctx context.Context, consumer string) error {
+	return nil
+}
+
+type memoryResult struct {
+	header  []byte
+	parts   []Part
+	claims  map[string]bool
+	expires time.Time
+	appended signal
+}
+
+type MemoryResults struct {
+	sync.Mutex
+	results map[string]*memoryResult
+	ttl     time.Duration
+}
+
+func NewMemoryResults(ttl time.Duration) *MemoryResults {
+	return &MemoryResults {
+		results: make(map[string]*memoryResult),
+		ttl:     ttl,
+	}
+}
+
+/*
+ * Get the result for the pid, creating it if it does not exist. Expired
+ * results are cleaned up whenever a new result is created.
+ *
+ * Must be called with the lock held.
+ */
+func (m *MemoryResults) get(pid string) *memoryResult {
+	result, ok := m.results[pid]
+	if ok {
+		return result
+	}
+
+	now := time.Now()
+	for key, r := range m.results {
+		if now.After(r.expires) {
+			delete(m.results, key)
+		}
+	}
+	result = &memoryResult { expires: now.Add(m.ttl) }
+	m.results[pid] = result
+	return result
+}
+
+func (m *MemoryResults) SetHeader(
+	ctx       context.Context,
+	pid       string,
+	header    []byte,
+	retention time.Duration,
+) error {
+	m.Lock()
+	defer m.Unlock()
+	result := m.get(pid)
+	result.header  = header
+	result.expires = time.Now().Add(keep(retention, m.ttl))
+	return nil
+}
+
+func (m *MemoryResults) Header(ctx context.Context, pid string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	result, ok := m.results[pid]
+	if !ok || result.header == nil || time.Now().After(result.expires) {
+		return nil, ErrNotFound
+	}
+	return result.header, nil
+}
+
+func (m *MemoryResults) DeleteHeader(ctx context.Context, pid string) error {
+	m.Lock()
+	defer m.Unlock()
+	if result, ok := m.results[pid]; ok {
+		result.header = nil
+	}
+	return nil
+}
+
+func (m *MemoryResults) Append(ctx context.Context, pid string, part Part) error {
+	m.Lock()
+	defer m.Unlock()
+	result := m.get(pid)
+	result.parts   = append(result.parts, part)
+	result.expires = time.Now().Add(keep(part.Retention, m.ttl))
+	result.appended.broadcast()
+	return nil
+}
+
+func (m *MemoryResults) Count(ctx context.Context, pid string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	result, ok := m.results[pid]
+	if !ok {
+		return 0, nil
+	}
+	return len(result.parts), nil
+}
+
+func (m *MemoryResults) Size(ctx context.Context, pid string) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	result, ok := m.results[pid]
+	if !ok {
+		return 0, nil
+	}
+	size := 0
+	for _, part := range result.parts {
+		size += len(part.Body)
+	}
+	return size, nil
+}
+
+func (m *MemoryResults) Claim(
+	ctx       context.Context,
+	pid       string,
+	name      string,
+	retention time.Duration,
+) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	result := m.get(pid)
+	if result.claims[name] {
+		return false, nil
+	}
+	if result.claims == nil {
+		result.claims = make(map[string]bool)
+	}
+	result.claims[name] = true
+	return true, nil
+}
+
+/*
+ * The cursor is the number of parts already read.
+ */
+func (m *MemoryResults) Read(
+	ctx    context.Context,
+	pid    string,
+	cursor string,
+) ([]Part, string, error) {
+	offset := 0
+	if cursor != "" {
+		var err error
+		offset, err = strconv.Atoi(cursor)
+		if err != nil {
+			return nil, cursor, fmt.Errorf("malformed cursor %s: %w", cursor, err)
+		}
+	}
+
+	for {
+		m.Lock()
+		result := m.get(pid)
+		if len(result.parts) > offset {
+			parts := result.parts[offset:]
+			m.Unlock()
+			return parts, strconv.Itoa(offset + len(parts)), nil
+		}
+		appended := result.appended.wait()
+		m.Unlock()
+
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return nil, cursor, ctx.Err()
+		}
+	}
+}
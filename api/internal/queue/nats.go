@@ -0,0 +1,489 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+ * The queues as NATS JetStream streams.
+ *
+ * The job queue is a work-queue stream per priority class, each with a single
+ * subject, and the consumer group is a durable pull consumer on every stream
+ * shared by all the workers. The
+ * process headers are kept in a key-value bucket, and the parts in a single
+ * stream where every process has its own subject, results.<pid>.
+ */
+
+const (
+	natsResultStream    = "results"
+	natsHeaderBucket    = "headers"
+	natsPidHeader       = "Oneseismic-Pid"
+	natsPartHeader      = "Oneseismic-Part"
+	natsUserHeader      = "Oneseismic-User"
+	natsRetentionHeader = "Oneseismic-Retention"
+	natsTraceHeader     = "Oneseismic-Trace-Context"
+	natsCallbackHeader  = "Oneseismic-Callback"
+	/*
+	 * JetStream pull consumers cannot wait on several streams at once, so
+	 * when all the priority classes are empty the job queue polls them at
+	 * this interval.
+	 */
+	natsPollInterval    = 100 * time.Millisecond
+)
+
+/*
+ * Create the stream, unless it already exists. The stream config of an
+ * existing stream is left as-is.
+ */
+func ensureStream(js nats.JetStreamContext, cfg *nats.StreamConfig) error {
+	_, err := js.StreamInfo(cfg.Name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return err
+	}
+	_, err = js.AddStream(cfg)
+	return err
+}
+
+type NatsJobs struct {
+	js     nats.JetStreamContext
+	stream string
+	group  string
+	subs   map[Priority]*nats.Subscription
+	order  readorder
+}
+
+/*
+ * Connect to the job queue, and create the streams if they do not exist. The
+ * stream names are also the subjects the tasks are published to.
+ */
+func NewNatsJobs(
+	js     nats.JetStreamContext,
+	stream string,
+	group  string,
+) (*NatsJobs, error) {
+	for _, p := range Priorities {
+		name := PriorityStream(stream, p)
+		err  := ensureStream(js, &nats.StreamConfig {
+			Name:      name,
+			Subjects:  []string { name },
+			Retention: nats.WorkQueuePolicy,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create stream %s: %w", name, err)
+		}
+	}
+	return &NatsJobs {
+		js:     js,
+		stream: stream,
+		group:  group,
+	}, nil
+}
+
+func (n *NatsJobs) Enqueue(ctx context.Context, tasks ...Task) error {
+	for _, task := range tasks {
+		msg := nats.NewMsg(PriorityStream(n.stream, task.Priority))
+		msg.Header.Set(natsPidHeader,  task.Pid)
+		msg.Header.Set(natsPartHeader, task.Part)
+		if task.User != "" {
+			msg.Header.Set(natsUserHeader, task.User)
+		}
+		if task.Retention > 0 {
+			ms := strconv.FormatInt(task.Retention.Milliseconds(), 10)
+			msg.Header.Set(natsRetentionHeader, ms)
+		}
+		if task.Callback != "" {
+			msg.Header.Set(natsCallbackHeader, task.Callback)
+		}
+		msg.Data = task.Body
+		_, err := n.js.PublishMsg(msg, nats.Context(ctx))
+		if err != nil {
+			msg := "pid=%s, part=%v, unable to schedule: %w"
+			return fmt.Errorf(msg, task.Pid, task.Part, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Create the durable consumers (the group), and bind to them. The
+ * subscriptions are bound rather than created by the subscribe call, so that
+ * unsubscribing on Leave() does not delete the consumers for the other
+ * workers.
+ */
+func (n *NatsJobs) CreateGroup(ctx context.Context) error {
+	subs := make(map[Priority]*nats.Subscription, len(Priorities))
+	for _, p := range Priorities {
+		stream := PriorityStream(n.stream, p)
+		_, err := n.js.AddConsumer(
+			stream,
+			&nats.ConsumerConfig {
+				Durable:   n.group,
+				AckPolicy: nats.AckExplicitPolicy,
+			},
+			nats.Context(ctx),
+		)
+		if err != nil {
+			return err
+		}
+		sub, err := n.js.PullSubscribe(
+			stream,
+			n.group,
+			nats.Bind(stream, n.group),
+		)
+		if err != nil {
+			return err
+		}
+		subs[p] = sub
+	}
+	n.subs = subs
+	return nil
+}
+
+/*
+ * Read from the first priority class (in order) with pending tasks. When all
+ * classes are empty, poll until block expires.
+ *
+ * Tasks are acked immediately when read, which removes them from the
+ * work-queue stream. Like with redis, we can afford to fail requests and lose
+ * messages should a node crash.
+ */
+func (n *NatsJobs) Read(
+	ctx      context.Context,
+	consumer string,
+	block    time.Duration,
+) ([]Task, error) {
+	if n.subs == nil {
+		return nil, fmt.Errorf("read from %s before CreateGroup()", n.stream)
+	}
+	ctx, cancel := context.WithTimeout(ctx, block)
+	defer cancel()
+
+	order := n.order.next()
+	for {
+		for _, p := range order {
+			info, err := n.subs[p].ConsumerInfo()
+			if err != nil {
+				return nil, err
+			}
+			if info.NumPending == 0 {
+				continue
+			}
+			tasks, err := n.fetch(ctx, p)
+			if err != nil || len(tasks) > 0 {
+				return tasks, err
+			}
+		}
+
+		select {
+		case <-time.After(natsPollInterval):
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, nil
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+/*
+ * Fetch a task from the priority class. The pending task may have been taken
+ * by another worker in the meantime, in which case this returns no tasks.
+ */
+func (n *NatsJobs) fetch(ctx context.Context, p Priority) ([]Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, natsPollInterval)
+	defer cancel()
+	msgs, err := n.subs[p].Fetch(1, nats.Context(ctx))
+	if errors.Is(err, context.DeadlineExceeded) || err == nats.ErrTimeout {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make([]Task, 0, len(msgs))
+	for _, msg := range msgs {
+		task := Task {
+			Pid:      msg.Header.Get(natsPidHeader),
+			Part:     msg.Header.Get(natsPartHeader),
+			Body:     msg.Data,
+			User:     msg.Header.Get(natsUserHeader),
+			Priority: p,
+			Callback: msg.Header.Get(natsCallbackHeader),
+		}
+		task.Retention = parseRetention(msg.Header.Get(natsRetentionHeader))
+		meta, err := msg.Metadata()
+		if err == nil {
+			task.ID       = strconv.FormatUint(meta.Sequence.Stream, 10)
+			task.Enqueued = meta.Timestamp
+		}
+		if err := msg.Ack(); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+/*
+ * Tasks are removed from the work-queue stream when acked, so the stream
+ * state is the backlog.
+ */
+func (n *NatsJobs) Backlog(ctx context.Context, p Priority) (Backlog, error) {
+	info, err := n.js.StreamInfo(PriorityStream(n.stream, p), nats.Context(ctx))
+	if err != nil {
+		return Backlog{}, err
+	}
+	backlog := Backlog { Tasks: int(info.State.Msgs) }
+	if info.State.Msgs > 0 {
+		backlog.Oldest = info.State.FirstTime
+	}
+	return backlog, nil
+}
+
+/*
+ * The consumers are shared by all the workers, so leaving only unsubscribes.
+ */
+func (n *NatsJobs) Leave(ctx context.Context, consumer string) error {
+	for _, sub := range n.subs {
+		if err := sub.Unsubscribe(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type NatsResults struct {
+	js      nats.JetStreamContext
+	headers nats.KeyValue
+}
+
+/*
+ * Connect to the result store, and create the stream and bucket if they do
+ * not exist. Unlike redis, the time-to-live is per part and from when it was
+ * written, not refreshed by appending to the process.
+ *
+ * JetStream only has a max age per stream or bucket, so the retention of
+ * processes is ignored, and results are always kept for ttl.
+ */
+func NewNatsResults(
+	js  nats.JetStreamContext,
+	ttl time.Duration,
+) (*NatsResults, error) {
+	err := ensureStream(js, &nats.StreamConfig {
+		Name:     natsResultStream,
+		Subjects: []string { natsResultStream + ".>" },
+		MaxAge:   ttl,
+	})
+	if err != nil {
+		msg := "unable to create stream %s: %w"
+		return nil, fmt.Errorf(msg, natsResultStream, err)
+	}
+
+	headers, err := js.KeyValue(natsHeaderBucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		headers, err = js.CreateKeyValue(&nats.KeyValueConfig {
+			Bucket: natsHeaderBucket,
+			TTL:    ttl,
+		})
+	}
+	if err != nil {
+		msg := "unable to create bucket %s: %w"
+		return nil, fmt.Errorf(msg, natsHeaderBucket, err)
+	}
+	return &NatsResults {
+		js:      js,
+		headers: headers,
+	}, nil
+}
+
+func partsubject(pid string) string {
+	return fmt.Sprintf("%s.%s", natsResultStream, pid)
+}
+
+func (n *NatsResults) SetHeader(
+	ctx       context.Context,
+	pid       string,
+	header    []byte,
+	retention time.Duration,
+) error {
+	_, err := n.headers.Put(pid, header)
+	return err
+}
+
+func (n *NatsResults) Header(ctx context.Context, pid string) ([]byte, error) {
+	entry, err := n.headers.Get(pid)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value(), nil
+}
+
+func (n *NatsResults) DeleteHeader(ctx context.Context, pid string) error {
+	err := n.headers.Delete(pid)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (n *NatsResults) Append(ctx context.Context, pid string, part Part) error {
+	msg := nats.NewMsg(partsubject(pid))
+	msg.Header.Set(natsPartHeader, part.Name)
+	if len(part.TraceContext) > 0 {
+		tc, err := json.Marshal(part.TraceContext)
+		if err == nil {
+			msg.Header.Set(natsTraceHeader, string(tc))
+		}
+	}
+	msg.Data = part.Body
+	_, err := n.js.PublishMsg(msg, nats.Context(ctx))
+	return err
+}
+
+/*
+ * JetStream does not (cheaply) count messages per subject, so count by making
+ * a short-lived consumer on the parts subject - the number of messages
+ * pending and delivered to it is the number of parts.
+ */
+func (n *NatsResults) Count(ctx context.Context, pid string) (int, error) {
+	sub, err := n.js.SubscribeSync(
+		partsubject(pid),
+		nats.DeliverAll(),
+		nats.AckNone(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Unsubscribe()
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return 0, err
+	}
+	return int(info.NumPending + info.Delivered.Consumer), nil
+}
+
+/*
+ * Like Count, but with a consumer that only delivers the headers of the
+ * parts, which carry the size of the (omitted) body.
+ */
+func (n *NatsResults) Size(ctx context.Context, pid string) (int, error) {
+	sub, err := n.js.SubscribeSync(
+		partsubject(pid),
+		nats.DeliverAll(),
+		nats.AckNone(),
+		nats.HeadersOnly(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Unsubscribe()
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return 0, err
+	}
+	pending := int(info.NumPending + info.Delivered.Consumer)
+
+	size := 0
+	for i := 0; i < pending; i++ {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.Atoi(msg.Header.Get(nats.MsgSize))
+		if err != nil {
+			return 0, fmt.Errorf("malformed %s header: %w", nats.MsgSize, err)
+		}
+		size += n
+	}
+	return size, nil
+}
+
+/*
+ * Claims are keys in the header bucket, which expire with the headers. The
+ * create fails if the key already exists, but the error does not tell if that
+ * is why, so the key is looked up to tell a lost claim from other errors.
+ */
+func (n *NatsResults) Claim(
+	ctx       context.Context,
+	pid       string,
+	name      string,
+	retention time.Duration,
+) (bool, error) {
+	key := fmt.Sprintf("%s.claim.%s", pid, name)
+	_, err := n.headers.Create(key, []byte("1"))
+	if err == nil {
+		return true, nil
+	}
+	if _, geterr := n.headers.Get(key); geterr == nil {
+		return false, nil
+	}
+	return false, err
+}
+
+/*
+ * The cursor is the stream sequence of the last part read.
+ */
+func (n *NatsResults) Read(
+	ctx    context.Context,
+	pid    string,
+	cursor string,
+) ([]Part, string, error) {
+	start := nats.DeliverAll()
+	if cursor != "" {
+		seq, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			msg := "malformed cursor %s: %w"
+			return nil, cursor, fmt.Errorf(msg, cursor, err)
+		}
+		start = nats.StartSequence(seq + 1)
+	}
+	sub, err := n.js.SubscribeSync(partsubject(pid), start, nats.AckNone())
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer sub.Unsubscribe()
+
+	/*
+	 * Block for the first part, then take the parts that are already
+	 * available, which the metadata tells through the pending count.
+	 */
+	parts := []Part{}
+	next  := cursor
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return nil, cursor, err
+		}
+		part := Part {
+			Name:         msg.Header.Get(natsPartHeader),
+			Body:         msg.Data,
+			TraceContext: map[string]string{},
+		}
+		if tc := msg.Header.Get(natsTraceHeader); tc != "" {
+			json.Unmarshal([]byte(tc), &part.TraceContext)
+		}
+		parts = append(parts, part)
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			return nil, cursor, err
+		}
+		next = strconv.FormatUint(meta.Sequence.Stream, 10)
+		if meta.NumPending == 0 {
+			return parts, next, nil
+		}
+	}
+}
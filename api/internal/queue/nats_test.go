@@ -0,0 +1,226 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+ * Run an embedded NATS server with JetStream enabled, and connect to it. The
+ * server is shut down when the test completes.
+ */
+func jetstream(t *testing.T) nats.JetStreamContext {
+	opts := &server.Options {
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	}
+	srv, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("unable to create nats server: %v", err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server not ready")
+	}
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("unable to connect to nats: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return js
+}
+
+func TestNatsJobsEveryTaskIsReadOnce(t *testing.T) {
+	ctx := context.Background()
+	js  := jetstream(t)
+	producer, err := NewNatsJobs(js, "jobs", "fetch")
+	assert.NoError(t, err)
+	err = producer.Enqueue(
+		ctx,
+		Task { Pid: "pid", Part: "0/2", Body: []byte("task-0") },
+		Task { Pid: "pid", Part: "1/2", Body: []byte("task-1") },
+	)
+	assert.NoError(t, err)
+
+	/*
+	 * Two consumers in the same group, which should share the tasks
+	 */
+	consumers := make([]*NatsJobs, 2)
+	for i := range consumers {
+		consumers[i], err = NewNatsJobs(js, "jobs", "fetch")
+		assert.NoError(t, err)
+		assert.NoError(t, consumers[i].CreateGroup(ctx))
+	}
+
+	parts := []string{}
+	for _, consumer := range consumers {
+		tasks, err := consumer.Read(ctx, "consumer", time.Second)
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+		parts = append(parts, tasks[0].Part)
+		assert.Equal(t, "pid", tasks[0].Pid)
+		assert.False(t, tasks[0].Enqueued.IsZero(), "want enqueued time")
+	}
+	assert.ElementsMatch(t, []string { "0/2", "1/2" }, parts)
+
+	tasks, err := consumers[0].Read(ctx, "consumer", 10 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, tasks)
+
+	for _, consumer := range consumers {
+		assert.NoError(t, consumer.Leave(ctx, "consumer"))
+	}
+}
+
+func TestNatsJobsCarryUserRetentionAndCallback(t *testing.T) {
+	ctx  := context.Background()
+	jobs, err := NewNatsJobs(jetstream(t), "jobs", "fetch")
+	assert.NoError(t, err)
+	assert.NoError(t, jobs.CreateGroup(ctx))
+
+	err = jobs.Enqueue(ctx, Task {
+		Pid:       "pid",
+		Part:      "0/1",
+		User:      "<oid>",
+		Retention: time.Hour,
+		Callback:  "https://hooks.example.com/done",
+	})
+	assert.NoError(t, err)
+	tasks, err := jobs.Read(ctx, "consumer", time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, "<oid>", tasks[0].User)
+	assert.Equal(t, time.Hour, tasks[0].Retention)
+	assert.Equal(t, "https://hooks.example.com/done", tasks[0].Callback)
+}
+
+func TestNatsResultsHeaderNotFound(t *testing.T) {
+	results, err := NewNatsResults(jetstream(t), DefaultTTL)
+	assert.NoError(t, err)
+	_, err = results.Header(context.Background(), "pid")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestNatsResultsDeleteHeader(t *testing.T) {
+	ctx := context.Background()
+	results, err := NewNatsResults(jetstream(t), DefaultTTL)
+	assert.NoError(t, err)
+
+	assert.NoError(t, results.SetHeader(ctx, "pid", []byte("header"), 0))
+	assert.NoError(t, results.DeleteHeader(ctx, "pid"))
+	_, err = results.Header(ctx, "pid")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, results.DeleteHeader(ctx, "other"))
+}
+
+func TestNatsResultsClaimOnce(t *testing.T) {
+	ctx := context.Background()
+	results, err := NewNatsResults(jetstream(t), DefaultTTL)
+	assert.NoError(t, err)
+
+	claimed, err := results.Claim(ctx, "pid", "callback", 0)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = results.Claim(ctx, "pid", "callback", 0)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	claimed, err = results.Claim(ctx, "other", "callback", 0)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestNatsResultsReadFromCursor(t *testing.T) {
+	ctx := context.Background()
+	results, err := NewNatsResults(jetstream(t), DefaultTTL)
+	assert.NoError(t, err)
+
+	err = results.SetHeader(ctx, "pid", []byte("header"), 0)
+	assert.NoError(t, err)
+	header, err := results.Header(ctx, "pid")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("header"), header)
+
+	tc := map[string]string { "traceparent": "00-abc-def-01" }
+	results.Append(ctx, "pid", Part { Name: "0/3", Body: []byte("a") })
+	results.Append(ctx, "pid", Part { Name: "1/3", Body: []byte("b"), TraceContext: tc })
+	results.Append(ctx, "other", Part { Name: "0/1", Body: []byte("x") })
+
+	parts, cursor, err := results.Read(ctx, "pid", "")
+	assert.NoError(t, err)
+	assert.Len(t, parts, 2)
+	assert.Equal(t, "0/3", parts[0].Name)
+	assert.Equal(t, []byte("b"), parts[1].Body)
+	assert.Equal(t, tc, parts[1].TraceContext)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		results.Append(ctx, "pid", Part { Name: "2/3", Body: []byte("cde") })
+	}()
+	parts, _, err = results.Read(ctx, "pid", cursor)
+	assert.NoError(t, err)
+	assert.Len(t, parts, 1)
+	assert.Equal(t, "2/3", parts[0].Name)
+
+	count, err := results.Count(ctx, "pid")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	size, err := results.Size(ctx, "pid")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, size)
+}
+
+func TestNatsJobsReadsHigherPriorityFirst(t *testing.T) {
+	ctx := context.Background()
+	jobs, err := NewNatsJobs(jetstream(t), "jobs", "fetch")
+	assert.NoError(t, err)
+	assert.NoError(t, jobs.CreateGroup(ctx))
+	err = jobs.Enqueue(
+		ctx,
+		Task { Pid: "export", Part: "0/1", Priority: Batch },
+		Task { Pid: "inline", Part: "0/1", Priority: Interactive },
+	)
+	assert.NoError(t, err)
+
+	for _, pid := range []string { "inline", "export" } {
+		tasks, err := jobs.Read(ctx, "consumer", time.Second)
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+		assert.Equal(t, pid, tasks[0].Pid)
+	}
+	assert.NoError(t, jobs.Leave(ctx, "consumer"))
+}
+
+func TestNatsJobsBacklog(t *testing.T) {
+	ctx := context.Background()
+	jobs, err := NewNatsJobs(jetstream(t), "jobs", "fetch")
+	assert.NoError(t, err)
+
+	backlog, err := jobs.Backlog(ctx, Interactive)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, backlog.Tasks)
+	assert.True(t, backlog.Oldest.IsZero())
+
+	err = jobs.Enqueue(ctx, Task { Pid: "pid" }, Task { Pid: "pid" })
+	assert.NoError(t, err)
+	backlog, err = jobs.Backlog(ctx, Interactive)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, backlog.Tasks)
+	assert.False(t, backlog.Oldest.IsZero())
+}
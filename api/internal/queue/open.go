@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/nats-io/nats.go"
+
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/redisclient"
+)
+
+/*
+ * The queues of a backend, as configured by config.Queue.
+ */
+type Conn struct {
+	/*
+	 * The name of the backend, i.e. redis or nats
+	 */
+	Backend string
+	/*
+	 * The name of the job queue, which lower priority classes are suffixed
+	 * to, see PriorityStream
+	 */
+	Stream  string
+	Jobs    Jobs
+	Results Results
+	/*
+	 * The redis client, when the backend is redis, and nil otherwise. Some
+	 * parts of oneseismic (the scheduler, queue metrics) are redis
+	 * specific.
+	 */
+	Redis   redis.UniversalClient
+	/*
+	 * Check that the backend is reachable, for the health probes.
+	 */
+	Ping    func(context.Context) error
+	close   func()
+}
+
+func (c *Conn) Close() {
+	c.close()
+}
+
+/*
+ * Connect to the queue backend. The stream is the name of the job queue, and
+ * the group the name of the consumer group; they should be the same for the
+ * producer and all the consumers.
+ */
+func Open(
+	cfg    config.Queue,
+	stream string,
+	group  string,
+	ttl    time.Duration,
+) (*Conn, error) {
+	switch cfg.Backend {
+	case "", "redis":
+		client, err := redisclient.New(cfg.Redis)
+		if err != nil {
+			return nil, err
+		}
+		return &Conn {
+			Backend: "redis",
+			Stream:  stream,
+			Jobs:    NewRedisJobs(client, stream, group),
+			Results: NewRedisResults(client, ttl),
+			Redis:   client,
+			Ping:    func(ctx context.Context) error {
+				return client.Ping(ctx).Err()
+			},
+			close:   func() { client.Close() },
+		}, nil
+
+	case "nats":
+		nc, err := nats.Connect(cfg.NatsURL)
+		if err != nil {
+			return nil, err
+		}
+		js, err := nc.JetStream()
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		jobs, err := NewNatsJobs(js, stream, group)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		results, err := NewNatsResults(js, ttl)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+		return &Conn {
+			Backend: "nats",
+			Stream:  stream,
+			Jobs:    jobs,
+			Results: results,
+			Ping:    func(ctx context.Context) error {
+				if !nc.IsConnected() {
+					return fmt.Errorf("nats: %s", nc.Status())
+				}
+				return nil
+			},
+			close:   func() { nc.Close() },
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown queue %s", cfg.Backend)
+	}
+}
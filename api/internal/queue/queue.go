@@ -0,0 +1,303 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The queues that connect the oneseismic services. The query service puts
+ * tasks on the job queue, and a process header in the result store. The fetch
+ * workers read tasks from the job queue and append the completed parts to the
+ * result store, from where the result service reads them.
+ *
+ * In a regular deployment the queues are redis streams or NATS JetStream
+ * streams, shared by all the services. For single-binary mode
+ * (oneseismic-server) and tests, the queues can be kept in memory.
+ */
+
+/*
+ * The default time-to-live of results, i.e. after this duration results will
+ * be cleaned up. This is the default retention of a deployment (see
+ * config.Retention).
+ */
+const DefaultTTL = 10 * time.Minute
+
+/*
+ * The retention, or the store's ttl if the retention is not set.
+ */
+func keep(retention, ttl time.Duration) time.Duration {
+	if retention > 0 {
+		return retention
+	}
+	return ttl
+}
+
+/*
+ * Returned by Results.Header when no process header exists, i.e. the process
+ * is not scheduled yet, or has expired.
+ */
+var ErrNotFound = errors.New("not found")
+
+/*
+ * The priority class of a task. Every class has its own queue, and workers
+ * read the higher priority classes first, so that a large batch job does not
+ * hold up the small, interactive queries queued after it.
+ */
+type Priority int
+
+const (
+	Interactive Priority = iota
+	Batch
+)
+
+/*
+ * All the priority classes, highest priority first.
+ */
+var Priorities = []Priority { Interactive, Batch }
+
+func (p Priority) String() string {
+	switch p {
+	case Interactive:
+		return "interactive"
+	case Batch:
+		return "batch"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range Priorities {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return Interactive, fmt.Errorf("unknown priority %s", s)
+}
+
+/*
+ * The name of the queue (stream) for the priority class. Interactive tasks go
+ * on the stream itself, so that the name of the default queue is unchanged,
+ * and the lower classes get a suffix, e.g. jobs-batch.
+ */
+func PriorityStream(stream string, p Priority) string {
+	if p == Interactive {
+		return stream
+	}
+	return fmt.Sprintf("%s-%s", stream, p)
+}
+
+/*
+ * Every n-th read starts at a lower priority class, so that the lower classes
+ * still make progress when the higher classes never run dry. With only
+ * interactive and batch, batch gets at least every fifth read that has work
+ * to choose from.
+ */
+const starvationInterval = 5
+
+/*
+ * The order to read the priority classes in, which is highest priority first
+ * except for every starvationInterval-th read. Safe for concurrent use.
+ */
+type readorder struct {
+	reads uint64
+}
+
+func (o *readorder) next() []Priority {
+	n := atomic.AddUint64(&o.reads, 1)
+	if n % starvationInterval != 0 || len(Priorities) < 2 {
+		return Priorities
+	}
+	/*
+	 * Rotate the classes so that the read starts at a lower class, cycling
+	 * through the lower classes should there be more than one.
+	 */
+	k := 1 + int(n / starvationInterval) % (len(Priorities) - 1)
+	order := make([]Priority, 0, len(Priorities))
+	order = append(order, Priorities[k:]...)
+	order = append(order, Priorities[:k]...)
+	return order
+}
+
+/*
+ * A task, as put on or read from the job queue. The task (body) is opaque to
+ * the queue.
+ */
+type Task struct {
+	/*
+	 * ID of the task in the queue, e.g. the stream entry ID in redis. Only set
+	 * for tasks read from a queue.
+	 */
+	ID   string
+	Pid  string
+	/*
+	 * The part of the process, formatted as n/m where n < m.
+	 */
+	Part string
+	Body []byte
+	/*
+	 * The user (oid) that made the query, for quotas. Empty if unknown.
+	 */
+	User string
+	/*
+	 * The priority class, which decides the queue the task is put on.
+	 */
+	Priority Priority
+	/*
+	 * How long the result of the process is kept. Zero for the result
+	 * store's time-to-live.
+	 */
+	Retention time.Duration
+	/*
+	 * The URL to notify when the process is done, or empty for none. See
+	 * the callback package.
+	 */
+	Callback string
+	/*
+	 * The time the task was put on the queue, if known by the queue.
+	 */
+	Enqueued time.Time
+}
+
+/*
+ * The tasks waiting in the queue of a priority class.
+ */
+type Backlog struct {
+	Tasks  int
+	/*
+	 * The time the oldest task in the queue was enqueued, or zero if the
+	 * queue is empty.
+	 */
+	Oldest time.Time
+}
+
+/*
+ * How long the oldest task has waited, which estimates how long a task
+ * enqueued now will wait.
+ */
+func (b Backlog) Wait() time.Duration {
+	if b.Oldest.IsZero() {
+		return 0
+	}
+	return time.Since(b.Oldest)
+}
+
+/*
+ * A completed part of a result, as written by the fetch worker.
+ */
+type Part struct {
+	/*
+	 * The part of the process, formatted as n/m where n < m.
+	 */
+	Name         string
+	Body         []byte
+	/*
+	 * The trace context of the process, so that the result service can
+	 * continue the trace. Empty when tracing is disabled.
+	 */
+	TraceContext map[string]string
+	/*
+	 * How long the result of the process is kept, from this part is
+	 * written. Zero for the result store's time-to-live.
+	 */
+	Retention    time.Duration
+}
+
+/*
+ * The job queue. All workers read from the same queue through a consumer
+ * group, and every task is read by exactly one worker. The queue is really one
+ * queue per priority class, and Read takes tasks from the higher classes
+ * first. Tasks are removed from
+ * the queue when read, and if a worker should crash the task is lost. Tasks
+ * that are read, but that the worker cannot complete (e.g. on shutdown), can
+ * be handed back with Enqueue.
+ */
+type Jobs interface {
+	Enqueue(ctx context.Context, tasks ...Task) error
+	/*
+	 * Create the consumer group (for all priority classes), if it does not
+	 * already exist. This should be
+	 * called by the consumers on start-up, before Read.
+	 */
+	CreateGroup(ctx context.Context) error
+	/*
+	 * Read the next task(s). Blocks for up to block if the queue is empty, and
+	 * returns an empty list (and no error) if there still are no tasks.
+	 */
+	Read(
+		ctx      context.Context,
+		consumer string,
+		block    time.Duration,
+	) ([]Task, error)
+	/*
+	 * Remove the consumer, when it shuts down for good.
+	 */
+	Leave(ctx context.Context, consumer string) error
+	/*
+	 * The tasks waiting in the queue of the priority class.
+	 */
+	Backlog(ctx context.Context, p Priority) (Backlog, error)
+}
+
+/*
+ * The result store. Both the process header and the parts expire after the
+ * retention of the process, or the time-to-live given to the implementation's
+ * constructor when the retention is not set. The retention should not be
+ * longer than the time-to-live, which some implementations have as their
+ * upper bound.
+ */
+type Results interface {
+	SetHeader(
+		ctx       context.Context,
+		pid       string,
+		header    []byte,
+		retention time.Duration,
+	) error
+	/*
+	 * Get the process header. Returns ErrNotFound if it does not exist.
+	 */
+	Header(ctx context.Context, pid string) ([]byte, error)
+	/*
+	 * Delete the process header, e.g. when not all the tasks of the process
+	 * could be scheduled, so that the process is not waited for. Deleting a
+	 * header that does not exist is not an error.
+	 */
+	DeleteHeader(ctx context.Context, pid string) error
+	Append(ctx context.Context, pid string, part Part) error
+	/*
+	 * The number of parts written for the process so far.
+	 */
+	Count(ctx context.Context, pid string) (int, error)
+	/*
+	 * The size in bytes of the parts written for the process so far, i.e. the
+	 * sum of the lengths of their bodies. Together with the header this is
+	 * the size of the result, without reading it.
+	 */
+	Size(ctx context.Context, pid string) (int, error)
+	/*
+	 * Claim the named event of the process, e.g. its final callback, so that
+	 * it happens at most once. Returns true for the first claim only, across
+	 * all the services sharing the store. The claim expires with the
+	 * process, after retention.
+	 */
+	Claim(
+		ctx       context.Context,
+		pid       string,
+		name      string,
+		retention time.Duration,
+	) (bool, error)
+	/*
+	 * Read the parts after the cursor, starting at the first part for the
+	 * empty cursor. Blocks until at least one part is available or the context
+	 * is cancelled. Returns the parts, and the cursor to continue from.
+	 */
+	Read(
+		ctx    context.Context,
+		pid    string,
+		cursor string,
+	) ([]Part, string, error)
+}
@@ -0,0 +1,284 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnqueuedAtFromStreamID(t *testing.T) {
+	enqueued, err := enqueuedAt("1526919030474-55")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1526919030474), enqueued.UnixNano() / 1e6)
+
+	_, err = enqueuedAt("not-an-id")
+	assert.Error(t, err)
+}
+
+func TestMemoryJobsReadsInOrder(t *testing.T) {
+	ctx  := context.Background()
+	jobs := NewMemoryJobs()
+	err  := jobs.Enqueue(
+		ctx,
+		Task { Pid: "pid", Part: "0/2" },
+		Task { Pid: "pid", Part: "1/2" },
+	)
+	assert.NoError(t, err)
+
+	for _, part := range []string { "0/2", "1/2" } {
+		tasks, err := jobs.Read(ctx, "consumer", time.Second)
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+		assert.Equal(t, part, tasks[0].Part)
+		assert.False(t, tasks[0].Enqueued.IsZero(), "want enqueued time")
+	}
+}
+
+func TestPriorityStreamKeepsInteractiveName(t *testing.T) {
+	assert.Equal(t, "jobs",       PriorityStream("jobs", Interactive))
+	assert.Equal(t, "jobs-batch", PriorityStream("jobs", Batch))
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range Priorities {
+		parsed, err := ParsePriority(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParsePriority("urgent")
+	assert.Error(t, err)
+}
+
+func TestReadOrderPreventsStarvation(t *testing.T) {
+	order := readorder{}
+	lowfirst := 0
+	for i := 0; i < 10 * starvationInterval; i++ {
+		o := order.next()
+		assert.ElementsMatch(t, Priorities, o)
+		if o[0] != Interactive {
+			lowfirst++
+		}
+	}
+	assert.Equal(t, 10, lowfirst)
+}
+
+func TestMemoryJobsReadsHigherPriorityFirst(t *testing.T) {
+	ctx  := context.Background()
+	jobs := NewMemoryJobs()
+	err  := jobs.Enqueue(
+		ctx,
+		Task { Pid: "export", Part: "0/1", Priority: Batch },
+		Task { Pid: "inline", Part: "0/1", Priority: Interactive },
+	)
+	assert.NoError(t, err)
+
+	tasks, err := jobs.Read(ctx, "consumer", time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, "inline", tasks[0].Pid)
+
+	tasks, err = jobs.Read(ctx, "consumer", time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, "export", tasks[0].Pid)
+	assert.Equal(t, Batch, tasks[0].Priority)
+}
+
+func TestMemoryJobsBatchIsNotStarved(t *testing.T) {
+	ctx  := context.Background()
+	jobs := NewMemoryJobs()
+	jobs.Enqueue(ctx, Task { Pid: "export", Priority: Batch })
+	for i := 0; i < starvationInterval; i++ {
+		jobs.Enqueue(ctx, Task { Pid: "inline", Priority: Interactive })
+	}
+
+	pids := []string{}
+	for i := 0; i < starvationInterval; i++ {
+		tasks, err := jobs.Read(ctx, "consumer", time.Second)
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+		pids = append(pids, tasks[0].Pid)
+	}
+	assert.Contains(t, pids, "export")
+}
+
+func TestMemoryJobsBacklog(t *testing.T) {
+	ctx  := context.Background()
+	jobs := NewMemoryJobs()
+	backlog, err := jobs.Backlog(ctx, Interactive)
+	assert.NoError(t, err)
+	assert.Equal(t, Backlog{}, backlog)
+	assert.Zero(t, backlog.Wait())
+
+	before := time.Now()
+	jobs.Enqueue(ctx, Task { Pid: "pid" }, Task { Pid: "pid" })
+	backlog, err = jobs.Backlog(ctx, Interactive)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, backlog.Tasks)
+	assert.False(t, backlog.Oldest.Before(before))
+
+	backlog, err = jobs.Backlog(ctx, Batch)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, backlog.Tasks)
+}
+
+func TestMemoryJobsReadTimesOutWhenEmpty(t *testing.T) {
+	jobs := NewMemoryJobs()
+	tasks, err := jobs.Read(context.Background(), "consumer", time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, tasks)
+}
+
+func TestMemoryJobsReadWakesOnEnqueue(t *testing.T) {
+	ctx  := context.Background()
+	jobs := NewMemoryJobs()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		jobs.Enqueue(ctx, Task { Pid: "pid", Part: "0/1" })
+	}()
+	tasks, err := jobs.Read(ctx, "consumer", 10 * time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 1)
+}
+
+func TestMemoryResultsHeaderNotFound(t *testing.T) {
+	results := NewMemoryResults(DefaultTTL)
+	_, err := results.Header(context.Background(), "pid")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryResultsClaimOnce(t *testing.T) {
+	ctx     := context.Background()
+	results := NewMemoryResults(DefaultTTL)
+
+	claimed, err := results.Claim(ctx, "pid", "callback", 0)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = results.Claim(ctx, "pid", "callback", 0)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	claimed, err = results.Claim(ctx, "pid", "other", 0)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestMemoryResultsReadFromCursor(t *testing.T) {
+	ctx     := context.Background()
+	results := NewMemoryResults(DefaultTTL)
+	results.Append(ctx, "pid", Part { Name: "0/2", Body: []byte("a") })
+
+	parts, cursor, err := results.Read(ctx, "pid", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []Part { { Name: "0/2", Body: []byte("a") } }, parts)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		results.Append(ctx, "pid", Part { Name: "1/2", Body: []byte("b") })
+	}()
+	parts, _, err = results.Read(ctx, "pid", cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, []Part { { Name: "1/2", Body: []byte("b") } }, parts)
+
+	count, err := results.Count(ctx, "pid")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	size, err := results.Size(ctx, "pid")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, size)
+}
+
+func TestMemoryResultsExpireAfterRetention(t *testing.T) {
+	ctx     := context.Background()
+	results := NewMemoryResults(DefaultTTL)
+	err := results.SetHeader(ctx, "pid", []byte("header"), time.Millisecond)
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = results.Header(ctx, "pid")
+	assert.Equal(t, ErrNotFound, err)
+
+	err = results.SetHeader(ctx, "other", []byte("header"), 0)
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = results.Header(ctx, "other")
+	assert.NoError(t, err, "want the store's ttl without retention")
+}
+
+func TestMemoryResultsReadIsCancellable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := NewMemoryResults(DefaultTTL).Read(ctx, "pid", "")
+	assert.Equal(t, context.Canceled, err)
+}
+
+/*
+ * A pipeline that records the keys of the commands queued on it.
+ */
+type recordingPipe struct {
+	redis.Pipeliner
+	cmds []string
+}
+
+func (p *recordingPipe) XAdd(
+	ctx  context.Context,
+	args *redis.XAddArgs,
+) *redis.StringCmd {
+	p.cmds = append(p.cmds, "XADD " + args.Stream)
+	return redis.NewStringResult("0-1", nil)
+}
+
+func (p *recordingPipe) IncrBy(
+	ctx   context.Context,
+	key   string,
+	value int64,
+) *redis.IntCmd {
+	p.cmds = append(p.cmds, "INCRBY " + key)
+	return redis.NewIntResult(value, nil)
+}
+
+func (p *recordingPipe) Expire(
+	ctx context.Context,
+	key string,
+	ttl time.Duration,
+) *redis.BoolCmd {
+	p.cmds = append(p.cmds, "EXPIRE " + key)
+	return redis.NewBoolResult(true, nil)
+}
+
+/*
+ * Only TxPipelined is implemented, so any command sent outside of a
+ * transaction panics on the nil Cmdable.
+ */
+type txClient struct {
+	redis.Cmdable
+	txs [][]string
+}
+
+func (c *txClient) TxPipelined(
+	ctx context.Context,
+	fn  func(redis.Pipeliner) error,
+) ([]redis.Cmder, error) {
+	pipe := &recordingPipe {}
+	err  := fn(pipe)
+	c.txs = append(c.txs, pipe.cmds)
+	return nil, err
+}
+
+func TestRedisResultsAppendIsSingleTransaction(t *testing.T) {
+	client  := &txClient {}
+	results := NewRedisResults(client, DefaultTTL)
+	part    := Part { Name: "0/1", Body: []byte("part") }
+	assert.NoError(t, results.Append(context.Background(), "pid", part))
+	assert.Equal(t, [][]string {{
+		"XADD pid",
+		"INCRBY {pid}/size",
+		"EXPIRE pid",
+		"EXPIRE {pid}/size",
+		"EXPIRE pid/header.json",
+	}}, client.txs)
+}
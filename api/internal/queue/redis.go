@@ -0,0 +1,481 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * The job queue as redis streams, one per priority class, read through a
+ * consumer group. Every entry is a task with the fields pid, part, task,
+ * user, retention (in milliseconds) and callback, see RedisValues.
+ */
+type RedisJobs struct {
+	client  redis.Cmdable
+	stream  string
+	group   string
+	deletes sync.WaitGroup
+	order   readorder
+}
+
+func NewRedisJobs(client redis.Cmdable, stream, group string) *RedisJobs {
+	return &RedisJobs {
+		client: client,
+		stream: stream,
+		group:  group,
+	}
+}
+
+/*
+ * Create the consumer group (and stream).
+ *
+ * The stream may have already been created, but that is a soft error to be
+ * discarded. In fact, the stream and group *probably* exists already because
+ * nodes connect in parallel.
+ *
+ * The XGroupCreate command is really just a try-create and fits well here,
+ * it offloads all the concurrency issues to redis. Consequently, consumers can
+ * immediately go into the work loop assuming that the stream and group
+ * exists, without having to do any chatter or sync.
+ */
+func (r *RedisJobs) CreateGroup(ctx context.Context) error {
+	for _, p := range Priorities {
+		stream := PriorityStream(r.stream, p)
+		err := r.client.XGroupCreateMkStream(ctx, stream, r.group, "0").Err()
+		if err != nil {
+			// Check if the response is a redis error (= BUSYGROUP), which just
+			// means the group already exists and nothing happens, or if it is
+			// a network error or something
+			_, busygroup := err.(interface{RedisError()})
+			if !busygroup {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * The fields of the stream entry of the task, for XADD.
+ */
+func RedisValues(task Task) []interface{} {
+	return []interface{} {
+		"pid",       task.Pid,
+		"part",      task.Part,
+		"task",      task.Body,
+		"user",      task.User,
+		"retention", task.Retention.Milliseconds(),
+		"callback",  task.Callback,
+	}
+}
+
+/*
+ * The counter of the tasks that are held back from the stream by the fair
+ * scheduler (see quota.Hold). They are not on the stream yet, but are part of
+ * its backlog.
+ */
+func HeldKey(stream string) string {
+	return fmt.Sprintf("%s/held", stream)
+}
+
+func (r *RedisJobs) Enqueue(ctx context.Context, tasks ...Task) error {
+	for _, task := range tasks {
+		args := &redis.XAddArgs {
+			Stream: PriorityStream(r.stream, task.Priority),
+			Values: RedisValues(task),
+		}
+		err := r.client.XAdd(ctx, args).Err()
+		if err != nil {
+			msg := "pid=%s, part=%v, unable to schedule: %w"
+			return fmt.Errorf(msg, task.Pid, task.Part, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Get the time a message was added to a stream. Redis stream IDs are on the
+ * form <milliseconds-since-epoch>-<seqno> when generated by redis (XADD *),
+ * which is always the case for the job queue.
+ */
+func enqueuedAt(id string) (time.Time, error) {
+	var ms, seq int64
+	_, err := fmt.Sscanf(id, "%d-%d", &ms, &seq)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed stream ID %s: %w", id, err)
+	}
+	return time.Unix(0, ms * int64(time.Millisecond)), nil
+}
+
+/*
+ * Read from the priority classes in order without blocking, and only block
+ * (on all classes at once) when they are all empty. The blocking read may
+ * return one task from every class that gets work at the same time.
+ */
+func (r *RedisJobs) Read(
+	ctx      context.Context,
+	consumer string,
+	block    time.Duration,
+) ([]Task, error) {
+	for _, p := range r.order.next() {
+		stream := PriorityStream(r.stream, p)
+		tasks, err := r.read(ctx, consumer, []string { stream, ">" }, -1)
+		if err != nil || len(tasks) > 0 {
+			return tasks, err
+		}
+	}
+
+	streams := make([]string, 0, 2 * len(Priorities))
+	for _, p := range Priorities {
+		streams = append(streams, PriorityStream(r.stream, p))
+	}
+	for range Priorities {
+		streams = append(streams, ">")
+	}
+	return r.read(ctx, consumer, streams, block)
+}
+
+/*
+ * Read one task from each of the streams. A negative block does not block.
+ */
+func (r *RedisJobs) read(
+	ctx      context.Context,
+	consumer string,
+	streams  []string,
+	block    time.Duration,
+) ([]Task, error) {
+	// NoAck is turned on - we can afford to fail requests and lose messages
+	// should a node crash.
+	args := redis.XReadGroupArgs {
+		Group:    r.group,
+		Consumer: consumer,
+		Streams:  streams,
+		Count:    1,
+		Block:    block,
+		NoAck:    true,
+	}
+	msgs, err := r.client.XReadGroup(ctx, &args).Result()
+	if err == redis.Nil {
+		// No new messages before the block timed out
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	priorities := make(map[string]Priority, len(Priorities))
+	for _, p := range Priorities {
+		priorities[PriorityStream(r.stream, p)] = p
+	}
+
+	/*
+	 * The redis interface is designed for asking for a set of messages per
+	 * XReadGroup command, but we really only ask for one per stream [1]. The
+	 * redis-go API is is aware of this which means the message structure must
+	 * be unpacked with nested loops.
+	 *
+	 * [1] Instead opting for multiple fragments to download per message.
+	 *     This is a design decision from before redis streams, but it works
+	 *     well with redis streams too.
+	 */
+	tasks := []Task{}
+	ids   := make(map[string][]string, len(msgs))
+	for _, xmsg := range msgs {
+		for _, msg := range xmsg.Messages {
+			/*
+			 * Curiously, the XReadGroup/XStream values end up being
+			 * map[string]string effectively. This is detail of the go library
+			 * where it uses ReadLine() internally - redis uses byte strings
+			 * as strings anyway.
+			 *
+			 * The type assertion is not checked and will panic. This is a
+			 * good thing as it should only happen when the redis library is
+			 * updated to no longer return strings, and crash oneseismic
+			 * properly. This should catch such a change early.
+			 */
+			task := Task {
+				ID:       msg.ID,
+				Pid:      msg.Values["pid" ].(string),
+				Part:     msg.Values["part"].(string),
+				Body:     []byte(msg.Values["task"].(string)),
+				Priority: priorities[xmsg.Stream],
+			}
+			/*
+			 * The user is optional, for tasks scheduled before it was added
+			 */
+			task.User, _ = msg.Values["user"].(string)
+			task.Callback, _ = msg.Values["callback"].(string)
+			task.Retention = parseRetention(msg.Values["retention"])
+			task.Enqueued, _ = enqueuedAt(msg.ID)
+			tasks = append(tasks, task)
+			ids[xmsg.Stream] = append(ids[xmsg.Stream], msg.ID)
+		}
+	}
+
+	r.deletes.Add(1)
+	go func() {
+		defer r.deletes.Done()
+		/*
+		 * Send a request-for-delete once the message has been read, in order
+		 * to stop the infinite growth of the job queue.
+		 *
+		 * This is the simplest solution that is correct [1] - the node that
+		 * gets a job also deletes it, which emulates a fire-and-forget job
+		 * queue. Unfortunately it also means more traffic back to the central
+		 * job queue node. In redis6.2 the XTRIM MINID strategy is introduced,
+		 * which opens up some interesting strategies for cleaning up the job
+		 * queue. This is work for later though.
+		 *
+		 * [1] except in some crashing scenarios
+		 */
+		for stream, ids := range ids {
+			err := r.client.XDel(ctx, stream, ids...).Err()
+			if err != nil {
+				zap.L().Fatal("unable to XDEL", zap.Error(err))
+			}
+		}
+	}()
+	return tasks, nil
+}
+
+/*
+ * Remove the consumer from the group, after the pending deletes complete.
+ * Jobs are read with NoAck, so there are no pending messages owned by this
+ * consumer that would be lost.
+ */
+func (r *RedisJobs) Leave(ctx context.Context, consumer string) error {
+	r.deletes.Wait()
+	for _, p := range Priorities {
+		stream := PriorityStream(r.stream, p)
+		err := r.client.XGroupDelConsumer(ctx, stream, r.group, consumer).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * The length of the stream, and the age of the first (oldest) entry. Read
+ * entries are deleted, so the first entry is the oldest task not yet read.
+ * The tasks held back by the fair scheduler are counted too, but they do not
+ * affect the age.
+ */
+func (r *RedisJobs) Backlog(ctx context.Context, p Priority) (Backlog, error) {
+	stream := PriorityStream(r.stream, p)
+	var length *redis.IntCmd
+	var held   *redis.StringCmd
+	var first  *redis.XMessageSliceCmd
+	/*
+	 * The held counter does not exist when no tasks were ever held back,
+	 * which fails the pipeline with redis.Nil, so the errors are checked per
+	 * command.
+	 */
+	r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		length = pipe.XLen(ctx, stream)
+		held   = pipe.Get(ctx, HeldKey(stream))
+		first  = pipe.XRangeN(ctx, stream, "-", "+", 1)
+		return nil
+	})
+	for _, err := range []error { length.Err(), first.Err(), held.Err() } {
+		if err != nil && err != redis.Nil {
+			return Backlog{}, err
+		}
+	}
+
+	nheld, _ := held.Int()
+	backlog  := Backlog { Tasks: int(length.Val()) + nheld }
+	if msgs := first.Val(); len(msgs) > 0 {
+		backlog.Oldest, _ = enqueuedAt(msgs[0].ID)
+	}
+	return backlog, nil
+}
+
+/*
+ * Parse the retention field of a task, in milliseconds. Zero if it is missing
+ * or malformed, i.e. the result store's time-to-live is used.
+ */
+func parseRetention(field interface{}) time.Duration {
+	s, ok := field.(string)
+	if !ok {
+		return 0
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+/*
+ * The result store in redis. The process header is a regular key, and the
+ * parts are entries in a stream named by the pid. The total size of the parts
+ * is kept in a counter next to the header, so that the size of a result is
+ * known without reading the stream.
+ */
+type RedisResults struct {
+	client redis.Cmdable
+	ttl    time.Duration
+}
+
+func NewRedisResults(client redis.Cmdable, ttl time.Duration) *RedisResults {
+	return &RedisResults {
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+/*
+ * Silly helper to centralise the name/key of the header object. It's not
+ * likely to change too much, but it beats hardcoding the key with formatting
+ * all over the place.
+ */
+func headerkey(pid string) string {
+	return fmt.Sprintf("%s/header.json", pid)
+}
+
+/*
+ * The pid is a hash tag, so that the size is in the same slot as the stream
+ * of parts (named by the pid) in redis cluster, and the two can be written in
+ * the same transaction.
+ */
+func sizekey(pid string) string {
+	return fmt.Sprintf("{%s}/size", pid)
+}
+
+func (r *RedisResults) SetHeader(
+	ctx       context.Context,
+	pid       string,
+	header    []byte,
+	retention time.Duration,
+) error {
+	ttl := keep(retention, r.ttl)
+	return r.client.Set(ctx, headerkey(pid), header, ttl).Err()
+}
+
+func (r *RedisResults) Header(ctx context.Context, pid string) ([]byte, error) {
+	header, err := r.client.Get(ctx, headerkey(pid)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return header, err
+}
+
+func (r *RedisResults) DeleteHeader(ctx context.Context, pid string) error {
+	return r.client.Del(ctx, headerkey(pid)).Err()
+}
+
+func (r *RedisResults) Append(ctx context.Context, pid string, part Part) error {
+	values := map[string]interface{}{part.Name: part.Body}
+	if len(part.TraceContext) > 0 {
+		tc, err := json.Marshal(part.TraceContext)
+		if err == nil {
+			values[message.TraceContextKey] = tc
+		}
+	}
+	args := redis.XAddArgs{
+		Stream: pid,
+		Values: values,
+	}
+	/*
+	 * The part and its size are written in one transaction, so that the size
+	 * is always the size of the parts in the stream. Were the size to lag
+	 * behind (or the INCRBY be lost), the Content-Length, ranges and ETag of
+	 * the result would be wrong.
+	 *
+	 * Refresh the header too, so that the header and the parts expire
+	 * together, retention after the last part is written. In redis cluster
+	 * the header is in another slot, and its expire is sent in a transaction
+	 * of its own.
+	 */
+	ttl := keep(part.Retention, r.ttl)
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &args)
+		pipe.IncrBy(ctx, sizekey(pid), int64(len(part.Body)))
+		pipe.Expire(ctx, pid, ttl)
+		pipe.Expire(ctx, sizekey(pid), ttl)
+		pipe.Expire(ctx, headerkey(pid), ttl)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisResults) Count(ctx context.Context, pid string) (int, error) {
+	count, err := r.client.XLen(ctx, pid).Result()
+	return int(count), err
+}
+
+func (r *RedisResults) Size(ctx context.Context, pid string) (int, error) {
+	size, err := r.client.Get(ctx, sizekey(pid)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return size, err
+}
+
+func claimkey(pid, name string) string {
+	return fmt.Sprintf("%s/claim/%s", pid, name)
+}
+
+func (r *RedisResults) Claim(
+	ctx       context.Context,
+	pid       string,
+	name      string,
+	retention time.Duration,
+) (bool, error) {
+	ttl := keep(retention, r.ttl)
+	return r.client.SetNX(ctx, claimkey(pid, name), 1, ttl).Result()
+}
+
+func (r *RedisResults) Read(
+	ctx    context.Context,
+	pid    string,
+	cursor string,
+) ([]Part, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	args := redis.XReadArgs{
+		Streams: []string{pid, cursor},
+		Block:   0,
+	}
+	reply, err := r.client.XRead(ctx, &args).Result()
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	parts := []Part{}
+	for _, entry := range reply[0].Messages {
+		tracecontext := map[string]string{}
+		if tc, ok := entry.Values[message.TraceContextKey].(string); ok {
+			json.Unmarshal([]byte(tc), &tracecontext)
+		}
+		for key, tile := range entry.Values {
+			if key == message.TraceContextKey {
+				continue
+			}
+
+			chunk, ok := tile.(string)
+			if !ok {
+				msg := "tile.type = %T; expected []byte]"
+				return nil, cursor, fmt.Errorf(msg, tile)
+			}
+			parts = append(parts, Part {
+				Name:         key,
+				Body:         []byte(chunk),
+				TraceContext: tracecontext,
+			})
+		}
+		cursor = entry.ID
+	}
+	return parts, cursor, nil
+}
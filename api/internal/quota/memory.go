@@ -0,0 +1,108 @@
+package quota
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+ * The usage of a single user.
+ */
+type usage struct {
+	/*
+	 * The tasks not yet done, per process
+	 */
+	processes map[string]int
+	bytes     int
+	/*
+	 * The end of the current bytes window
+	 */
+	window    time.Time
+}
+
+/*
+ * Quotas kept in memory, for tests. The usage is not shared between
+ * processes, and tasks are never held back, i.e. the share is ignored.
+ */
+type MemoryStore struct {
+	sync.Mutex
+	limits Limits
+	users  map[string]*usage
+}
+
+func NewMemoryStore(limits Limits) *MemoryStore {
+	return &MemoryStore {
+		limits: limits,
+		users:  make(map[string]*usage),
+	}
+}
+
+/*
+ * Get the usage of the user, creating it if it does not exist, with the
+ * bytes window reset if it has expired.
+ *
+ * Must be called with the lock held.
+ */
+func (m *MemoryStore) get(user string, now time.Time) *usage {
+	u, ok := m.users[user]
+	if !ok {
+		u = &usage { processes: make(map[string]int) }
+		m.users[user] = u
+	}
+	if now.After(u.window) {
+		u.bytes = 0
+	}
+	return u
+}
+
+func (m *MemoryStore) Admit(
+	ctx    context.Context,
+	user   string,
+	pid    string,
+	ntasks int,
+) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	u   := m.get(user, now)
+	tasks := 0
+	for _, n := range u.processes {
+		tasks += n
+	}
+	err := m.limits.check(
+		len(u.processes),
+		tasks,
+		ntasks,
+		u.bytes,
+		u.window.Sub(now),
+	)
+	if err != nil {
+		return err
+	}
+	u.processes[pid] = ntasks
+	return nil
+}
+
+func (m *MemoryStore) Done(ctx context.Context, user, pid string) error {
+	m.Lock()
+	defer m.Unlock()
+	u := m.get(user, time.Now())
+	u.processes[pid]--
+	if u.processes[pid] <= 0 {
+		delete(u.processes, pid)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Served(ctx context.Context, user string, bytes int) error {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	u   := m.get(user, now)
+	if u.bytes == 0 {
+		u.window = now.Add(m.limits.Window)
+	}
+	u.bytes += bytes
+	return nil
+}
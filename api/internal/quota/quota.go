@@ -0,0 +1,185 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+/*
+ * Per-user quotas, keyed on the caller identity, i.e. the object ID (oid) of
+ * the bearer token. A user is limited in
+ *
+ * - the number of concurrent processes, i.e. processes with tasks that are
+ *   not yet done
+ * - the number of tasks not yet done, across all the user's processes
+ * - the number of bytes served by /result per time window
+ *
+ * The query service admits new processes against the limits, the fetch
+ * workers mark the tasks as done, and the result service counts the bytes
+ * served. The counters must be shared by all the services, so they are kept
+ * in redis. The in-memory store is for tests.
+ *
+ * The store also counts the tasks a user has in the job queue, so that the
+ * scheduler can hold back the tasks of a user that already has its fair share
+ * of the queue (see Hold and api.NewFairScheduler). The held-back tasks are
+ * released by Done.
+ *
+ * Requests without a known user (no oid) are not subject to quotas.
+ */
+
+/*
+ * The retry-after hint given when a user is at the process or task limit.
+ * When tasks complete is not known up front, so this is only a hint to
+ * not retry immediately.
+ */
+const DefaultRetryAfter = 10 * time.Second
+
+/*
+ * The limits for every user. Zero (or less) means unlimited.
+ */
+type Limits struct {
+	Processes int
+	Tasks     int
+	Bytes     int
+	/*
+	 * The time window the byte limit applies to. The window is fixed, and
+	 * starts with the first bytes served to the user.
+	 */
+	Window    time.Duration
+}
+
+/*
+ * Returned by Admit when admitting the process would exceed the limit, which
+ * is one of processes, tasks, bytes.
+ */
+type ExceededError struct {
+	Limit      string
+	/*
+	 * When the user can expect to be admitted again. Zero when the query can
+	 * never be admitted, i.e. it has more tasks than the task limit.
+	 */
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	if e.RetryAfter == 0 {
+		return fmt.Sprintf("query exceeds the %s quota", e.Limit)
+	}
+	return fmt.Sprintf(
+		"%s quota exceeded; retry after %s",
+		e.Limit,
+		e.RetryAfter.Round(time.Second),
+	)
+}
+
+type Store interface {
+	/*
+	 * Admit the process pid with ntasks tasks for the user, or return an
+	 * *ExceededError if that would exceed the limits.
+	 */
+	Admit(ctx context.Context, user, pid string, ntasks int) error
+	/*
+	 * Mark a task of the process as done. Tasks are done when they complete,
+	 * successfully or not. If the user has tasks held back, the next one is
+	 * released to the job queue.
+	 */
+	Done(ctx context.Context, user, pid string) error
+	/*
+	 * Count bytes served to the user.
+	 */
+	Served(ctx context.Context, user string, bytes int) error
+}
+
+/*
+ * Check the limits, given the current usage. The bytes window should be
+ * reset (bytes = 0) by the caller when expired, and windowleft is the time
+ * left of it.
+ */
+func (l Limits) check(
+	processes  int,
+	tasks      int,
+	ntasks     int,
+	bytes      int,
+	windowleft time.Duration,
+) error {
+	if l.Tasks > 0 && ntasks > l.Tasks {
+		return &ExceededError { Limit: "tasks" }
+	}
+	if l.Bytes > 0 && bytes >= l.Bytes {
+		return &ExceededError { Limit: "bytes", RetryAfter: windowleft }
+	}
+	if l.Processes > 0 && processes >= l.Processes {
+		return &ExceededError {
+			Limit:      "processes",
+			RetryAfter: DefaultRetryAfter,
+		}
+	}
+	if l.Tasks > 0 && tasks + ntasks > l.Tasks {
+		return &ExceededError {
+			Limit:      "tasks",
+			RetryAfter: DefaultRetryAfter,
+		}
+	}
+	return nil
+}
+
+/*
+ * Middleware that counts the bytes served to the user. It should be
+ * registered after auth.ResultAuth, which verifies the token and provides the
+ * user.
+ */
+func Middleware(store Store) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Next()
+
+		user := auth.VerifiedUser(ctx).Oid
+		size := ctx.Writer.Size()
+		if user == "" || size <= 0 {
+			return
+		}
+		err := store.Served(ctx.Request.Context(), user, size)
+		if err != nil {
+			zap.L().Warn(
+				"unable to count bytes served",
+				zap.String("oid", user),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+/*
+ * Open the quota store of the queue backend, or nil if quotas are disabled.
+ * Quotas are only supported with the redis backend.
+ */
+func Open(cfg config.Quota, conn *queue.Conn, ttl time.Duration) (Store, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+	if conn.Redis == nil {
+		msg := "quotas are not supported by the %s queue backend"
+		return nil, fmt.Errorf(msg, conn.Backend)
+	}
+	if _, cluster := conn.Redis.(*redis.ClusterClient); cluster {
+		if cfg.FairShare > 0 {
+			return nil, errors.New("fair-share is not supported with redis cluster")
+		}
+	}
+	limits := Limits {
+		Processes: cfg.Processes,
+		Tasks:     cfg.Tasks,
+		Bytes:     cfg.Bytes,
+		Window:    cfg.Window,
+	}
+	return NewRedisStore(conn.Redis, conn.Stream, limits, ttl), nil
+}
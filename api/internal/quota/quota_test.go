@@ -0,0 +1,225 @@
+package quota
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.uber.org/zap"
+
+	"github.com/equinor/oneseismic/api/internal/audit"
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+func exceeded(t *testing.T, err error) *ExceededError {
+	e, ok := err.(*ExceededError)
+	if !ok {
+		t.Fatalf("expected *ExceededError; got %v", err)
+	}
+	return e
+}
+
+func TestAdmitLimitsProcesses(t *testing.T) {
+	ctx   := context.Background()
+	store := NewMemoryStore(Limits { Processes: 2 })
+	assert.NoError(t, store.Admit(ctx, "user", "pid-0", 1))
+	assert.NoError(t, store.Admit(ctx, "user", "pid-1", 1))
+
+	err := exceeded(t, store.Admit(ctx, "user", "pid-2", 1))
+	assert.Equal(t, "processes", err.Limit)
+	assert.Equal(t, DefaultRetryAfter, err.RetryAfter)
+
+	assert.NoError(t, store.Admit(ctx, "other", "pid-3", 1), "limits are per user")
+
+	assert.NoError(t, store.Done(ctx, "user", "pid-0"))
+	assert.NoError(t, store.Admit(ctx, "user", "pid-2", 1))
+}
+
+func TestAdmitLimitsTasks(t *testing.T) {
+	ctx   := context.Background()
+	store := NewMemoryStore(Limits { Tasks: 10 })
+	assert.NoError(t, store.Admit(ctx, "user", "pid-0", 6))
+
+	err := exceeded(t, store.Admit(ctx, "user", "pid-1", 5))
+	assert.Equal(t, "tasks", err.Limit)
+	assert.NotZero(t, err.RetryAfter)
+
+	assert.NoError(t, store.Done(ctx, "user", "pid-0"))
+	assert.NoError(t, store.Admit(ctx, "user", "pid-1", 5))
+}
+
+func TestAdmitNeverAdmitsQueriesLargerThanTaskLimit(t *testing.T) {
+	store := NewMemoryStore(Limits { Tasks: 10 })
+	err := exceeded(t, store.Admit(context.Background(), "user", "pid", 11))
+	assert.Equal(t, "tasks", err.Limit)
+	assert.Zero(t, err.RetryAfter)
+}
+
+func TestAdmitLimitsBytesPerWindow(t *testing.T) {
+	ctx   := context.Background()
+	store := NewMemoryStore(Limits { Bytes: 100, Window: 50 * time.Millisecond })
+	assert.NoError(t, store.Served(ctx, "user", 60))
+	assert.NoError(t, store.Admit(ctx, "user", "pid-0", 1))
+	assert.NoError(t, store.Served(ctx, "user", 60))
+
+	err := exceeded(t, store.Admit(ctx, "user", "pid-1", 1))
+	assert.Equal(t, "bytes", err.Limit)
+	assert.True(t, err.RetryAfter > 0 && err.RetryAfter <= 50 * time.Millisecond)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, store.Admit(ctx, "user", "pid-1", 1))
+}
+
+func TestMiddlewareCountsBytesServed(t *testing.T) {
+	keyring := auth.MakeKeyring([]byte("key"))
+	anonymous, err := keyring.Sign("pid", time.Minute)
+	assert.NoError(t, err)
+	signed, err := keyring.SignOnBehalfOf("pid", "user", "", time.Minute)
+	assert.NoError(t, err)
+
+	store := NewMemoryStore(Limits { Bytes: 10, Window: time.Hour })
+	app   := gin.New()
+	app.Use(auth.ResultAuth(&keyring))
+	app.Use(Middleware(store))
+	app.GET("/result/:pid", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "0123456789")
+	})
+
+	/*
+	 * Without a user (in the token) nothing is counted
+	 */
+	w   := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/result/pid", nil)
+	req.Header.Set("Authorization", "Bearer " + anonymous)
+	app.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, store.users)
+
+	req.Header.Set("Authorization", "Bearer " + signed)
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	err = store.Admit(context.Background(), "user", "pid", 1)
+	assert.Equal(t, "bytes", exceeded(t, err).Limit)
+}
+
+func TestMiddlewareIgnoresUnverifiedUser(t *testing.T) {
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims {
+		"oid": "user",
+	})
+	signed, err := forged.SignedString([]byte("other-key"))
+	assert.NoError(t, err)
+
+	store := NewMemoryStore(Limits { Bytes: 10, Window: time.Hour })
+	app   := gin.New()
+	app.Use(audit.Middleware(zap.NewNop()))
+	app.Use(Middleware(store))
+	app.GET("/result", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "0123456789")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/result", nil)
+	req.Header.Set("Authorization", "Bearer " + signed)
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, store.users, "want nothing counted for a claimed user")
+}
+
+/*
+ * A pipeline that records the commands of Hold rather than sending them.
+ */
+type holdPipe struct {
+	redis.Pipeliner
+	held   map[string][]interface{}
+	incrs  map[string]int64
+	evals  [][]string
+}
+
+func (p *holdPipe) RPush(
+	ctx    context.Context,
+	key    string,
+	values ...interface{},
+) *redis.IntCmd {
+	p.held[key] = append(p.held[key], values...)
+	return redis.NewIntResult(int64(len(values)), nil)
+}
+
+func (p *holdPipe) IncrBy(ctx context.Context, key string, n int64) *redis.IntCmd {
+	p.incrs[key] += n
+	return redis.NewIntResult(p.incrs[key], nil)
+}
+
+func (p *holdPipe) PExpire(
+	ctx context.Context,
+	key string,
+	ttl time.Duration,
+) *redis.BoolCmd {
+	return redis.NewBoolResult(true, nil)
+}
+
+func (p *holdPipe) Eval(
+	ctx    context.Context,
+	script string,
+	keys   []string,
+	args   ...interface{},
+) *redis.Cmd {
+	p.evals = append(p.evals, keys)
+	return redis.NewCmdResult(int64(0), nil)
+}
+
+func TestHoldQueuesEntriesForReleaseScript(t *testing.T) {
+	pipe := &holdPipe {
+		held:  make(map[string][]interface{}),
+		incrs: make(map[string]int64),
+	}
+	tasks := []queue.Task {
+		{ Pid: "pid", Part: "0/2", Body: []byte{ 0xff }, User: "user" },
+		{ Pid: "pid", Part: "1/2", Body: []byte{ 0x00 }, User: "user" },
+	}
+	for i := range tasks {
+		tasks[i].Priority  = queue.Batch
+		tasks[i].Retention = time.Minute
+	}
+	err := Hold(context.Background(), pipe, "jobs", 1, time.Minute, tasks)
+	assert.NoError(t, err)
+
+	entries := pipe.held["quota/{user}/held"]
+	assert.Len(t, entries, 2)
+	assert.Equal(t, map[string]int64 { "jobs-batch/held": 2 }, pipe.incrs)
+	assert.Equal(t, [][]string {{
+		"quota/{user}/tasks", "quota/{user}/held",
+		"jobs",               "jobs/held",
+		"jobs-batch",         "jobs-batch/held",
+	}}, pipe.evals)
+
+	/*
+	 * The release script reads the index of the priority first, which picks
+	 * the stream and held counter from its keys, followed by the fields of
+	 * the stream entry
+	 */
+	var entry []interface{}
+	assert.NoError(t, msgpack.Unmarshal(entries[1].([]byte), &entry))
+	assert.Equal(t, []interface{} {
+		int8(1),
+		"pid",       "pid",
+		"part",      "1/2",
+		"task",      []byte{ 0x00 },
+		"user",      "user",
+		"retention", int64(60000),
+		"callback",  "",
+	}, entry)
+}
+
+func TestHoldRefusesTasksOfDifferentUsers(t *testing.T) {
+	tasks := []queue.Task {
+		{ Pid: "pid-0", Part: "0/1", User: "user" },
+		{ Pid: "pid-1", Part: "0/1", User: "other" },
+	}
+	err := Hold(context.Background(), &holdPipe{}, "jobs", 1, time.Minute, tasks)
+	assert.Error(t, err)
+}
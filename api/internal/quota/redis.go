@@ -0,0 +1,325 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/equinor/oneseismic/api/internal/queue"
+)
+
+/*
+ * Quotas in redis. Every user has three keys:
+ *
+ *     quota/{oid}/tasks   hash of pid -> tasks not yet done, and the fields
+ *                         @queued with the tasks released to the job queue
+ *                         and @share with the fair share of the user
+ *     quota/{oid}/bytes   bytes served in the current window, which expires
+ *                         with the window
+ *     quota/{oid}/held    list of tasks held back by the fair scheduler, see
+ *                         Hold
+ *
+ * The oid is a hash tag so that the keys of a user are in the same slot in
+ * redis cluster, and the scripts can use both. Fair sharing moves tasks from
+ * the held list to the job queue, which is in another slot, and is not
+ * supported with redis cluster.
+ *
+ * Should a fetch worker crash, the tasks it was working on are never marked
+ * as done. The tasks key therefore expires when it has not been written to
+ * for ttl, so that the user is not locked out forever.
+ */
+type RedisStore struct {
+	client redis.Cmdable
+	stream string
+	limits Limits
+	ttl    time.Duration
+}
+
+/*
+ * The stream is the job queue that held-back tasks are released to, which
+ * must be the same as the one the fair scheduler holds them for.
+ */
+func NewRedisStore(
+	client redis.Cmdable,
+	stream string,
+	limits Limits,
+	ttl    time.Duration,
+) *RedisStore {
+	return &RedisStore {
+		client: client,
+		stream: stream,
+		limits: limits,
+		ttl:    ttl,
+	}
+}
+
+func taskskey(user string) string {
+	return fmt.Sprintf("quota/{%s}/tasks", user)
+}
+
+func byteskey(user string) string {
+	return fmt.Sprintf("quota/{%s}/bytes", user)
+}
+
+func heldkey(user string) string {
+	return fmt.Sprintf("quota/{%s}/held", user)
+}
+
+/*
+ * The keys of the release script: the tasks and held keys of the user,
+ * followed by the stream and held counter (see queue.HeldKey) of every
+ * priority, in the order of queue.Priorities.
+ */
+func releasekeys(user, stream string) []string {
+	keys := []string { taskskey(user), heldkey(user) }
+	for _, p := range queue.Priorities {
+		s := queue.PriorityStream(stream, p)
+		keys = append(keys, s, queue.HeldKey(s))
+	}
+	return keys
+}
+
+/*
+ * Register the process if the user is within the limits.
+ *
+ * KEYS = tasks, bytes
+ * ARGV = pid, ntasks, ttl (ms), max processes, max tasks, max bytes
+ *
+ * Returns 1 if the process is admitted, 0 if not, followed by the usage
+ * before registering the process: the number of processes, the tasks not
+ * done, the bytes served and the time left of the bytes window (ms).
+ */
+var admitscript = redis.NewScript(`
+local fields = redis.call('HGETALL', KEYS[1])
+local processes, tasks = 0, 0
+for i = 1, #fields, 2 do
+	if string.sub(fields[i], 1, 1) ~= '@' then
+		processes = processes + 1
+		tasks = tasks + tonumber(fields[i + 1])
+	end
+end
+local bytes  = tonumber(redis.call('GET', KEYS[2]) or '0')
+local window = redis.call('PTTL', KEYS[2])
+local usage  = { processes, tasks, bytes, window }
+
+local ntasks   = tonumber(ARGV[2])
+local maxprocs = tonumber(ARGV[4])
+local maxtasks = tonumber(ARGV[5])
+local maxbytes = tonumber(ARGV[6])
+if (maxprocs > 0 and processes >= maxprocs)
+	or (maxtasks > 0 and tasks + ntasks > maxtasks)
+	or (maxbytes > 0 and bytes >= maxbytes) then
+	return { 0, unpack(usage) }
+end
+redis.call('HSET', KEYS[1], ARGV[1], ntasks)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return { 1, unpack(usage) }
+`)
+
+/*
+ * Marks the task as done.
+ *
+ * KEYS = tasks
+ * ARGV = pid
+ *
+ * Returns the fair share of the user, or 0 if the user has no tasks held
+ * back, so that the caller knows to release them.
+ */
+var donescript = redis.NewScript(`
+local left = redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+if left <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+if tonumber(redis.call('HGET', KEYS[1], '@queued') or '0') > 0 then
+	redis.call('HINCRBY', KEYS[1], '@queued', -1)
+end
+return tonumber(redis.call('HGET', KEYS[1], '@share') or '0')
+`)
+
+/*
+ * Move held-back tasks of the user to the job queue until the user has share
+ * tasks queued. The held tasks are msgpack arrays of the index of the
+ * priority (see releasekeys) and the fields of the stream entry.
+ *
+ * KEYS = see releasekeys
+ * ARGV = ttl (ms), share
+ *
+ * The share is stored with the tasks of the user, so that releasing tasks
+ * does not depend on the configuration of the fetch workers. Without the
+ * share argument, the stored share is used.
+ */
+var releasescript = redis.NewScript(`
+local tasks, held = KEYS[1], KEYS[2]
+local share = tonumber(ARGV[2] or redis.call('HGET', tasks, '@share') or '0')
+if ARGV[2] then
+	redis.call('HSET', tasks, '@share', share)
+	redis.call('PEXPIRE', tasks, ARGV[1])
+end
+
+local queued   = tonumber(redis.call('HGET', tasks, '@queued') or '0')
+local released = 0
+while queued + released < share do
+	local entry = redis.call('LPOP', held)
+	if not entry then
+		break
+	end
+	local values  = cmsgpack.unpack(entry)
+	local stream  = KEYS[3 + 2 * values[1]]
+	local counter = KEYS[4 + 2 * values[1]]
+	redis.call('XADD', stream, '*', unpack(values, 2))
+	if tonumber(redis.call('GET', counter) or '0') > 0 then
+		redis.call('DECR', counter)
+	end
+	released = released + 1
+end
+if released > 0 then
+	redis.call('HINCRBY', tasks, '@queued', released)
+	redis.call('PEXPIRE', tasks, ARGV[1])
+end
+return released
+`)
+
+/*
+ * KEYS = bytes
+ * ARGV = bytes, window (ms)
+ */
+var servedscript = redis.NewScript(`
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return n
+`)
+
+/*
+ * The limits are checked by the script, so that checking and registering the
+ * process is atomic. When the process is not admitted, the usage is checked
+ * again in go to tell which limit was exceeded.
+ */
+func (r *RedisStore) Admit(
+	ctx    context.Context,
+	user   string,
+	pid    string,
+	ntasks int,
+) error {
+	keys := []string { taskskey(user), byteskey(user) }
+	args := []interface{} {
+		pid,
+		ntasks,
+		r.ttl.Milliseconds(),
+		r.limits.Processes,
+		r.limits.Tasks,
+		r.limits.Bytes,
+	}
+	reply, err := admitscript.Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return err
+	}
+	if len(reply) != 5 {
+		return fmt.Errorf("unexpected reply from quota script: %v", reply)
+	}
+	if reply[0] == 1 {
+		return nil
+	}
+	err = r.limits.check(
+		int(reply[1]),
+		int(reply[2]),
+		ntasks,
+		int(reply[3]),
+		time.Duration(reply[4]) * time.Millisecond,
+	)
+	if err == nil {
+		return fmt.Errorf("quota script rejected admitted usage %v", reply)
+	}
+	return err
+}
+
+/*
+ * Marks the task as done, and releases the held-back tasks it made room for.
+ * The tasks are released by a separate script, which is only run when the
+ * user has a fair share, since the job queue is in another slot in redis
+ * cluster.
+ */
+func (r *RedisStore) Done(ctx context.Context, user, pid string) error {
+	keys := []string { taskskey(user) }
+	share, err := donescript.Run(ctx, r.client, keys, pid).Int64()
+	if err != nil || share <= 0 {
+		return err
+	}
+	keys = releasekeys(user, r.stream)
+	ttl := r.ttl.Milliseconds()
+	return releasescript.Run(ctx, r.client, keys, ttl).Err()
+}
+
+func (r *RedisStore) Served(ctx context.Context, user string, bytes int) error {
+	keys   := []string { byteskey(user) }
+	window := r.limits.Window.Milliseconds()
+	return servedscript.Run(ctx, r.client, keys, bytes, window).Err()
+}
+
+/*
+ * Hold back the tasks of a user, as part of the transaction tx, and release
+ * as many as the user has share for to the job queue. The rest are released
+ * by Done as the user's tasks are done. The tasks must all be of the same
+ * user.
+ *
+ * The held tasks expire after ttl, like the process they belong to. The tasks
+ * are counted in the held counter of their stream, so that the backlog of the
+ * job queue includes them.
+ */
+func Hold(
+	ctx    context.Context,
+	tx     redis.Pipeliner,
+	stream string,
+	share  int,
+	ttl    time.Duration,
+	tasks  []queue.Task,
+) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	user    := tasks[0].User
+	entries := make([]interface{}, len(tasks))
+	held    := make(map[string]int64)
+	for i, task := range tasks {
+		if task.User != user {
+			msg := "tasks of users %s and %s held together"
+			return fmt.Errorf(msg, user, task.User)
+		}
+		index := priorityindex(task.Priority)
+		if index < 0 {
+			return fmt.Errorf("task with unknown priority %d", task.Priority)
+		}
+		entry, err := msgpack.Marshal(append(
+			[]interface{} { index },
+			queue.RedisValues(task)...,
+		))
+		if err != nil {
+			return err
+		}
+		entries[i] = entry
+		s := queue.PriorityStream(stream, task.Priority)
+		held[queue.HeldKey(s)]++
+	}
+
+	tx.RPush(ctx, heldkey(user), entries...)
+	tx.PExpire(ctx, heldkey(user), ttl)
+	for key, n := range held {
+		tx.IncrBy(ctx, key, n)
+		tx.PExpire(ctx, key, ttl)
+	}
+	keys := releasekeys(user, stream)
+	return releasescript.Eval(ctx, tx, keys, ttl.Milliseconds(), share).Err()
+}
+
+func priorityindex(p queue.Priority) int {
+	for i, q := range queue.Priorities {
+		if q == p {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,117 @@
+//go:build redis
+// +build redis
+
+package quota
+
+/*
+ * Tests of the quota scripts against a real redis, since they are lua and
+ * not run by any of the other tests. Run with
+ *
+ *     REDIS_URL=localhost:6379 go test -tags redis ./internal/quota
+ *
+ * The keys are unique to every test, and expire shortly after.
+ */
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/config"
+	"github.com/equinor/oneseismic/api/internal/queue"
+	"github.com/equinor/oneseismic/api/internal/redisclient"
+)
+
+func redisClient(t *testing.T) redis.UniversalClient {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		url = "localhost:6379"
+	}
+	client, err := redisclient.New(config.Redis { URL: url })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatalf("redis at %s: %v", url, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func unique(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+}
+
+func TestRedisAdmitLimitsProcesses(t *testing.T) {
+	ctx    := context.Background()
+	client := redisClient(t)
+	user   := unique(t)
+	store  := NewRedisStore(client, "jobs", Limits { Processes: 1 }, time.Minute)
+
+	assert.NoError(t, store.Admit(ctx, user, "pid-0", 2))
+	err := exceeded(t, store.Admit(ctx, user, "pid-1", 1))
+	assert.Equal(t, "processes", err.Limit)
+
+	assert.NoError(t, store.Done(ctx, user, "pid-0"))
+	assert.NoError(t, store.Done(ctx, user, "pid-0"))
+	assert.NoError(t, store.Admit(ctx, user, "pid-1", 1))
+}
+
+func TestRedisDoneReleasesHeldTasks(t *testing.T) {
+	ctx    := context.Background()
+	client := redisClient(t)
+	user   := unique(t)
+	stream := unique(t)
+	batch  := queue.PriorityStream(stream, queue.Batch)
+	store  := NewRedisStore(client, stream, Limits {}, time.Minute)
+	t.Cleanup(func() {
+		client.Del(ctx, stream, batch, queue.HeldKey(stream), queue.HeldKey(batch))
+	})
+
+	tasks := []queue.Task {
+		{ Pid: "pid", Part: "0/3", Body: []byte{ 0 }, Priority: queue.Interactive },
+		{ Pid: "pid", Part: "1/3", Body: []byte{ 1 }, Priority: queue.Batch },
+		{ Pid: "pid", Part: "2/3", Body: []byte{ 2 }, Priority: queue.Batch },
+	}
+	for i := range tasks {
+		tasks[i].User      = user
+		tasks[i].Retention = time.Minute
+	}
+	assert.NoError(t, store.Admit(ctx, user, "pid", len(tasks)))
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return Hold(ctx, pipe, stream, 1, time.Minute, tasks)
+	})
+	assert.NoError(t, err)
+
+	/*
+	 * The store is not configured with a share, and releases tasks by the
+	 * share stored by Hold
+	 */
+	assert.Equal(t, int64(1), client.XLen(ctx, stream).Val())
+	assert.Equal(t, int64(0), client.XLen(ctx, batch).Val())
+	assert.Equal(t, "2", client.Get(ctx, queue.HeldKey(batch)).Val())
+
+	assert.NoError(t, store.Done(ctx, user, "pid"))
+	assert.Equal(t, int64(1), client.XLen(ctx, batch).Val())
+	assert.Equal(t, "1", client.Get(ctx, queue.HeldKey(batch)).Val())
+
+	entries, err := client.XRange(ctx, batch, "-", "+").Result()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "1/3",  entries[0].Values["part"])
+		assert.Equal(t, "\x01", entries[0].Values["task"])
+		assert.Equal(t, user,   entries[0].Values["user"])
+	}
+
+	assert.NoError(t, store.Done(ctx, user, "pid"))
+	assert.NoError(t, store.Done(ctx, user, "pid"))
+	assert.Equal(t, int64(2), client.XLen(ctx, batch).Val())
+	assert.Equal(t, "0", client.Get(ctx, queue.HeldKey(batch)).Val())
+	assert.Equal(t, int64(0), client.LLen(ctx, heldkey(user)).Val())
+	assert.False(t, client.HExists(ctx, taskskey(user), "pid").Val())
+}
@@ -0,0 +1,154 @@
+package redisclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/config"
+)
+
+/*
+ * Connect to Redis as configured by config.Redis. This is the only place
+ * oneseismic creates Redis clients, so that all binaries support the same set
+ * of deployments:
+ *
+ * - standalone: a single Redis, the default
+ * - sentinel:   a master/replica set monitored by Redis Sentinel. The address
+ *               list is the sentinels, not the Redis nodes
+ * - cluster:    a Redis Cluster. The address list is a seed list of nodes
+ *
+ * The client is a redis.UniversalClient, which is a redis.Cmdable, and most of
+ * oneseismic should be oblivious to the deployment.
+ */
+func New(cfg config.Redis) (redis.UniversalClient, error) {
+	opts, err := options(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Mode {
+	case "", "standalone":
+		return redis.NewClient(opts.Simple()), nil
+	case "sentinel":
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case "cluster":
+		return redis.NewClusterClient(opts.Cluster()), nil
+	default:
+		return nil, fmt.Errorf("unknown redis-mode %s", cfg.Mode)
+	}
+}
+
+/*
+ * Parse a single address, which is either a host:port or a redis:// or
+ * rediss:// URL.
+ */
+func parseAddr(addr string) (*redis.Options, error) {
+	if !strings.Contains(addr, "://") {
+		return &redis.Options{ Addr: addr }, nil
+	}
+	return redis.ParseURL(addr)
+}
+
+func options(cfg config.Redis) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{}
+
+	/*
+	 * The credentials, database and TLS are taken from the first address, and
+	 * should be the same for all the addresses in the list anyway.
+	 */
+	secure := cfg.Secure
+	for i, addr := range strings.Split(cfg.URL, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		parsed, err := parseAddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("redis-url: %w", err)
+		}
+		opts.Addrs = append(opts.Addrs, parsed.Addr)
+		if i == 0 {
+			opts.Username = parsed.Username
+			opts.Password = parsed.Password
+			opts.DB       = parsed.DB
+			secure = secure || parsed.TLSConfig != nil
+		}
+	}
+	if len(opts.Addrs) == 0 {
+		return nil, fmt.Errorf("redis-url: no address")
+	}
+
+	if cfg.Username != "" {
+		opts.Username = cfg.Username
+	}
+	if cfg.Password != "" {
+		opts.Password = cfg.Password
+	}
+	if cfg.DB != 0 {
+		opts.DB = cfg.DB
+	}
+	opts.SentinelPassword = cfg.SentinelPassword
+	opts.MasterName = cfg.MasterName
+
+	switch cfg.Mode {
+	case "", "standalone":
+	case "sentinel":
+		if opts.MasterName == "" {
+			return nil, fmt.Errorf("redis-mode sentinel requires redis-master")
+		}
+	case "cluster":
+		if opts.DB != 0 {
+			return nil, fmt.Errorf("redis-db is not supported in cluster mode")
+		}
+	default:
+		return nil, fmt.Errorf("unknown redis-mode %s", cfg.Mode)
+	}
+
+	if secure || cfg.CA != "" || cfg.Cert != "" {
+		tlsconfig, err := tlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsconfig
+	}
+	return opts, nil
+}
+
+/*
+ * The server name is not set, but filled in from the address when connecting,
+ * so that the same config works for all the nodes.
+ */
+func tlsConfig(cfg config.Redis) (*tls.Config, error) {
+	tlsconfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CA != "" {
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("redis-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("redis-ca: no certificates in %s", cfg.CA)
+		}
+		tlsconfig.RootCAs = pool
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		if cfg.Cert == "" || cfg.Key == "" {
+			return nil, fmt.Errorf("redis-cert and redis-key must both be set")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("redis-cert: %w", err)
+		}
+		tlsconfig.Certificates = []tls.Certificate{ cert }
+	}
+	return tlsconfig, nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+ * The Server is a http.Server with graceful shutdown, for services that run in
+ * an orchestrator like kubernetes which stops (and restarts) instances on
+ * every deploy, scale-down etc.
+ *
+ * Shutting down is done in phases:
+ * 1. the service is marked as not ready, so that load balancers stop routing
+ *    new requests to it. This is not instant, so the server keeps accepting
+ *    new requests for a little while (ReadinessDelay).
+ * 2. the listeners are closed, and active requests (including long-lived
+ *    streaming responses) are given some time to complete (DrainTimeout).
+ * 3. any connections still active are forcibly closed.
+ *
+ * When Run() returns, no handlers are running and it is safe to close
+ * database connection pools and the like.
+ */
+type Server struct {
+	http.Server
+	/*
+	 * Time given to active requests to complete after the listeners are
+	 * closed.
+	 */
+	DrainTimeout   time.Duration
+	/*
+	 * Time between marking the service as not ready and closing the
+	 * listeners.
+	 */
+	ReadinessDelay time.Duration
+
+	draining int32
+}
+
+func New(addr string, drain time.Duration) *Server {
+	return &Server {
+		Server:         http.Server { Addr: addr },
+		DrainTimeout:   drain,
+		ReadinessDelay: 5 * time.Second,
+	}
+}
+
+/*
+ * Ready is true until shutdown is initiated. It is intended as the readiness
+ * gate for health.Checker.
+ */
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.draining) == 0
+}
+
+/*
+ * Listen on s.Addr and serve until ctx is cancelled, then shut down
+ * gracefully. Usually ctx is cancelled on SIGTERM, see signal.NotifyContext.
+ */
+func (s *Server) Run(ctx context.Context) error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, listener)
+}
+
+/*
+ * Serve on the listener until ctx is cancelled, then shut down gracefully.
+ */
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	failure := make(chan error, 1)
+	go func() {
+		failure <- s.Server.Serve(listener)
+	}()
+
+	select {
+	case err := <-failure:
+		return err
+	case <-ctx.Done():
+	}
+
+	atomic.StoreInt32(&s.draining, 1)
+	delay := s.ReadinessDelay
+	if delay > s.DrainTimeout {
+		delay = s.DrainTimeout
+	}
+	zap.L().Info(
+		"shutting down; marked as not ready",
+		zap.Duration("closing-in", delay),
+	)
+	time.Sleep(delay)
+
+	zap.L().Info(
+		"waiting for active requests",
+		zap.Duration("timeout", s.DrainTimeout),
+	)
+	drain, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	defer cancel()
+	err := s.Shutdown(drain)
+	if err != nil {
+		zap.L().Warn(
+			"graceful shutdown failed; closing connections",
+			zap.Error(err),
+		)
+		s.Close()
+	}
+
+	/*
+	 * Serve() returns ErrServerClosed immediately when Shutdown() is called,
+	 * which is the expected outcome and not really an error.
+	 */
+	err = <-failure
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
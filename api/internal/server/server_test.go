@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownCompletesActiveRequests(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := New("", time.Second)
+	s.ReadinessDelay = 0
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(ctx, listener)
+	}()
+
+	type response struct {
+		body []byte
+		err  error
+	}
+	responses := make(chan response)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- response{ err: err }
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		responses <- response{ body: body, err: err }
+	}()
+
+	<-started
+	cancel()
+	// Give the server a moment to start draining before releasing the
+	// request, so that it is in-flight during shutdown
+	for s.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	res := <-responses
+	assert.NoError(t, res.err)
+	assert.Equal(t, "done", string(res.body))
+	assert.NoError(t, <-served)
+}
+
+func TestForcedCloseAfterDrainTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	s := New("", 10 * time.Millisecond)
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(ctx, listener)
+	}()
+	go http.Get("http://" + listener.Addr().String())
+
+	<-started
+	cancel()
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("Serve() did not return after drain timeout")
+	}
+}
@@ -0,0 +1,165 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ * OpenTelemetry tracing for oneseismic.
+ *
+ * A single request crosses multiple services (query, fetch, result) with
+ * redis in between, so the trace context must be carried along with the
+ * messages. The context is serialized as a plain string-to-string map (the
+ * W3C traceparent and tracestate headers), which is easy to embed in the JSON
+ * messages and redis streams.
+ */
+
+/*
+ * The trace context as carried in messages, see Inject() and Extract().
+ */
+type Carrier = map[string]string
+
+var propagator = propagation.TraceContext{}
+
+/*
+ * The oneseismic tracer. Spans are no-ops until Setup() is called, so it is
+ * always safe to trace.
+ */
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/equinor/oneseismic/api")
+}
+
+/*
+ * Configure the global tracer provider for the service. The exporter is one
+ * of:
+ *
+ * none   - tracing disabled (the default)
+ * stdout - pretty-print spans to stdout, useful for local development
+ * otlp   - export with OTLP over HTTP. If endpoint is empty, the
+ *          OTEL_EXPORTER_OTLP_ENDPOINT environment variable is honoured, and
+ *          otherwise localhost:4318 is used.
+ *
+ * The returned function flushes and stops the exporter, and should be called
+ * on shutdown.
+ */
+func Setup(
+	ctx      context.Context,
+	service  string,
+	exporter string,
+	endpoint string,
+) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+
+	case "stdout":
+		exp, err = stdouttrace.New(
+			stdouttrace.WithWriter(os.Stdout),
+			stdouttrace.WithPrettyPrint(),
+		)
+
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+
+	default:
+		return nil, fmt.Errorf(
+			"unknown tracing exporter '%s'; want none, stdout or otlp",
+			exporter,
+		)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(service),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+/*
+ * Serialize the trace context of ctx, for embedding in messages. Returns nil
+ * if there is no (valid) span in ctx.
+ */
+func Inject(ctx context.Context) Carrier {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier
+}
+
+/*
+ * Get a context with the (remote) trace context from a carrier, so that new
+ * spans become children of the span that injected the carrier. A nil or empty
+ * carrier gives ctx back as-is.
+ */
+func Extract(ctx context.Context, carrier Carrier) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+/*
+ * Get a context with the trace context from HTTP headers, if any, so that
+ * traces started by clients can be continued.
+ */
+func ExtractHTTP(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+/*
+ * Get a context with the span from ctx, but without the cancellation and
+ * deadline of ctx. This is useful when work outlives the request that
+ * started it, like scheduling a process after the promise is returned.
+ */
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+/*
+ * Common span attributes.
+ */
+func Pid(pid string) attribute.KeyValue {
+	return attribute.String("oneseismic.pid", pid)
+}
+
+func Part(part string) attribute.KeyValue {
+	return attribute.String("oneseismic.part", part)
+}
+
+func Guid(guid string) attribute.KeyValue {
+	return attribute.String("oneseismic.guid", guid)
+}
+
+func Function(function string) attribute.KeyValue {
+	return attribute.String("oneseismic.function", function)
+}
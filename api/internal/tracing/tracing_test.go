@@ -0,0 +1,40 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectWithoutSpanIsNil(t *testing.T) {
+	assert.Nil(t, Inject(context.Background()))
+}
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	ctx, span := provider.Tracer("test").Start(context.Background(), "query")
+	defer span.End()
+
+	carrier := Inject(ctx)
+	assert.Contains(t, carrier, "traceparent")
+
+	extracted := trace.SpanContextFromContext(
+		Extract(context.Background(), carrier),
+	)
+	assert.True(t, extracted.IsRemote())
+	assert.Equal(t, span.SpanContext().TraceID(), extracted.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(),  extracted.SpanID())
+}
+
+func TestExtractEmptyCarrierIsNoop(t *testing.T) {
+	ctx := Extract(context.Background(), nil)
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+}
+
+func TestSetupRejectsUnknownExporter(t *testing.T) {
+	_, err := Setup(context.Background(), "test", "jaeger", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,236 @@
+package util
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/equinor/oneseismic/api/internal/config"
+)
+
+/*
+ * The compressing writers of the supported codecs. They all buffer, so Flush
+ * must be called to get the data written so far out to the client, and Close
+ * to end the stream.
+ */
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+type compressWriter struct {
+	gin.ResponseWriter
+	writer encoder
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	return cw.writer.Write(b)
+}
+
+func (cw *compressWriter) WriteString(s string) (int, error) {
+	return cw.writer.Write([]byte(s))
+}
+
+/*
+ * Flush the data compressed so far to the client, so that streams (e.g.
+ * /result/:pid/stream) get their data as it is written, and not when the
+ * encoder's buffers happen to fill up.
+ */
+func (cw *compressWriter) Flush() {
+	cw.writer.Flush()
+	cw.ResponseWriter.Flush()
+}
+
+/*
+ * The codecs, in order of preference when the client accepts more than one
+ * equally. zstd compresses float seismic better and faster than gzip, and
+ * lz4 is the fastest, but compresses the least.
+ */
+var codecs = []string { "zstd", "lz4", "gzip" }
+
+/*
+ * The codec asked for with the ?compression=kind query. gz is the original
+ * name of gzip, and none (or identity) asks for no compression. Returns false
+ * if the query does not name a codec, in which case the codec should be
+ * negotiated.
+ */
+func queryCodec(kind string) (string, bool) {
+	switch kind {
+	case "gz", "gzip":
+		return "gzip", true
+	case "zstd", "lz4":
+		return kind, true
+	case "none", "identity":
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+/*
+ * Negotiate the codec from the Accept-Encoding header [1], or empty for no
+ * compression. The codec with the highest q-value wins, and ties are broken
+ * by the order of codecs. * is any codec not listed, and x-gzip is gzip.
+ *
+ * [1] https://www.rfc-editor.org/rfc/rfc9110#field.accept-encoding
+ */
+func negotiate(acceptEncoding string) string {
+	weights  := make(map[string]float64)
+	wildcard := -1.0
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name   := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			w, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil {
+				w = 0
+			}
+			q = w
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		weights[name] = q
+	}
+
+	best  := ""
+	bestq := 0.0
+	for _, codec := range codecs {
+		q, ok := weights[codec]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestq {
+			best  = codec
+			bestq = q
+		}
+	}
+	return best
+}
+
+/*
+ * Compress the response, with the codec asked for with a ?compression=kind
+ * query, or else negotiated with the Accept-Encoding header. The supported
+ * codecs are gzip, zstd and lz4.
+ *
+ * Range requests are not compressed unless asked for explicitly with the
+ * query, so that the ranges are of the result itself (see api.Result.Get).
+ *
+ * The implementation is roughly based on https://github.com/gin-contrib/gzip/
+ * with a couple of changed assumptions. The gin-contrib/gzip does not quite
+ * fit our usecase, and is very much geared towards compressing small
+ * text-responses and serving files, in a proper webserver fashion.
+ */
+func Compression(cfg config.Compression) gin.HandlerFunc {
+	// responses are not very compressible (usually compressible to half the
+	// size), and *speed* is the key anyway. Within the data centre it seems
+	// like the break-even for compression time vs. saved transport cost is at
+	// approx 20M responses.
+	//
+	// From a small rough experiment on a 14M response built from a 1.4M
+	// response concatenated 10 times indicates that there are no significant
+	// size improvements, but huge runtime costs in upping the compression
+	// level:
+	//
+	// $ time gzip -1 -c response.bin | wc -c
+	// 5812130
+	// real    0m0.286s
+	// $ time gzip -6 -c response.bin | wc -c
+	// 5330006
+	// real    0m1.230s
+	//
+	// zstd gives a much better trade-off between size and speed than gzip,
+	// and where the break-even is depends on the deployment, so its level is
+	// configurable (zstd-level) rather than fixed.
+
+	// make new writers from a pool. There is some overhead in creating new
+	// writers, and they're easily re-usable. Using a sync.pool seems to
+	// be the standard implementation for this.
+	//
+	// https://github.com/gin-contrib/gzip/blob/7bbc855cce8a575268c8f3e8d0f7a6a67f3dee65/handler.go#L22
+	zstdlevel := zstd.EncoderLevelFromZstd(cfg.ZstdLevel)
+	pools := map[string]*sync.Pool {
+		"gzip": {
+			New: func() interface {} {
+				gz, err := gzip.NewWriterLevel(ioutil.Discard, 1)
+				if err != nil {
+					panic(err)
+				}
+				return gz
+			},
+		},
+		"zstd": {
+			New: func() interface {} {
+				zw, err := zstd.NewWriter(
+					ioutil.Discard,
+					zstd.WithEncoderLevel(zstdlevel),
+					zstd.WithEncoderConcurrency(1),
+				)
+				if err != nil {
+					panic(err)
+				}
+				return zw
+			},
+		},
+		"lz4": {
+			New: func() interface {} {
+				return lz4.NewWriter(ioutil.Discard)
+			},
+		},
+	}
+
+	// It is very important that ctx.Next() is called - it effectively suspends
+	// this handler and performs the request, then resumes where it left off.
+	// It ensures that the Close(), Reset() and Put() are performed *after*
+	// everything is properly written, and resources can be cleaned up.
+	return func (ctx *gin.Context) {
+		codec, explicit := queryCodec(ctx.Query("compression"))
+		if !explicit && ctx.GetHeader("Range") == "" {
+			codec = negotiate(ctx.GetHeader("Accept-Encoding"))
+		}
+		/*
+		 * Whether the response is compressed depends on the Accept-Encoding,
+		 * which caches must know about.
+		 */
+		ctx.Header("Vary", "Accept-Encoding")
+		if codec == "" {
+			return
+		}
+
+		pool := pools[codec]
+		enc  := pool.Get().(encoder)
+		defer pool.Put(enc)
+		defer enc.Reset(ioutil.Discard)
+		defer enc.Close()
+
+		enc.Reset(ctx.Writer)
+		ctx.Writer = &compressWriter{ctx.Writer, enc}
+		ctx.Header("Content-Encoding", codec)
+		ctx.Next()
+
+		if (ctx.GetHeader("Transfer-Encoding") != "chunked") {
+			ctx.Header("Content-Length", fmt.Sprint(ctx.Writer.Size()))
+		}
+	}
+}
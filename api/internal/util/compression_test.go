@@ -0,0 +1,141 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/config"
+)
+
+func TestNegotiateCodec(t *testing.T) {
+	cases := []struct {
+		accept string
+		codec  string
+	}{
+		{ "",                         ""     },
+		{ "identity",                 ""     },
+		{ "gzip",                     "gzip" },
+		{ "x-gzip",                   "gzip" },
+		{ "gzip, deflate, br",        "gzip" },
+		{ "gzip, zstd",               "zstd" },
+		{ "gzip, lz4",                "lz4"  },
+		{ "zstd;q=0.5, gzip",         "gzip" },
+		{ "ZSTD;q=0.5, lz4;q=0.8",    "lz4"  },
+		{ "zstd;q=0, gzip;q=0.1",     "gzip" },
+		{ "zstd;q=0",                 ""     },
+		{ "*",                        "zstd" },
+		{ "*;q=0.5, gzip",            "gzip" },
+		{ "*, zstd;q=0",              "lz4"  },
+		{ "gzip;q=bad",               ""     },
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.codec, negotiate(c.accept), "Accept-Encoding: %s", c.accept)
+	}
+}
+
+func compressedGet(path, accept, rng string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	app := gin.New()
+	app.Use(Compression(config.DefaultCompression()))
+	app.GET("/result", func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/octet-stream", payload())
+	})
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func payload() []byte {
+	return bytes.Repeat([]byte("oneseismic "), 1000)
+}
+
+func decode(t *testing.T, codec string, body []byte) []byte {
+	var r io.Reader
+	switch codec {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		assert.NoError(t, err)
+		r = gz
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		assert.NoError(t, err)
+		defer zr.Close()
+		r = zr
+	case "lz4":
+		r = lz4.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+	decoded, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	return decoded
+}
+
+func TestCompressionNegotiatedRoundTrip(t *testing.T) {
+	for _, codec := range []string { "gzip", "zstd", "lz4" } {
+		w := compressedGet("/result", codec, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, codec, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		assert.Less(t, w.Body.Len(), len(payload()), "want %s compressed", codec)
+		assert.Equal(t, payload(), decode(t, codec, w.Body.Bytes()))
+	}
+}
+
+func TestCompressionQueryOverridesAcceptEncoding(t *testing.T) {
+	w := compressedGet("/result?compression=gz", "zstd", "")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, payload(), decode(t, "gzip", w.Body.Bytes()))
+
+	w = compressedGet("/result?compression=lz4", "", "")
+	assert.Equal(t, "lz4", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, payload(), decode(t, "lz4", w.Body.Bytes()))
+
+	w = compressedGet("/result?compression=none", "zstd", "")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, payload(), w.Body.Bytes())
+}
+
+func TestRangeRequestIsNotNegotiated(t *testing.T) {
+	w := compressedGet("/result", "zstd", "bytes=0-9")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+
+	w = compressedGet("/result?compression=zstd", "", "bytes=0-9")
+	assert.Equal(t, "zstd", w.Header().Get("Content-Encoding"))
+}
+
+func TestCompressedFlushWritesThrough(t *testing.T) {
+	for _, codec := range []string { "gzip", "zstd", "lz4" } {
+		gin.SetMode(gin.TestMode)
+		app := gin.New()
+		app.Use(Compression(config.DefaultCompression()))
+		flushed := 0
+		app.GET("/stream", func(ctx *gin.Context) {
+			ctx.Writer.Write(payload())
+			ctx.Writer.Flush()
+			flushed = ctx.Writer.Size()
+		})
+		req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		req.Header.Set("Accept-Encoding", codec)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		assert.Greater(t, flushed, 0, "want %s data written on flush", codec)
+	}
+}
@@ -1,15 +1,14 @@
 package util
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/url"
-	"sync"
-	"time"
+	"os"
+	"path"
 
 	"github.com/equinor/oneseismic/api/internal"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
@@ -25,77 +24,6 @@ func GeneratePID(ctx *gin.Context) {
 	ctx.Set("pid", MakePID())
 }
 
-type gzipWriter struct {
-	gin.ResponseWriter
-	writer *gzip.Writer
-}
-
-func (gz *gzipWriter) Write(b []byte) (int, error) {
-	return gz.writer.Write(b)
-}
-
-// Compress the response if requested with a ?compression=kind query
-//
-// The implementation is roughly based on https://github.com/gin-contrib/gzip/
-// with a couple of changed assumptions. The gin-contrib/gzip does not quite
-// fit our usecase, and is very much geared towards compressing small
-// text-responses and serving files, in a proper webserver fashion.
-func Compression() gin.HandlerFunc {
-	// responses are not very compressible (usually compressible to half the
-	// size), and *speed* is the key anyway. Within the data centre it seems
-	// like the break-even for compression time vs. saved transport cost is at
-	// approx 20M responses.
-	//
-	// From a small rough experiment on a 14M response built from a 1.4M
-	// response concatenated 10 times indicates that there are no significant
-	// size improvements, but huge runtime costs in upping the compression
-	// level:
-	//
-	// $ time gzip -1 -c response.bin | wc -c
-	// 5812130
-	// real    0m0.286s
-	// $ time gzip -6 -c response.bin | wc -c
-	// 5330006
-	// real    0m1.230s
-
-	// make new writers from a pool. There is some overhead in creating new
-	// gzip writers, and they're easily re-usable. Using a sync.pool seems to
-	// be the standard implementation for this.
-	//
-	// https://github.com/gin-contrib/gzip/blob/7bbc855cce8a575268c8f3e8d0f7a6a67f3dee65/handler.go#L22
-	gzpool := sync.Pool {
-		New: func() interface {} {
-			gz, err := gzip.NewWriterLevel(ioutil.Discard, 1)
-			if err != nil {
-				panic(err)
-			}
-			return gz
-		},
-	}
-
-	// It is very important that ctx.Next() is called - it effectively suspends
-	// this handler and performs the request, then resumes where it left off.
-	// It ensures that the Close(), Reset() and Put() are performed *after*
-	// everything is properly written, and resources can be cleaned up.
-	return func (ctx *gin.Context) {
-		if (ctx.Query("compression") == "gz") {
-			gz := gzpool.Get().(*gzip.Writer)
-			defer gzpool.Put(gz)
-			defer gz.Reset(ioutil.Discard)
-			defer gz.Close()
-
-			gz.Reset(ctx.Writer)
-			ctx.Writer = &gzipWriter{ctx.Writer, gz}
-			ctx.Header("Content-Encoding", "gzip")
-			ctx.Next()
-
-			if (ctx.GetHeader("Transfer-Encoding") != "chunked") {
-				ctx.Header("Content-Length", fmt.Sprint(ctx.Writer.Size()))
-			}
-		}
-	}
-}
-
 type GraphQLQuery struct {
 	Query         string                 `json:"query"`
 	OperationName string                 `json:"operationName"`
@@ -175,53 +103,82 @@ func UnpackAzStorageError(err error) error {
 }
 
 /*
- * Get the manifest for the cube from the blob store.
+ * Get the manifest for the cube from the blob store, and its ETag.
  *
  * It's important that this is a blocking read, since this is the first
  * authorization mechanism in oneseismic. If the user (through the
  * on-behalf-token) does not have permissions to read the manifest, it
  * shouldn't be able to read the cube either. If so, no more processing should
  * be done, and the request discarded.
+ *
+ * file:// URLs are read from the local filesystem, which is only meant for
+ * single-binary mode (oneseismic-server). A missing manifest is then an
+ * os.ErrNotExist, and the ETag is made from the modification time and size of
+ * the file.
+ *
+ * The ETag identifies this version of the manifest (and so of the cube), and
+ * is empty if the store does not give one.
  */
 func FetchManifest(
 	ctx          context.Context,
 	containerURL *url.URL,
-) ([]byte, error) {
+) ([]byte, string, error) {
+	if containerURL.Scheme == "file" {
+		/*
+		 * Don't let the guid climb out of the data directory
+		 */
+		dir := containerURL.Path
+		if path.Clean(dir) != dir {
+			return nil, "", fmt.Errorf("%s: %w", dir, os.ErrNotExist)
+		}
+		return readManifest(path.Join(dir, "manifest.json"))
+	}
+
 	container, err := azblob.NewContainerClientWithNoCredential(
 		containerURL.String(),
 		nil,
 	)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	blob    := container.NewBlobClient("manifest.json")
 	dl, err := blob.Download(ctx, &azblob.DownloadBlobOptions{})
 	if err != nil {
-		return nil, UnpackAzStorageError(err)
+		return nil, "", UnpackAzStorageError(err)
 	}
 
 	body := dl.Body(&azblob.RetryReaderOptions{})
 	defer body.Close()
-	return ioutil.ReadAll(body)
+	manifest, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	etag := ""
+	if dl.ETag != nil {
+		etag = *dl.ETag
+	}
+	return manifest, etag, nil
 }
 
-/*
- * Custom logger for the /query family of endpoints, that logs the id of the
- * process to be generated by the request (pid).
- */
-func QueryLogger(ctx *gin.Context) {
-	gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		return fmt.Sprintf("%s - [%s] \"pid=%s, %s %s %s %d %s %s\"\n",
-			param.ClientIP,
-			param.TimeStamp.Format(time.RFC1123),
-			param.Keys["pid"],
-			param.Method,
-			param.Path,
-			param.Request.Proto,
-			param.StatusCode,
-			param.Latency,
-			param.ErrorMessage,
-		)
-	})(ctx)
+func readManifest(path string) ([]byte, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+	manifest, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, "", err
+	}
+	etag := fmt.Sprintf(
+		"\"%x-%x\"",
+		info.ModTime().UnixNano(),
+		info.Size(),
+	)
+	return manifest, etag, nil
 }
@@ -2,6 +2,7 @@
 #define ONESEISMIC_MESSAGES_HPP
 
 #include <array>
+#include <map>
 #include <optional>
 #include <stdexcept>
 #include <string>
@@ -75,6 +76,12 @@ struct basic_query {
     std::string                 storage_endpoint;
     std::string                 function;
     std::vector< std::string >  attributes;
+    /*
+     * The (opentelemetry) trace context of the query, which is not used by
+     * the core library at all, but passed along to tasks so that the workers
+     * can continue the trace.
+     */
+    std::map< std::string, std::string > trace_context;
 
     const std::vector< int >& shape() const noexcept (false) {
         /*
@@ -108,7 +115,8 @@ struct basic_task {
         storage_endpoint (q.storage_endpoint),
         shape            (q.shape()),
         function         (q.function),
-        attribute        ("data")
+        attribute        ("data"),
+        trace_context    (q.trace_context)
     {
         this->shape_cube.reserve(q.manifest.line_numbers.size());
         for (const auto& d : q.manifest.line_numbers)
@@ -125,7 +133,8 @@ struct basic_task {
         storage_endpoint (q.storage_endpoint),
         shape            (attr.shapes.at(0)),
         function         (q.function),
-        attribute        (attr.type)
+        attribute        (attr.type),
+        trace_context    (q.trace_context)
     {
         this->shape_cube.reserve(q.manifest.line_numbers.size());
         for (const auto& d : q.manifest.line_numbers)
@@ -144,6 +153,7 @@ struct basic_task {
     std::vector< int > shape_cube;
     std::string        function;
     std::string        attribute;
+    std::map< std::string, std::string > trace_context;
 };
 
 /*
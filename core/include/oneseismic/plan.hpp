@@ -50,6 +50,20 @@ public:
     ~session();
 
     void init(const char* doc, int len) noexcept (false);
+
+    /*
+     * Planning is in two steps, so that the task size can be chosen from the
+     * number of fragments in the query. prepare_query() parses the query and
+     * builds the set of fragments, and returns the number of fragments.
+     * plan_query(task_size) then partitions the prepared query into tasks.
+     * A prepared query can only be planned once.
+     */
+    int prepare_query(const char* doc, int len) noexcept (false);
+    taskset plan_query(int task_size) noexcept (false);
+
+    /*
+     * Prepare and plan in one go, when the task size is known up front.
+     */
     taskset plan_query(
         const char* doc,
         int len,
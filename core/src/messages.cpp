@@ -233,6 +233,10 @@ void from_json(const nlohmann::json& doc, basic_query& query) noexcept (false) {
     doc.at("storage_endpoint").get_to(query.storage_endpoint);
     doc.at("function")        .get_to(query.function);
 
+    const auto traceitr = doc.find("trace-context");
+    if (traceitr != doc.end())
+        traceitr->get_to(query.trace_context);
+
     const auto optsitr = doc.find("opts");
     if (optsitr == doc.end()) return;
 
@@ -254,6 +258,8 @@ void to_json(nlohmann::json& doc, const basic_task& task) noexcept (false) {
     doc["shape-cube"]       = task.shape_cube;
     doc["function"]         = task.function;
     doc["attribute"]        = task.attribute;
+    if (!task.trace_context.empty())
+        doc["trace-context"] = task.trace_context;
     assert(task.shape_cube.size() == task.shape.size());
 }
 
@@ -268,6 +274,10 @@ void from_json(const nlohmann::json& doc, basic_task& task) noexcept (false) {
     doc.at("shape-cube")      .get_to(task.shape_cube);
     doc.at("function")        .get_to(task.function);
     doc.at("attribute")       .get_to(task.attribute);
+
+    const auto traceitr = doc.find("trace-context");
+    if (traceitr != doc.end())
+        traceitr->get_to(task.trace_context);
 }
 
 void to_json(nlohmann::json& doc, const process_header& head) noexcept (false) {
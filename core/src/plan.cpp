@@ -1,6 +1,8 @@
 #include <algorithm>
 #include <cassert>
+#include <functional>
 #include <iterator>
+#include <numeric>
 #include <sstream>
 #include <string>
 #include <vector>
@@ -410,6 +412,14 @@ noexcept (false) {
 
 
 
+template< typename Outputs >
+int count_fragments(const Outputs& outputs) noexcept (true) {
+    const auto add = [](auto acc, const auto& elem) noexcept (true) {
+        return acc + int(elem.ids.size());
+    };
+    return std::accumulate(outputs.begin(), outputs.end(), 0, add);
+}
+
 template< typename Outputs >
 int count_tasks(const Outputs& outputs, int task_size) noexcept (true) {
     const auto add = [task_size](auto acc, const auto& elem) noexcept (true) {
@@ -525,6 +535,11 @@ std::string pack_with_envelope(const process_header& head) {
  *  the shape (slice, curtain, horizon etc) and comes with no default
  *  implementation.
  *
+ * int count_fragments(vector< Output >)
+ *  The number of fragments in the schedule, which is what the task size is
+ *  usually chosen from. Building the schedule is the expensive part, so it is
+ *  built once, counted, and then partitioned with the chosen task size.
+ *
  * process_header header(Input, ntasks)
  *  Make a header. This function requires deep knowledge of the shape and
  *  oneseismic geometry, and must be implemented for all shape types.
@@ -538,17 +553,28 @@ std::string pack_with_envelope(const process_header& head) {
  *  metadata to make sense of data as it is streamed.
  */
 
+/*
+ * A query that is built, but not yet partitioned. Call it with the task size
+ * to partition it.
+ */
+using prepared_query = std::function< taskset (int) >;
+
 template < typename Input >
-taskset schedule(Input& in, const char* doc, int len, int task_size)
+prepared_query prepare(const char* doc, int len, int& nfragments)
 noexcept (false) {
+    Input in;
     in.unpack(doc, doc + len);
     in.attributes = normalized_attributes(in);
     auto fetch = build(in);
-    auto sched = partition(fetch, task_size);
-    const auto ntasks = int(sched.count());
-    const auto head   = header(in, ntasks);
-    sched.append(pack_with_envelope(head));
-    return sched;
+    nfragments = count_fragments(fetch);
+
+    return [in = std::move(in), fetch = std::move(fetch)](int task_size) mutable {
+        auto sched = partition(fetch, task_size);
+        const auto ntasks = int(sched.count());
+        const auto head   = header(in, ntasks);
+        sched.append(pack_with_envelope(head));
+        return sched;
+    };
 }
 
 }
@@ -557,6 +583,11 @@ class session::impl {
 public:
     nlohmann::json document;
     manifestdoc    manifest;
+    /*
+     * The query prepared by prepare_query(), until it is planned. partition()
+     * changes the schedule in-place, so it can only be planned once.
+     */
+    prepared_query prepared;
 };
 
 session::session() : self(std::make_unique<impl>()) {}
@@ -581,8 +612,7 @@ void session::init(const char* doc, int len) noexcept (false) {
     self->document = std::move(parsed);
 }
 
-taskset session::plan_query( const char* doc, int len, int task_size)
-noexcept (false) {
+int session::prepare_query(const char* doc, int len) noexcept (false) {
     const auto document = nlohmann::json::parse(doc, doc + len);
     /*
      * Right now, only format-version: 1 is supported, but checking the format
@@ -600,18 +630,34 @@ noexcept (false) {
         throw bad_document(msg);
     }
 
+    int nfragments = 0;
     const std::string function = document.at("function");
     if (function == "slice") {
-        slice_query q;
-        return schedule(q, doc, len, task_size);
+        self->prepared = prepare< slice_query >(doc, len, nfragments);
+        return nfragments;
     }
     if (function == "curtain") {
-        curtain_query q;
-        return schedule(q, doc, len, task_size);
+        self->prepared = prepare< curtain_query >(doc, len, nfragments);
+        return nfragments;
     }
     throw std::logic_error("No handler for function " + function);
 }
 
+taskset session::plan_query(int task_size) noexcept (false) {
+    if (not self->prepared) {
+        throw std::logic_error("plan_query() without a prepared query");
+    }
+    auto prepared = std::move(self->prepared);
+    self->prepared = nullptr;
+    return prepared(task_size);
+}
+
+taskset session::plan_query(const char* doc, int len, int task_size)
+noexcept (false) {
+    this->prepare_query(doc, len);
+    return this->plan_query(task_size);
+}
+
 std::string session::query_manifest(const std::string& path) const
 noexcept (false) {
     nlohmann::json::json_pointer ptr(path);
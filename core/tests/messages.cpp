@@ -21,6 +21,7 @@ bool operator == (const one::basic_task& lhs, const one::basic_task& rhs) {
         && lhs.storage_endpoint == rhs.storage_endpoint
         && lhs.shape            == rhs.shape
         && lhs.function         == rhs.function
+        && lhs.trace_context    == rhs.trace_context
     ;
 }
 
@@ -460,6 +461,9 @@ TEST_CASE("slice-task can round trip packing") {
         { 0, 1, 2 },
         { 3, 4, 5 },
     };
+    task.trace_context = {
+        { "traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01" },
+    };
 
     const auto packed = task.pack();
     INFO(packed);